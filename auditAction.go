@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/mxk/go-imap/imap"
+	"golang.org/x/crypto/openpgp"
+)
+
+// DefaultAuditSampleSize is the default number of messages per folder which
+// are checked by the audit action.
+const DefaultAuditSampleSize = 100
+
+// AuditAction provides the context for the audit action, which checks that
+// a random sample of the encrypted messages can be decrypted using the
+// recovery key alone.
+type AuditAction struct {
+	MailboxAction
+	recoveryKey *openpgp.Entity
+}
+
+// Run starts the AuditAction.
+func (a *AuditAction) Run(ctx *cli.Context) {
+	a.ctx = ctx
+	err := a.loadConfig()
+	if err != nil {
+		os.Exit(1)
+	}
+	// nothing is modified and the results are reported like in a dry run
+	a.dryRun = true
+
+	accounts, err := a.accounts()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	err = a.runAccounts(accounts, a.parallelAccounts, func(account *MailboxAction) error {
+		aa := &AuditAction{MailboxAction: *account}
+		return aa.run()
+	})
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// run checks the encrypted mails of the action's account.
+func (a *AuditAction) run() error {
+	if a.cfg.PGP.RecoveryKey == "" {
+		logger.Errorf("audit requires pgp.recovery_key")
+		return errors.New("no recovery key configured")
+	}
+	sampleSize := a.flagInt("sample")
+	if sampleSize < 1 {
+		sampleSize = DefaultAuditSampleSize
+	}
+	// the encrypted messages are read from the target server; messages
+	// are never deleted, no matter what the config says
+	cfg := *a.cfg
+	cfg.Mailbox.DeletePlainCopies = false
+	a.cfg = &cfg
+	a.sourceServer = a.targetServer
+	defer a.clearCredentials()
+
+	agent, err := a.gpgAgent()
+	if err != nil {
+		return err
+	}
+	a.recoveryKey, err = loadPrivateKey(a.cfg.PGP.RecoveryKeyPath, a.cfg.PGP.RecoveryKey,
+		func() ([]byte, error) {
+			return a.cfg.PGP.RecoveryKeyPassphraseSecret().Resolve(
+				"Passphrase for recovery key " + a.cfg.PGP.RecoveryKey)
+		}, agent)
+	if err != nil {
+		logger.Errorf("failed to load private recovery key: %s", err)
+		return err
+	}
+
+	err = a.setupSource()
+	if err != nil {
+		return err
+	}
+	defer a.closeSource()
+	a.source.SetSampleSize(sampleSize)
+
+	for _, folder := range a.encryptedFolders() {
+		logger.Infof("auditing folder=%s", folder)
+		a.summary.StartFolder(folder)
+		err = a.source.IterateEncrypted(folder, a.auditMail)
+		if err != nil {
+			logger.Errorf("folder iteration failed")
+			return err
+		}
+	}
+	if failed := a.summary.Failed(); failed > 0 {
+		return fmt.Errorf("%d messages cannot be decrypted using the recovery key", failed)
+	}
+	return nil
+}
+
+// encryptedFolders returns the configured target folders, which contain the
+// encrypted messages.
+func (a *AuditAction) encryptedFolders() []string {
+	seen := make(map[string]bool)
+	var folders []string
+	for sourceFolder, targetFolder := range a.cfg.Mailbox.Folders {
+		if targetFolder == "" {
+			targetFolder = sourceFolder
+		}
+		if !seen[targetFolder] {
+			seen[targetFolder] = true
+			folders = append(folders, targetFolder)
+		}
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// auditMail is called for each sampled message and decrypts it using the
+// recovery key. The returned function records the result.
+func (a *AuditAction) auditMail(rec *JournalRecord, flags imap.FlagSet, idate *time.Time,
+	encMail imap.Literal) MessageStoreFunc {
+	origMail, err := a.recoverMail(encMail)
+	return func() error {
+		defer closeLiteral(origMail)
+		a.summary.Record(idate, encMail, origMail, err)
+		return err
+	}
+}
+
+// recoverMail decrypts the given message using only the private recovery
+// key. The signature is not verified, as the signing key is usually not
+// available to whoever holds the recovery key; use the decrypt action for
+// that.
+func (a *AuditAction) recoverMail(encMail imap.Literal) (imap.Literal, error) {
+	d := NewPGPDecryptor(nil, openpgp.EntityList{a.recoveryKey}, a.spooler)
+	defer d.Close()
+	_, err := encMail.WriteTo(d)
+	if err != nil {
+		return nil, err
+	}
+	decReader, err := d.GetNonVerifyingReader()
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt using the recovery key: %s", err)
+	}
+	if !d.IsLemoncrypt() {
+		return nil, errors.New("message has not been encrypted by lemoncrypt")
+	}
+	origMail := a.spooler.NewBuffer()
+	// reading the whole message checks its integrity
+	_, err = io.Copy(origMail, decReader)
+	if err != nil {
+		origMail.Close()
+		return nil, fmt.Errorf("decryption failed: %s", err)
+	}
+	logger.Infof("message can be decrypted using the recovery key")
+	return origMail, nil
+}
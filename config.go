@@ -1,27 +1,395 @@
 package main
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
 
 // Config defines the structure of the TOML config file and represents the
 // stored values.
 type Config struct {
-	Server struct {
-		Address  string
-		Username string
-		Password string
-	}
-	Mailbox struct {
-		Folders           map[string]string
-		DeletePlainCopies bool
-		MinAgeInDays      time.Duration
-	}
-	PGP struct {
-		EncryptionKeyPath       string
-		EncryptionKeyID         string `toml:"encryption_key_id"`
-		EncryptionKeyPassphrase string
-		SigningKeyPath          string
-		SigningKeyID            string `toml:"signing_key_id"`
-		SigningKeyPassphrase    string
-		PlainHeaders            []string
+	Server   ServerConfig
+	Source   ServerConfig
+	Target   ServerConfig
+	Mailbox  MailboxConfig
+	Accounts []AccountConfig `toml:"account"`
+	Watch    struct {
+		RescanIntervalInMinutes time.Duration
 	}
+	Spool struct {
+		Dir         string
+		ThresholdMB int64 `toml:"threshold_mb"`
+	}
+	PGP PGPConfig
+
+	// account is the name of the account this config has been derived
+	// from by AccountConfigs.
+	account string
+}
+
+// AccountConfig contains the settings of a single account in configs which
+// define several accounts. The PGP settings are optional; the global ones
+// are used if they are omitted.
+type AccountConfig struct {
+	Name    string
+	Server  ServerConfig
+	Source  ServerConfig
+	Target  ServerConfig
+	Mailbox MailboxConfig
+	PGP     PGPConfig
+}
+
+// MailboxConfig contains the settings which define which messages are
+// processed and where the results are stored.
+type MailboxConfig struct {
+	Folders           map[string]string
+	DeletePlainCopies bool
+	ExpungeFallback   string
+	MinAgeInDays      time.Duration
+	JournalPath       string
+	BatchSize         int
+	BatchSizeMB       int64 `toml:"batch_size_mb"`
+	Filter            SearchFilter
+	FolderFilters     map[string]SearchFilter
+}
+
+// PGPConfig contains the settings of the keys used for encryption and
+// signing.
+type PGPConfig struct {
+	EncryptionKeyPath       string
+	EncryptionKeyID         string   `toml:"encryption_key_id"`
+	EncryptionKeyIDs        []string `toml:"encryption_key_ids"`
+	EncryptionKeyPassphrase string
+	SigningKeyPath          string
+	SigningKeyID            string `toml:"signing_key_id"`
+	SigningKeyPassphrase    string
+	PlainHeaders            []string
+
+	// GPGAgent enables delegating signing and decryption to gpg-agent for
+	// keys whose private parts are not contained in the keyrings. GnuPGHome
+	// selects the agent (default: $GNUPGHOME or ~/.gnupg).
+	GPGAgent  bool   `toml:"gpg_agent"`
+	GnuPGHome string `toml:"gnupg_home"`
+
+	// EphemeralVerification makes the round-trip verification use a key
+	// which is generated at startup instead of the private encryption
+	// keys, see PGPTransformer.GenerateEphemeralKey.
+	EphemeralVerification bool `toml:"ephemeral_verification"`
+
+	// FolderEncryptionKeyIDs replaces EncryptionKeyIDs for the given source
+	// folders.
+	FolderEncryptionKeyIDs map[string][]string `toml:"folder_encryption_key_ids"`
+
+	// RecoveryKey is the id of a key which every message is encrypted to in
+	// addition to the other recipients. Its public key is read from
+	// RecoveryKeyPath (default: EncryptionKeyPath); the private key is only
+	// needed by the audit command.
+	RecoveryKey                  string `toml:"recovery_key"`
+	RecoveryKeyPath              string
+	RecoveryKeyPassphrase        string
+	RecoveryKeyPassphraseCommand string
+	RecoveryKeyPassphraseFile    string
+	RecoveryKeyPassphraseEnv     string
+
+	// accountRecoveryKey and accountRecoveryKeyPath identify an account's
+	// own recovery key, which is used in addition to the global one.
+	accountRecoveryKey     string
+	accountRecoveryKeyPath string
+
+	EncryptionKeyPassphraseCommand string
+	EncryptionKeyPassphraseFile    string
+	EncryptionKeyPassphraseEnv     string
+	SigningKeyPassphraseCommand    string
+	SigningKeyPassphraseFile       string
+	SigningKeyPassphraseEnv        string
+}
+
+// EncryptionKeyPassphraseSecret returns the configured sources of the
+// encryption key's passphrase.
+func (p *PGPConfig) EncryptionKeyPassphraseSecret() *Secret {
+	return &Secret{
+		Value:   p.EncryptionKeyPassphrase,
+		Command: p.EncryptionKeyPassphraseCommand,
+		File:    p.EncryptionKeyPassphraseFile,
+		Env:     p.EncryptionKeyPassphraseEnv,
+	}
+}
+
+// SigningKeyPassphraseSecret returns the configured sources of the signing
+// key's passphrase.
+func (p *PGPConfig) SigningKeyPassphraseSecret() *Secret {
+	return &Secret{
+		Value:   p.SigningKeyPassphrase,
+		Command: p.SigningKeyPassphraseCommand,
+		File:    p.SigningKeyPassphraseFile,
+		Env:     p.SigningKeyPassphraseEnv,
+	}
+}
+
+// gnupgHome returns the configured GnuPG home directory or the default one.
+func (p *PGPConfig) gnupgHome() string {
+	if p.GnuPGHome != "" {
+		return expandTilde(p.GnuPGHome)
+	}
+	if home := os.Getenv("GNUPGHOME"); home != "" {
+		return home
+	}
+	return expandTilde("~/.gnupg")
+}
+
+// RecoveryKeyPassphraseSecret returns the configured sources of the recovery
+// key's passphrase.
+func (p *PGPConfig) RecoveryKeyPassphraseSecret() *Secret {
+	return &Secret{
+		Value:   p.RecoveryKeyPassphrase,
+		Command: p.RecoveryKeyPassphraseCommand,
+		File:    p.RecoveryKeyPassphraseFile,
+		Env:     p.RecoveryKeyPassphraseEnv,
+	}
+}
+
+// inherit fills in the settings which are not set in an account's
+// [account.pgp] section from the given (global) settings. Settings which
+// belong together are inherited as a group, so that an account's keys are not
+// mixed with global ones: the encryption key ids including the per-folder
+// ones and the passphrase sources of each key. gpg_agent and
+// ephemeral_verification can only be enabled, not disabled, per account. The
+// recovery key is handled by inheritRecoveryKey.
+func (p *PGPConfig) inherit(global *PGPConfig) {
+	if p.EncryptionKeyPath == "" {
+		p.EncryptionKeyPath = global.EncryptionKeyPath
+	}
+	if p.EncryptionKeyID == "" && len(p.EncryptionKeyIDs) == 0 && len(p.FolderEncryptionKeyIDs) == 0 {
+		p.EncryptionKeyID = global.EncryptionKeyID
+		p.EncryptionKeyIDs = global.EncryptionKeyIDs
+		p.FolderEncryptionKeyIDs = global.FolderEncryptionKeyIDs
+	}
+	if *p.EncryptionKeyPassphraseSecret() == (Secret{}) {
+		p.EncryptionKeyPassphrase = global.EncryptionKeyPassphrase
+		p.EncryptionKeyPassphraseCommand = global.EncryptionKeyPassphraseCommand
+		p.EncryptionKeyPassphraseFile = global.EncryptionKeyPassphraseFile
+		p.EncryptionKeyPassphraseEnv = global.EncryptionKeyPassphraseEnv
+	}
+	if p.SigningKeyPath == "" {
+		p.SigningKeyPath = global.SigningKeyPath
+	}
+	if p.SigningKeyID == "" {
+		p.SigningKeyID = global.SigningKeyID
+	}
+	if *p.SigningKeyPassphraseSecret() == (Secret{}) {
+		p.SigningKeyPassphrase = global.SigningKeyPassphrase
+		p.SigningKeyPassphraseCommand = global.SigningKeyPassphraseCommand
+		p.SigningKeyPassphraseFile = global.SigningKeyPassphraseFile
+		p.SigningKeyPassphraseEnv = global.SigningKeyPassphraseEnv
+	}
+	if len(p.PlainHeaders) == 0 {
+		p.PlainHeaders = global.PlainHeaders
+	}
+	if p.GnuPGHome == "" {
+		p.GnuPGHome = global.GnuPGHome
+	}
+	p.GPGAgent = p.GPGAgent || global.GPGAgent
+	p.EphemeralVerification = p.EphemeralVerification || global.EphemeralVerification
+	p.inheritRecoveryKey(global)
+}
+
+// inheritRecoveryKey copies the recovery key settings from the given
+// (global) settings, so that accounts with their own keys cannot bypass the
+// recovery key. An account's own recovery key is kept as an additional one.
+func (p *PGPConfig) inheritRecoveryKey(global *PGPConfig) {
+	if p.RecoveryKey != "" && p.RecoveryKey != global.RecoveryKey {
+		p.accountRecoveryKey = p.RecoveryKey
+		p.accountRecoveryKeyPath = p.RecoveryKeyPath
+		if p.accountRecoveryKeyPath == "" {
+			p.accountRecoveryKeyPath = p.EncryptionKeyPath
+		}
+	}
+	p.RecoveryKey = global.RecoveryKey
+	p.RecoveryKeyPath = global.RecoveryKeyPath
+	if p.RecoveryKeyPath == "" {
+		p.RecoveryKeyPath = global.EncryptionKeyPath
+	}
+	p.RecoveryKeyPassphrase = global.RecoveryKeyPassphrase
+	p.RecoveryKeyPassphraseCommand = global.RecoveryKeyPassphraseCommand
+	p.RecoveryKeyPassphraseFile = global.RecoveryKeyPassphraseFile
+	p.RecoveryKeyPassphraseEnv = global.RecoveryKeyPassphraseEnv
+}
+
+// SourceServer returns the settings of the server where messages are read
+// from: the [source] section if configured, [server] otherwise.
+func (c *Config) SourceServer() *ServerConfig {
+	if c.Source.configured() {
+		return &c.Source
+	}
+	return &c.Server
+}
+
+// TargetServer returns the settings of the server where the processed
+// messages are stored: the [target] section if configured, [server]
+// otherwise.
+func (c *Config) TargetServer() *ServerConfig {
+	if c.Target.configured() {
+		return &c.Target
+	}
+	return &c.Server
+}
+
+// ServerConfig contains the settings which are needed to connect to and
+// authenticate with an IMAP server or, depending on Type, the location of
+// local mailboxes.
+type ServerConfig struct {
+	Type              string
+	Path              string
+	Address           string
+	Username          string
+	Password          string
+	PasswordCommand   string
+	PasswordFile      string
+	PasswordEnv       string
+	Auth              string
+	AuthzID           string `toml:"authzid"`
+	OAuth2            OAuth2Config
+	Security          string
+	AllowInsecureAuth bool
+	CAFile            string `toml:"ca_file"`
+	ClientCertFile    string
+	ClientKeyFile     string
+	TLSMinVersion     string `toml:"tls_min_version"`
+	TLSPinSHA256      string `toml:"tls_pin_sha256"`
+	MaxRetries        int
+}
+
+// PasswordSecret returns the configured sources of the server password.
+func (s *ServerConfig) PasswordSecret() *Secret {
+	return &Secret{
+		Value:   s.Password,
+		Command: s.PasswordCommand,
+		File:    s.PasswordFile,
+		Env:     s.PasswordEnv,
+	}
+}
+
+// configured returns true if the section has been given in the config file.
+func (s *ServerConfig) configured() bool {
+	return s.Type != "" || s.Path != "" || s.Address != ""
+}
+
+// FolderFilter returns the search filter which applies to the given source
+// folder. A folder-specific filter replaces the default filter completely.
+func (c *Config) FolderFilter(folder string) *SearchFilter {
+	if filter, exists := c.Mailbox.FolderFilters[folder]; exists {
+		return &filter
+	}
+	return &c.Mailbox.Filter
+}
+
+// EncryptionKeyIDs returns the ids of the keys which the messages of the
+// given source folder are encrypted to. A folder-specific list replaces the
+// default list completely.
+func (c *Config) EncryptionKeyIDs(folder string) []string {
+	if ids, exists := c.PGP.FolderEncryptionKeyIDs[folder]; exists {
+		return ids
+	}
+	return c.PGP.defaultEncryptionKeyIDs()
+}
+
+// defaultEncryptionKeyIDs returns the encryption key ids which are used for
+// folders without specific ones: encryption_key_ids or, in older configs,
+// the single encryption_key_id.
+func (p *PGPConfig) defaultEncryptionKeyIDs() []string {
+	if len(p.EncryptionKeyIDs) == 0 {
+		return []string{p.EncryptionKeyID}
+	}
+	return p.EncryptionKeyIDs
+}
+
+// AllEncryptionKeyIDs returns the ids of all keys which are used for
+// encryption in any folder, without duplicates.
+func (c *Config) AllEncryptionKeyIDs() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	lists := [][]string{c.PGP.defaultEncryptionKeyIDs()}
+	for _, folder := range sortedFolders(c.PGP.FolderEncryptionKeyIDs) {
+		lists = append(lists, c.PGP.FolderEncryptionKeyIDs[folder])
+	}
+	for _, list := range lists {
+		for _, id := range list {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// sortedFolders returns the folder names of the given map in sorted order.
+func sortedFolders(folders map[string][]string) []string {
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AccountName returns the name of the account this config belongs to or an
+// empty string if the config does not define any accounts.
+func (c *Config) AccountName() string {
+	return c.account
+}
+
+// AccountConfigs returns one config per account, which contains the
+// account's settings and the global settings. If names is not empty, only
+// the accounts with the given names are returned.
+// Configs without [[account]] sections define a single, unnamed account
+// using the global server and mailbox settings.
+func (c *Config) AccountConfigs(names []string) ([]*Config, error) {
+	if len(c.Accounts) == 0 {
+		if len(names) > 0 {
+			return nil, errors.New("no accounts configured, unable to select any")
+		}
+		return []*Config{c}, nil
+	}
+	if c.Server.configured() || c.Source.configured() || c.Target.configured() ||
+		len(c.Mailbox.Folders) > 0 {
+		return nil, errors.New("server and mailbox have to be configured per account when using [[account]]")
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[name] = true
+	}
+	seen := make(map[string]bool)
+	var configs []*Config
+	for _, account := range c.Accounts {
+		if account.Name == "" {
+			return nil, errors.New("missing account name")
+		}
+		if seen[account.Name] {
+			return nil, fmt.Errorf("duplicate account name %s", account.Name)
+		}
+		seen[account.Name] = true
+		if len(names) > 0 && !selected[account.Name] {
+			continue
+		}
+		delete(selected, account.Name)
+		cfg := *c
+		cfg.Accounts = nil
+		cfg.account = account.Name
+		cfg.Server = account.Server
+		cfg.Source = account.Source
+		cfg.Target = account.Target
+		cfg.Mailbox = account.Mailbox
+		cfg.PGP = account.PGP
+		cfg.PGP.inherit(&c.PGP)
+		configs = append(configs, &cfg)
+	}
+	for name := range selected {
+		return nil, fmt.Errorf("unknown account %s", name)
+	}
+	return configs, nil
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/naoina/toml"
+	. "gopkg.in/check.v1"
+)
+
+type ConfigSuite struct{}
+
+var _ = Suite(&ConfigSuite{})
+
+const testAccountsConfig = `
+[pgp]
+encryption_key_path = "/global/pubring.gpg"
+
+[[account]]
+name = "sales"
+[account.server]
+address = "imap.example.org:993"
+username = "sales@example.org"
+[account.mailbox]
+folders = {"INBOX" = ""}
+
+[[account]]
+name = "support"
+[account.server]
+address = "imap.example.org:993"
+username = "support@example.org"
+[account.mailbox]
+folders = {"INBOX" = "Archive"}
+[account.pgp]
+encryption_key_path = "/support/pubring.gpg"
+`
+
+// parseConfig parses the given config file contents.
+func parseConfig(c *C, content string) *Config {
+	cfg := &Config{}
+	c.Assert(toml.Unmarshal([]byte(content), cfg), IsNil)
+	return cfg
+}
+
+func (s *ConfigSuite) TestSingleAccount(c *C) {
+	cfg := parseConfig(c, "[server]\naddress = \"example.org:993\"\n")
+	configs, err := cfg.AccountConfigs(nil)
+	c.Assert(err, IsNil)
+	c.Assert(configs, DeepEquals, []*Config{cfg})
+	c.Assert(configs[0].AccountName(), Equals, "")
+
+	_, err = cfg.AccountConfigs([]string{"sales"})
+	c.Assert(err, ErrorMatches, "no accounts configured.*")
+}
+
+func (s *ConfigSuite) TestAccounts(c *C) {
+	cfg := parseConfig(c, testAccountsConfig)
+	configs, err := cfg.AccountConfigs(nil)
+	c.Assert(err, IsNil)
+	c.Assert(configs, HasLen, 2)
+	c.Assert(configs[0].AccountName(), Equals, "sales")
+	c.Assert(configs[0].Server.Username, Equals, "sales@example.org")
+	c.Assert(configs[0].PGP.EncryptionKeyPath, Equals, "/global/pubring.gpg")
+	c.Assert(configs[0].Accounts, IsNil)
+	c.Assert(configs[1].AccountName(), Equals, "support")
+	c.Assert(configs[1].Mailbox.Folders, DeepEquals, map[string]string{"INBOX": "Archive"})
+	c.Assert(configs[1].PGP.EncryptionKeyPath, Equals, "/support/pubring.gpg")
+}
+
+func (s *ConfigSuite) TestSelectAccounts(c *C) {
+	cfg := parseConfig(c, testAccountsConfig)
+	configs, err := cfg.AccountConfigs([]string{"support"})
+	c.Assert(err, IsNil)
+	c.Assert(configs, HasLen, 1)
+	c.Assert(configs[0].AccountName(), Equals, "support")
+
+	_, err = cfg.AccountConfigs([]string{"support", "billing"})
+	c.Assert(err, ErrorMatches, "unknown account billing")
+}
+
+func (s *ConfigSuite) TestInvalidAccounts(c *C) {
+	cfg := parseConfig(c, testAccountsConfig+"\n[[account]]\nname = \"sales\"\n")
+	_, err := cfg.AccountConfigs(nil)
+	c.Assert(err, ErrorMatches, "duplicate account name sales")
+
+	cfg = parseConfig(c, testAccountsConfig+"\n[[account]]\n")
+	_, err = cfg.AccountConfigs(nil)
+	c.Assert(err, ErrorMatches, "missing account name")
+
+	cfg = parseConfig(c, "[server]\naddress = \"example.org:993\"\n"+testAccountsConfig)
+	_, err = cfg.AccountConfigs(nil)
+	c.Assert(err, ErrorMatches, "server and mailbox have to be configured per account.*")
+}
+
+func (s *ConfigSuite) TestSourceAndTarget(c *C) {
+	cfg := parseConfig(c, "[server]\naddress = \"example.org:993\"\n")
+	c.Assert(cfg.SourceServer(), Equals, &cfg.Server)
+	c.Assert(cfg.TargetServer(), Equals, &cfg.Server)
+
+	cfg = parseConfig(c, "[server]\naddress = \"old.example.org:993\"\n"+
+		"[target]\naddress = \"new.example.org:993\"\nusername = \"doe\"\n")
+	c.Assert(cfg.SourceServer().Address, Equals, "old.example.org:993")
+	c.Assert(cfg.TargetServer().Address, Equals, "new.example.org:993")
+	c.Assert(cfg.TargetServer().Username, Equals, "doe")
+}
+
+func (s *ConfigSuite) TestOAuth2(c *C) {
+	cfg := parseConfig(c, "[server]\naddress = \"imap.example.org:993\"\nauth = \"xoauth2\"\n"+
+		"[server.oauth2]\ntoken_url = \"https://example.org/token\"\nclient_id = \"lemoncrypt\"\n"+
+		"refresh_token_command = \"pass show refresh-token\"\n")
+	c.Assert(cfg.Server.Auth, Equals, AuthXOAuth2)
+	c.Assert(cfg.Server.OAuth2.TokenURL, Equals, "https://example.org/token")
+	c.Assert(cfg.Server.OAuth2.ClientID, Equals, "lemoncrypt")
+	c.Assert(cfg.Server.OAuth2.RefreshTokenCommand, Equals, "pass show refresh-token")
+	c.Assert(validateServer(&cfg.Server), IsNil)
+
+	cfg.Server.Auth = "cram-md5"
+	c.Assert(validateServer(&cfg.Server), ErrorMatches, "unsupported auth mechanism 'cram-md5'.*")
+}
+
+func (s *ConfigSuite) TestEncryptionKeyIDs(c *C) {
+	cfg := parseConfig(c, "[pgp]\nencryption_key_id = \"12345678\"\n")
+	c.Assert(cfg.EncryptionKeyIDs("INBOX"), DeepEquals, []string{"12345678"})
+
+	cfg = parseConfig(c, "[pgp]\nencryption_key_ids = [\"12345678\", \"23456789\"]\n"+
+		"[pgp.folder_encryption_key_ids]\n\"Shared/Team\" = [\"34567890\", \"12345678\"]\n")
+	c.Assert(cfg.EncryptionKeyIDs("INBOX"), DeepEquals, []string{"12345678", "23456789"})
+	c.Assert(cfg.EncryptionKeyIDs("Shared/Team"), DeepEquals, []string{"34567890", "12345678"})
+	c.Assert(cfg.AllEncryptionKeyIDs(), DeepEquals, []string{"12345678", "23456789", "34567890"})
+}
+
+func (s *ConfigSuite) TestRecoveryKeyInherited(c *C) {
+	cfg := parseConfig(c, strings.Replace(testAccountsConfig, "[pgp]\n", "[pgp]\nrecovery_key = \"DEADBEEF\"\n", 1))
+	configs, err := cfg.AccountConfigs(nil)
+	c.Assert(err, IsNil)
+	c.Assert(configs, HasLen, 2)
+	for _, account := range configs {
+		c.Assert(account.PGP.RecoveryKey, Equals, "DEADBEEF")
+	}
+	// the recovery key is read from the global keyring unless configured
+	c.Assert(configs[1].PGP.EncryptionKeyPath, Equals, "/support/pubring.gpg")
+	c.Assert(configs[1].PGP.RecoveryKeyPath, Equals, "/global/pubring.gpg")
+}
+
+func (s *ConfigSuite) TestAccountRecoveryKey(c *C) {
+	// an account's own recovery key does not replace the global one
+	cfg := parseConfig(c, strings.Replace(testAccountsConfig, "[pgp]\n", "[pgp]\nrecovery_key = \"DEADBEEF\"\n", 1)+
+		"recovery_key = \"CAFEBABE\"\n")
+	configs, err := cfg.AccountConfigs(nil)
+	c.Assert(err, IsNil)
+	c.Assert(configs, HasLen, 2)
+	c.Assert(configs[1].PGP.RecoveryKey, Equals, "DEADBEEF")
+	c.Assert(configs[1].PGP.RecoveryKeyPath, Equals, "/global/pubring.gpg")
+	c.Assert(configs[1].PGP.accountRecoveryKey, Equals, "CAFEBABE")
+	c.Assert(configs[1].PGP.accountRecoveryKeyPath, Equals, "/support/pubring.gpg")
+	c.Assert(configs[0].PGP.accountRecoveryKey, Equals, "")
+}
+
+func (s *ConfigSuite) TestAccountPGPOverride(c *C) {
+	// an account overriding only its key ids keeps the global key ring,
+	// signing key and passphrase, but none of the global key ids
+	config := strings.Replace(testAccountsConfig, "/global/pubring.gpg\"\n", "/global/pubring.gpg\"\n"+
+		"encryption_key_ids = [\"12345678\"]\n"+
+		"encryption_key_passphrase = \"secret\"\n"+
+		"signing_key_path = \"/global/secring.gpg\"\n"+
+		"[pgp.folder_encryption_key_ids]\n"+
+		"\"Shared\" = [\"34567890\"]\n", 1)
+	config = strings.Replace(config, "encryption_key_path = \"/support/pubring.gpg\"\n",
+		"encryption_key_ids = [\"CAFEBABE\"]\n", 1)
+	configs, err := parseConfig(c, config).AccountConfigs(nil)
+	c.Assert(err, IsNil)
+	c.Assert(configs, HasLen, 2)
+	support := configs[1].PGP
+	c.Assert(support.EncryptionKeyPath, Equals, "/global/pubring.gpg")
+	c.Assert(support.EncryptionKeyIDs, DeepEquals, []string{"CAFEBABE"})
+	c.Assert(support.FolderEncryptionKeyIDs, HasLen, 0)
+	c.Assert(support.EncryptionKeyPassphrase, Equals, "secret")
+	c.Assert(support.SigningKeyPath, Equals, "/global/secring.gpg")
+	// an account without [account.pgp] uses the global settings
+	c.Assert(configs[0].PGP.EncryptionKeyIDs, DeepEquals, []string{"12345678"})
+	c.Assert(configs[0].PGP.FolderEncryptionKeyIDs["Shared"], DeepEquals, []string{"34567890"})
+}
+
+func (s *ConfigSuite) TestRecoveryKeyRequired(c *C) {
+	config := `
+[server]
+address = "imap.example.org:993"
+[mailbox]
+folders = {"INBOX" = ""}
+[pgp]
+encryption_key_path = "/global/pubring.gpg"
+`
+	a := &MailboxAction{cfg: parseConfig(c, config), encrypting: true}
+	c.Assert(a.validateConfig(), ErrorMatches, "missing pgp.recovery_key.*")
+	// decrypting does not need the recovery key
+	a = &MailboxAction{cfg: parseConfig(c, config)}
+	c.Assert(a.validateConfig(), IsNil)
+	a = &MailboxAction{cfg: parseConfig(c, config+"recovery_key = \"DEADBEEF\"\n"), encrypting: true}
+	c.Assert(a.validateConfig(), IsNil)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/mxk/go-imap/imap"
+)
+
+// DecryptAction provides the context for the decrypt action, which restores
+// the original messages from their encrypted counterparts.
+type DecryptAction struct {
+	MailboxAction
+}
+
+// Run starts the DecryptAction.
+func (a *DecryptAction) Run(ctx *cli.Context) {
+	a.ctx = ctx
+	a.restoring = true
+	err := a.loadConfig()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	accounts, err := a.accounts()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	err = a.runAccounts(accounts, a.parallelAccounts, func(account *MailboxAction) error {
+		da := &DecryptAction{MailboxAction: *account}
+		return da.run()
+	})
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// run restores the mails of the action's account. validateConfig has
+// already swapped the source and target servers.
+func (a *DecryptAction) run() error {
+	defer a.clearCredentials()
+	err := a.setupSource()
+	if err != nil {
+		return err
+	}
+	defer a.closeSource()
+
+	err = a.setupJournal()
+	if err != nil {
+		return err
+	}
+	defer a.closeJournal()
+
+	err = a.setupTarget()
+	if err != nil {
+		return err
+	}
+	defer a.closeTarget()
+
+	err = a.setupPGP()
+	if err != nil {
+		return err
+	}
+
+	return a.decryptMails()
+}
+
+// reverseFolders returns the configured folder mapping with source and target
+// swapped, i.e. it maps folders containing encrypted mail to the folders where
+// the original mail should be restored to.
+func (a *DecryptAction) reverseFolders() (map[string]string, error) {
+	folders := make(map[string]string)
+	for sourceFolder, targetFolder := range a.cfg.Mailbox.Folders {
+		if targetFolder == "" {
+			targetFolder = sourceFolder
+		}
+		if other, exists := folders[targetFolder]; exists {
+			return nil, fmt.Errorf("folder %s is the target of both %s and %s, unable to restore",
+				targetFolder, other, sourceFolder)
+		}
+		folders[targetFolder] = sourceFolder
+	}
+	return folders, nil
+}
+
+// decryptMails starts iterating over the encrypted mails in all configured
+// target folders and restores them to their source folders.
+func (a *DecryptAction) decryptMails() error {
+	folders, err := a.reverseFolders()
+	if err != nil {
+		logger.Errorf("invalid folder mapping: %s", err)
+		return err
+	}
+	var failed error
+	for encryptedFolder, plainFolder := range folders {
+		logger.Infof("working on folder=%s (target=%s)", encryptedFolder, plainFolder)
+		a.summary.StartFolder(encryptedFolder)
+		err := a.selectTarget(plainFolder)
+		if err != nil {
+			return err
+		}
+		err = a.source.IterateEncrypted(encryptedFolder, a.decryptMail)
+		if err == ErrUIDValidityChanged {
+			// UIDs of the other folders are still valid
+			logger.Errorf("aborted folder=%s, please re-run lemoncrypt", encryptedFolder)
+			failed = err
+			continue
+		}
+		if err != nil {
+			logger.Errorf("folder iteration failed")
+			return err
+		}
+	}
+	return failed
+}
+
+// decryptMail is called for each encrypted message and restores the original
+// message. The returned function writes the result to the target mailbox.
+func (a *DecryptAction) decryptMail(rec *JournalRecord, flags imap.FlagSet, idate *time.Time,
+	encMail imap.Literal) MessageStoreFunc {
+	origMail, restoreErr := a.restoreMail(encMail)
+
+	return func() error {
+		defer closeLiteral(origMail)
+		stored, err := a.reconcile(rec, origMail)
+		if err != nil || stored {
+			return err
+		}
+
+		a.summary.Record(idate, encMail, origMail, restoreErr)
+		if restoreErr != nil {
+			return restoreErr
+		}
+		if a.dryRun {
+			logger.Infof("dry run: not storing decrypted message")
+			return nil
+		}
+		return a.store(rec, flags, idate, origMail, readHeaders(origMail).Get("Message-Id"))
+	}
+}
+
+// restoreMail decrypts the given message and verifies its signature.
+// The restored message may be backed by a temporary file and has to be
+// released using closeLiteral() after use.
+func (a *DecryptAction) restoreMail(encMail imap.Literal) (imap.Literal, error) {
+	d := a.pgp.NewDecryptor()
+	defer d.Close()
+	_, err := encMail.WriteTo(d)
+	if err != nil {
+		return nil, err
+	}
+	decReader, err := d.GetNonVerifyingReader()
+	if err != nil {
+		return nil, err
+	}
+	if !d.IsLemoncrypt() {
+		return nil, errors.New("message has not been encrypted by lemoncrypt")
+	}
+	origMail := a.spooler.NewBuffer()
+	_, err = io.Copy(origMail, decReader)
+	if err != nil {
+		origMail.Close()
+		return nil, fmt.Errorf("decryption failed: %s", err)
+	}
+
+	err = d.Verify()
+	if err != nil {
+		origMail.Close()
+		return nil, fmt.Errorf("signature verification failed: %s", err)
+	}
+
+	logger.Infof("decryption and signature verification succeeded")
+	return origMail, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	. "gopkg.in/check.v1"
+)
+
+// fakeSink is a MessageSink which keeps the appended messages in memory. Its
+// mailbox already contains messages with the Message-Ids in existing, such as
+// the originals of encrypted messages. Messages whose UIDs are in incomplete
+// have been stored partially.
+type fakeSink struct {
+	existing   map[string]uint32
+	incomplete map[uint32]bool
+	appendUID  uint32
+	appended   [][]byte
+	calls      []string
+}
+
+func (s *fakeSink) SelectMailbox(mailbox string) error {
+	return nil
+}
+
+func (s *fakeSink) Append(flags imap.FlagSet, idate *time.Time, msg imap.Literal, msgID string) (uint32, error) {
+	s.calls = append(s.calls, fmt.Sprintf("Append %s", msgID))
+	var buf bytes.Buffer
+	msg.WriteTo(&buf)
+	s.appended = append(s.appended, buf.Bytes())
+	return s.appendUID, nil
+}
+
+func (s *fakeSink) FindMessageID(msgID string) (uint32, error) {
+	s.calls = append(s.calls, fmt.Sprintf("FindMessageID %s", msgID))
+	return s.existing[msgID], nil
+}
+
+// ConfirmStored behaves like IMAPTarget.ConfirmStored: messages without UID
+// are looked up by their Message-Id, which finds the original message if it
+// still exists.
+func (s *fakeSink) ConfirmStored(uid uint32, msgID string, msg imap.Literal) (uint32, error) {
+	s.calls = append(s.calls, fmt.Sprintf("ConfirmStored %d %s", uid, msgID))
+	if s.incomplete[uid] {
+		return 0, fmt.Errorf("stored message uid=%d is incomplete", uid)
+	}
+	if uid != 0 {
+		return uid, nil
+	}
+	if msgID == "" {
+		return 0, errors.New("unable to confirm that the message has been stored")
+	}
+	if uid = s.existing[msgID]; uid == 0 {
+		return 0, fmt.Errorf("stored message with message-id=%s not found", msgID)
+	}
+	return uid, nil
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+type DecryptActionSuite struct {
+	key *openpgp.Entity
+}
+
+var _ = Suite(&DecryptActionSuite{})
+
+func (s *DecryptActionSuite) SetUpSuite(c *C) {
+	var err error
+	s.key, err = openpgp.NewEntity("Alice", "", "alice@example.org", &packet.Config{RSABits: 1024})
+	c.Assert(err, IsNil)
+}
+
+// newAction returns a DecryptAction which restores messages to the given
+// sink and a journal record of an encrypted message whose restore has been
+// interrupted.
+func (s *DecryptActionSuite) newAction(c *C, sink *fakeSink) (*DecryptAction, *JournalRecord) {
+	t := NewPGPTransformer(nil)
+	t.signingKey = s.key
+	t.signer = s.key
+	t.decryptionKeys = openpgp.EntityList{s.key}
+	a := &DecryptAction{MailboxAction: MailboxAction{
+		cfg:       &Config{Mailbox: MailboxConfig{DeletePlainCopies: true}},
+		target:    sink,
+		pgp:       t,
+		restoring: true,
+	}}
+	j, err := OpenJournal(filepath.Join(c.MkDir(), "test.journal"))
+	c.Assert(err, IsNil)
+	rec := j.Record("INBOX.Encrypted", 1, 5)
+	c.Assert(rec.SetTarget(JournalEncrypted, 0, "<1@example.org>"), IsNil)
+	return a, rec
+}
+
+// encrypt returns a test message encrypted by the action's transformer.
+func (s *DecryptActionSuite) encrypt(c *C, a *DecryptAction) imap.Literal {
+	e, err := a.pgp.NewEncryptor([]*openpgp.Entity{s.key})
+	c.Assert(err, IsNil)
+	_, err = e.Write([]byte("Subject: team\r\nMessage-Id: <1@example.org>\r\n\r\nhello\r\n"))
+	c.Assert(err, IsNil)
+	encMail, err := e.GetLiteral()
+	c.Assert(err, IsNil)
+	return encMail
+}
+
+func (s *DecryptActionSuite) TestInterruptedRestore(c *C) {
+	// the original message still exists with the same Message-Id, which
+	// must neither be taken for the restored message nor confirm it
+	sink := &fakeSink{existing: map[string]uint32{"<1@example.org>": 3}, appendUID: 12}
+	a, rec := s.newAction(c, sink)
+	encMail := s.encrypt(c, a)
+	defer closeLiteral(encMail)
+
+	c.Assert(a.decryptMail(rec, nil, nil, encMail)(), IsNil)
+	c.Assert(sink.calls, DeepEquals, []string{"Append ", "ConfirmStored 12 "})
+	c.Assert(sink.appended, HasLen, 1)
+	c.Assert(strings.HasSuffix(string(sink.appended[0]), "\r\n\r\nhello\r\n"), Equals, true)
+	c.Assert(rec.State(), Equals, JournalAppended)
+	c.Assert(rec.TargetUID(), Equals, uint32(12))
+	c.Assert(rec.MessageID(), Equals, "<1@example.org>")
+}
+
+func (s *DecryptActionSuite) TestRestoreWithoutUID(c *C) {
+	// without a UID, the restored message cannot be told apart from the
+	// original one, so the encrypted message must be kept
+	sink := &fakeSink{existing: map[string]uint32{"<1@example.org>": 3}}
+	a, rec := s.newAction(c, sink)
+	encMail := s.encrypt(c, a)
+	defer closeLiteral(encMail)
+
+	c.Assert(a.decryptMail(rec, nil, nil, encMail)(), ErrorMatches, "unable to confirm .*")
+	c.Assert(sink.calls, DeepEquals, []string{"Append ", "ConfirmStored 0 "})
+	c.Assert(rec.State(), Equals, JournalEncrypted)
+}
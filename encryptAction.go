@@ -1,54 +1,31 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/mxk/go-imap/imap"
-	"github.com/naoina/toml"
+	"golang.org/x/crypto/openpgp"
 )
 
 // EncryptAction provides the context for the default encrypt action.
 type EncryptAction struct {
-	ctx     *cli.Context
-	cfg     *Config
-	source  *IMAPSource
-	target  *IMAPTarget
-	pgp     *PGPTransformer
+	MailboxAction
 	metrics *MetricCollector
 }
 
 // Run starts the EncryptAction.
 func (a *EncryptAction) Run(ctx *cli.Context) {
 	a.ctx = ctx
+	a.encrypting = true
 	err := a.loadConfig()
 	if err != nil {
 		os.Exit(1)
 	}
 
-	err = a.validateConfig()
-	if err != nil {
-		logger.Errorf("config validation failed: %s", err)
-		os.Exit(1)
-	}
-
-	err = a.setupSource()
-	if err != nil {
-		os.Exit(1)
-	}
-	defer a.closeSource()
-
-	err = a.setupTarget()
-	if err != nil {
-		os.Exit(1)
-	}
-	defer a.closeTarget()
-
-	err = a.setupPGP()
+	accounts, err := a.accounts()
 	if err != nil {
 		os.Exit(1)
 	}
@@ -58,114 +35,49 @@ func (a *EncryptAction) Run(ctx *cli.Context) {
 		os.Exit(1)
 	}
 
-	err = a.encryptMails()
+	err = a.runAccounts(accounts, a.parallelAccounts, func(account *MailboxAction) error {
+		ea := &EncryptAction{MailboxAction: *account, metrics: a.metrics}
+		return ea.run()
+	})
+	a.metrics.Close()
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
-// loadConfig reads and parses the config file.
-// If no error occurs, the config is available in the EncryptAction.cfg field
-// afterwards.
-func (a *EncryptAction) loadConfig() error {
-	path := a.ctx.String("config")
-	if path == "" {
-		path = "lemoncrypt.cfg"
-	}
-
-	logger.Debugf("trying to load config file %s", path)
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		logger.Errorf("failed to read config file: %s", err)
-		return err
-	}
-
-	a.cfg = &Config{}
-	err = toml.Unmarshal(content, a.cfg)
+// run encrypts the mails of the action's account.
+func (a *EncryptAction) run() error {
+	defer a.clearCredentials()
+	err := a.setupSource()
 	if err != nil {
-		logger.Errorf("unable to parse config file: %s", err)
 		return err
 	}
+	defer a.closeSource()
 
-	logger.Debugf("config loaded successfully")
-	return nil
-}
-
-// validateConfig performs basic upfront sanity checks on certain config values and
-// returns an error on failure.
-func (a *EncryptAction) validateConfig() error {
-	if len(a.cfg.Mailbox.Folders) < 1 {
-		return errors.New("no folders configured (mailbox.folders)")
-	}
-	if a.cfg.PGP.EncryptionKeyPath == "" {
-		return errors.New("missing encryption key path")
-	}
-	if len(a.cfg.PGP.PlainHeaders) == 0 {
-		a.cfg.PGP.PlainHeaders = []string{
-			"From", "To", "Cc", "Bcc", "Date", "Subject"}
-	}
-
-	a.cfg.PGP.EncryptionKeyPath = expandTilde(a.cfg.PGP.EncryptionKeyPath)
-	a.cfg.PGP.SigningKeyPath = expandTilde(a.cfg.PGP.SigningKeyPath)
-	return nil
-}
-
-// setupSource initializes the source IMAP connection.
-func (a *EncryptAction) setupSource() error {
-	a.source = NewIMAPSource(a.cfg.Mailbox.DeletePlainCopies,
-		a.cfg.Mailbox.MinAgeInDays)
-	err := a.source.Dial(a.cfg.Server.Address)
-	if err != nil {
-		return err
-	}
-	return a.source.Login(a.cfg.Server.Username, a.cfg.Server.Password)
-}
-
-// setupTarget initializes the target IMAP connection.
-func (a *EncryptAction) setupTarget() error {
-	a.target = NewIMAPTarget()
-	err := a.target.Dial(a.cfg.Server.Address)
+	err = a.setupJournal()
 	if err != nil {
 		return err
 	}
+	defer a.closeJournal()
 
-	return a.target.Login(a.cfg.Server.Username, a.cfg.Server.Password)
-}
-
-// setupPGP initializes the PGP message converter.
-func (a *EncryptAction) setupPGP() error {
-	a.pgp = NewPGPTransformer(a.cfg.PGP.PlainHeaders)
-	err := a.pgp.LoadEncryptionKey(a.cfg.PGP.EncryptionKeyPath, a.cfg.PGP.EncryptionKeyID,
-		a.cfg.PGP.EncryptionKeyPassphrase)
+	err = a.setupTarget()
 	if err != nil {
-		logger.Errorf("failed to load encryption key: %s", err)
 		return err
 	}
+	defer a.closeTarget()
 
-	err = a.pgp.LoadSigningKey(a.cfg.PGP.SigningKeyPath, a.cfg.PGP.SigningKeyID,
-		a.cfg.PGP.SigningKeyPassphrase)
+	err = a.setupPGP()
 	if err != nil {
-		logger.Errorf("failed to load signing key: %s", err)
 		return err
 	}
 
-	return nil
-}
-
-// closeSource cleans up the source server connection.
-func (a *EncryptAction) closeSource() error {
-	return a.source.Close()
-}
-
-// closeTarget cleans up the target server connection.
-func (a *EncryptAction) closeTarget() error {
-	return a.target.Close()
+	return a.encryptMails()
 }
 
 // setupMetrics initializes the metrics collector if the --write-metrics
 // command line parameter is given.
 func (a *EncryptAction) setupMetrics() error {
-	outfile := a.ctx.String("write-metrics")
+	outfile := a.flagString("write-metrics")
 	if outfile == "" {
 		return nil
 	}
@@ -181,55 +93,134 @@ func (a *EncryptAction) setupMetrics() error {
 // encryptMails starts iterating over the all configured folders' mails and
 // invokes the callback.
 func (a *EncryptAction) encryptMails() error {
-	for sourceFolder, targetFolder := range a.cfg.Mailbox.Folders {
-		if targetFolder == "" {
-			targetFolder = sourceFolder
+	var failed error
+	for sourceFolder := range a.cfg.Mailbox.Folders {
+		err := a.encryptFolder(sourceFolder)
+		if err == ErrUIDValidityChanged {
+			// UIDs of the other folders are still valid
+			logger.Errorf("aborted folder=%s, please re-run lemoncrypt", sourceFolder)
+			failed = err
+			continue
 		}
-		logger.Infof("working on folder=%s (target=%s)", sourceFolder, targetFolder)
-		err := a.target.SelectMailbox(targetFolder)
 		if err != nil {
-			logger.Errorf("failed to select mailbox %s", targetFolder)
-			return err
-		}
-		err = a.source.Iterate(sourceFolder, a.encryptMail)
-		if err != nil {
-			logger.Errorf("folder iteration failed")
 			return err
 		}
 	}
-	return nil
+	return failed
+}
+
+// encryptFolder encrypts the matching mails of the given source folder and
+// stores them in the configured target folder.
+func (a *EncryptAction) encryptFolder(sourceFolder string) error {
+	targetFolder := a.cfg.Mailbox.Folders[sourceFolder]
+	if targetFolder == "" {
+		targetFolder = sourceFolder
+	}
+	logger.Infof("working on folder=%s (target=%s)", sourceFolder, targetFolder)
+	a.summary.StartFolder(sourceFolder)
+	recipients, err := a.pgp.Recipients(a.cfg.EncryptionKeyIDs(sourceFolder))
+	if err != nil {
+		logger.Errorf("unable to encrypt folder=%s: %s", sourceFolder, err)
+		return err
+	}
+	err = a.selectTarget(targetFolder)
+	if err != nil {
+		return err
+	}
+	err = a.source.Iterate(sourceFolder, a.cfg.FolderFilter(sourceFolder),
+		func(rec *JournalRecord, flags imap.FlagSet, idate *time.Time, origMail imap.Literal) MessageStoreFunc {
+			return a.encryptMail(rec, flags, idate, origMail, recipients)
+		})
+	if err != nil && err != ErrUIDValidityChanged {
+		logger.Errorf("folder iteration failed")
+	}
+	return err
 }
 
-// encryptMail is called for each message, handles transformation and writes the result
-// to the target mailbox.
-// FIXME: refactoring candidate
-func (a *EncryptAction) encryptMail(flags imap.FlagSet, idate *time.Time, origMail imap.Literal) error {
+// encryptMail is called for each message and handles the transformation
+// for the given recipients. The returned function writes the result to the
+// target mailbox.
+// The metric record only measures the transformation, which starts right
+// away on a pipeline worker, but neither the time spent waiting for the
+// preceding messages nor storing the message.
+func (a *EncryptAction) encryptMail(rec *JournalRecord, flags imap.FlagSet, idate *time.Time,
+	origMail imap.Literal, recipients []*openpgp.Entity) MessageStoreFunc {
 	metricRecord := a.metrics.NewRecord()
 	metricRecord.OrigSize = origMail.Info().Len
 	metricRecord.Success = false
-	defer func() {
-		err := metricRecord.Commit()
-		if err != nil {
-			logger.Warningf("failed to write metric record: %s", err)
+	encMail, msgID, transformErr := a.transformMail(origMail, recipients)
+	metricRecord.Stop()
+
+	return func() error {
+		defer closeLiteral(encMail)
+		defer func() {
+			err := metricRecord.Commit()
+			if err != nil {
+				logger.Warningf("failed to write metric record: %s", err)
+			}
+		}()
+
+		stored, err := a.reconcile(rec, encMail)
+		if stored {
+			metricRecord.ResultSize = encMail.Info().Len
+			metricRecord.Success = err == nil
+			metricRecord.Skipped = true
 		}
-	}()
+		if err != nil || stored {
+			return err
+		}
+
+		a.summary.Record(idate, origMail, encMail, transformErr)
+		if transformErr != nil {
+			return transformErr
+		}
+		metricRecord.ResultSize = encMail.Info().Len
+		metricRecord.Success = true
+		if a.dryRun {
+			logger.Infof("dry run: not storing encrypted message")
+			return nil
+		}
+		return a.store(rec, flags, idate, encMail, msgID)
+	}
+}
 
-	e, err := a.pgp.NewEncryptor()
+// transformMail encrypts the given message to the given recipients and
+// verifies that the original message can be restored from the result. It
+// returns the encrypted message and its Message-Id.
+func (a *EncryptAction) transformMail(origMail imap.Literal, recipients []*openpgp.Entity) (imap.Literal,
+	string, error) {
+	e, err := a.pgp.NewEncryptor(recipients)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 	origLen, err := origMail.WriteTo(e)
 	if err != nil {
-		return err
+		e.Close()
+		return nil, "", err
 	}
-	encBytes, err := e.GetBytes()
+	encMail, err := e.GetLiteral()
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	err = a.verifyMail(origMail, origLen, encMail, recipients)
+	if err != nil {
+		closeLiteral(encMail)
+		return nil, "", err
 	}
-	encMail := imap.NewLiteral(encBytes)
-	metricRecord.ResultSize = encMail.Info().Len
+	return encMail, e.MessageID(), nil
+}
+
+// verifyMail ensures that the given original message can be restored from
+// the encrypted message and that the latter has been encrypted to all of the
+// given recipients.
+func (a *EncryptAction) verifyMail(origMail imap.Literal, origLen int64, encMail imap.Literal,
+	recipients []*openpgp.Entity) error {
 	d := a.pgp.NewDecryptor()
-	_, err = encMail.WriteTo(d)
+	defer d.Close()
+	_, err := encMail.WriteTo(d)
+	if err != nil {
+		return err
+	}
 	decReader, err := d.GetNonVerifyingReader()
 	if err != nil {
 		return err
@@ -246,7 +237,11 @@ func (a *EncryptAction) encryptMail(flags imap.FlagSet, idate *time.Time, origMa
 		return fmt.Errorf("round-trip signature verification failed: %s", err)
 	}
 
+	err = d.VerifyRecipients(recipients)
+	if err != nil {
+		return fmt.Errorf("round-trip verification failed: %s", err)
+	}
+
 	logger.Infof("round-trip verification succeeded")
-	metricRecord.Success = true
-	return a.target.Append(flags, idate, encMail)
+	return nil
 }
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// assuanMaxLine is the maximum length of a line in the Assuan protocol,
+// which is spoken by gpg-agent.
+const assuanMaxLine = 1000
+
+// agentHashAlgos maps hash functions to their libgcrypt algorithm numbers,
+// which are used by the SETHASH command.
+var agentHashAlgos = map[crypto.Hash]int{
+	crypto.MD5:       1,
+	crypto.SHA1:      2,
+	crypto.RIPEMD160: 3,
+	crypto.SHA256:    8,
+	crypto.SHA384:    9,
+	crypto.SHA512:    10,
+	crypto.SHA224:    11,
+}
+
+// GPGAgent delegates signing and decryption to gpg-agent, which holds the
+// private keys of GnuPG 2.1 and later (private-keys-v1.d) and asks for
+// their passphrases using pinentry, so that they never have to be
+// configured. Only RSA keys are supported.
+type GPGAgent struct {
+	socket string
+}
+
+// NewGPGAgent returns a GPGAgent which uses the agent of the given GnuPG
+// home directory (default: $GNUPGHOME or ~/.gnupg). The agent is started if
+// it is not running yet.
+func NewGPGAgent(home string) (*GPGAgent, error) {
+	var homeArgs []string
+	if home != "" {
+		homeArgs = []string{"--homedir", home}
+	}
+	out, err := exec.Command("gpgconf", append(homeArgs, "--list-dirs", "agent-socket")...).Output()
+	socket := strings.TrimSpace(string(out))
+	if err != nil || socket == "" {
+		// gpgconf is not available, fall back to the traditional location
+		logger.Debugf("unable to query agent socket using gpgconf: %s", err)
+		if home == "" {
+			home = os.Getenv("GNUPGHOME")
+		}
+		if home == "" {
+			home = expandTilde("~/.gnupg")
+		}
+		socket = filepath.Join(home, "S.gpg-agent")
+	} else {
+		err = exec.Command("gpgconf", append(homeArgs, "--launch", "gpg-agent")...).Run()
+		if err != nil {
+			logger.Warningf("unable to launch gpg-agent: %s", err)
+		}
+	}
+	a := &GPGAgent{socket: socket}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to gpg-agent at %s: %s", socket, err)
+	}
+	conn.Close()
+	logger.Debugf("using gpg-agent at %s", socket)
+	return a, nil
+}
+
+// PrivateKey returns a copy of the given public key whose private parts are
+// held by the agent, or nil if the agent does not have any of them. Signing
+// and decryption using the returned key are performed by the agent.
+func (a *GPGAgent) PrivateKey(key *openpgp.Entity) (*openpgp.Entity, error) {
+	priv := *key
+	priv.Subkeys = append([]openpgp.Subkey(nil), key.Subkeys...)
+	found := false
+	var err error
+	priv.PrivateKey, err = a.privateKey(key.PrimaryKey)
+	if err != nil {
+		return nil, err
+	}
+	found = priv.PrivateKey != nil
+	for i := range priv.Subkeys {
+		priv.Subkeys[i].PrivateKey, err = a.privateKey(priv.Subkeys[i].PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		found = found || priv.Subkeys[i].PrivateKey != nil
+	}
+	if !found {
+		return nil, nil
+	}
+	return &priv, nil
+}
+
+// privateKey returns a private key which is backed by the agent for the
+// given public key or nil if the agent does not have it.
+func (a *GPGAgent) privateKey(pub *packet.PublicKey) (*packet.PrivateKey, error) {
+	rsaPub, ok := pub.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		logger.Debugf("key %s does not use RSA, not looking it up in gpg-agent", pub.KeyIdString())
+		return nil, nil
+	}
+	grip := rsaKeygrip(rsaPub)
+	available, err := a.haveKey(grip)
+	if err != nil || !available {
+		return nil, err
+	}
+	logger.Debugf("private key of %s (keygrip=%s) is available in gpg-agent", pub.KeyIdString(), grip)
+	return &packet.PrivateKey{
+		PublicKey:  *pub,
+		PrivateKey: &agentKey{agent: a, grip: grip, public: rsaPub, keyID: pub.KeyIdString()},
+	}, nil
+}
+
+// rsaKeygrip returns the keygrip of the given key, which is how gpg-agent
+// identifies keys. For RSA, it is the SHA-1 hash of the modulus as a signed
+// big-endian number, i.e. with a leading zero byte if the top bit is set.
+func rsaKeygrip(pub *rsa.PublicKey) string {
+	n := pub.N.Bytes()
+	if len(n) > 0 && n[0]&0x80 != 0 {
+		n = append([]byte{0}, n...)
+	}
+	sum := sha1.Sum(n)
+	return fmt.Sprintf("%X", sum[:])
+}
+
+// haveKey returns true if the agent has the private key with the given
+// keygrip.
+func (a *GPGAgent) haveKey(grip string) (bool, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = conn.transact("HAVEKEY "+grip, nil)
+	if _, ok := err.(*assuanError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// dial connects to the agent and passes the terminal and display settings,
+// which pinentry needs for asking for passphrases.
+func (a *GPGAgent) dial() (*assuanConn, error) {
+	c, err := net.Dial("unix", a.socket)
+	if err != nil {
+		return nil, err
+	}
+	conn := &assuanConn{conn: c, r: bufio.NewReader(c)}
+	_, err = conn.response(nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for option, env := range map[string]string{
+		"ttyname": "GPG_TTY",
+		"ttytype": "TERM",
+		"display": "DISPLAY",
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		_, err = conn.transact("OPTION "+option+"="+value, nil)
+		if err != nil {
+			logger.Debugf("gpg-agent did not accept option %s: %s", option, err)
+		}
+	}
+	return conn, nil
+}
+
+// agentKey is an RSA private key which is held by gpg-agent. It implements
+// crypto.Signer and crypto.Decrypter, as expected by the openpgp package.
+type agentKey struct {
+	agent  *GPGAgent
+	grip   string
+	public *rsa.PublicKey
+	keyID  string
+}
+
+// Public implements the crypto.Signer interface.
+func (k *agentKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Sign implements the crypto.Signer interface. The agent creates a PKCS #1
+// v1.5 signature of the given digest.
+func (k *agentKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algo, ok := agentHashAlgos[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function %d", opts.HashFunc())
+	}
+	conn, err := k.agent.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for _, cmd := range []string{
+		"SIGKEY " + k.grip,
+		"SETKEYDESC " + assuanEscape("lemoncrypt needs the passphrase of the signing key "+k.keyID),
+		fmt.Sprintf("SETHASH %d %X", algo, digest),
+	} {
+		_, err = conn.transact(cmd, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := conn.transact("PKSIGN", nil)
+	if err != nil {
+		return nil, fmt.Errorf("gpg-agent failed to sign: %s", err)
+	}
+	sexp, err := parseSexp(data)
+	if err != nil {
+		return nil, err
+	}
+	sig := sexp.find("s")
+	if sig == nil {
+		return nil, errors.New("unexpected signature from gpg-agent")
+	}
+	return leftPad(sig, (k.public.N.BitLen()+7)/8), nil
+}
+
+// Decrypt implements the crypto.Decrypter interface. The agent decrypts the
+// given RSA ciphertext; the PKCS #1 v1.5 padding is removed afterwards if
+// the agent has not done so.
+func (k *agentKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	conn, err := k.agent.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for _, cmd := range []string{
+		"SETKEY " + k.grip,
+		"SETKEYDESC " + assuanEscape("lemoncrypt needs the passphrase of the decryption key "+k.keyID),
+	} {
+		_, err = conn.transact(cmd, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ciphertext := bytes.TrimLeft(msg, "\x00")
+	data, err := conn.transact("PKDECRYPT", func(keyword string) []byte {
+		if keyword != "CIPHERTEXT" {
+			return nil
+		}
+		return []byte(fmt.Sprintf("(7:enc-val(3:rsa(1:a%d:%s)))", len(ciphertext), ciphertext))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gpg-agent failed to decrypt: %s", err)
+	}
+	sexp, err := parseSexp(data)
+	if err != nil {
+		return nil, err
+	}
+	value := sexp.find("value")
+	if value == nil {
+		return nil, errors.New("unexpected decryption result from gpg-agent")
+	}
+	if conn.status["PADDING"] == "0" {
+		return value, nil
+	}
+	return unpadPKCS1(value)
+}
+
+// unpadPKCS1 removes the PKCS #1 v1.5 encryption padding (block type 2)
+// from the given message; the leading zero byte may be missing.
+func unpadPKCS1(msg []byte) ([]byte, error) {
+	if len(msg) > 0 && msg[0] == 0 {
+		msg = msg[1:]
+	}
+	if len(msg) < 10 || msg[0] != 2 {
+		return nil, errors.New("invalid PKCS #1 padding")
+	}
+	end := bytes.IndexByte(msg[1:], 0)
+	if end < 8 {
+		return nil, errors.New("invalid PKCS #1 padding")
+	}
+	return msg[end+2:], nil
+}
+
+// leftPad returns the given big-endian number padded with zeros to the
+// given length.
+func leftPad(b []byte, length int) []byte {
+	if len(b) >= length {
+		return b
+	}
+	return append(make([]byte, length-len(b)), b...)
+}
+
+// assuanError is an ERR response of the agent.
+type assuanError struct {
+	msg string
+}
+
+func (e *assuanError) Error() string {
+	return e.msg
+}
+
+// assuanConn is a connection to gpg-agent, which speaks the line-based
+// Assuan protocol.
+type assuanConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	status map[string]string
+}
+
+// Close closes the connection.
+func (c *assuanConn) Close() error {
+	return c.conn.Close()
+}
+
+// transact sends the given command and returns the data sent by the agent
+// in response. inquire is invoked if the agent asks for more data and
+// returns it; nil is sent as an empty answer.
+func (c *assuanConn) transact(cmd string, inquire func(keyword string) []byte) ([]byte, error) {
+	_, err := io.WriteString(c.conn, cmd+"\n")
+	if err != nil {
+		return nil, err
+	}
+	return c.response(inquire)
+}
+
+// response reads the agent's response up to the final OK or ERR line.
+// Status lines are recorded in c.status.
+func (c *assuanConn) response(inquire func(keyword string) []byte) ([]byte, error) {
+	var data []byte
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		keyword, args := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			keyword, args = line[:i], line[i+1:]
+		}
+		switch keyword {
+		case "OK":
+			return data, nil
+		case "ERR":
+			return nil, &assuanError{assuanDescription(args)}
+		case "D":
+			data = append(data, assuanUnescape(args)...)
+		case "S":
+			if c.status == nil {
+				c.status = make(map[string]string)
+			}
+			name := args
+			value := ""
+			if i := strings.IndexByte(args, ' '); i >= 0 {
+				name, value = args[:i], args[i+1:]
+			}
+			c.status[name] = value
+		case "INQUIRE":
+			name := strings.Fields(args + " ")[0]
+			var answer []byte
+			if inquire != nil {
+				answer = inquire(name)
+			}
+			err = c.sendData(answer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// comments (#) are ignored
+	}
+}
+
+// sendData sends the given data followed by END.
+func (c *assuanConn) sendData(data []byte) error {
+	w := bufio.NewWriter(c.conn)
+	line := []byte("D ")
+	for _, b := range data {
+		if b == '%' || b == '\r' || b == '\n' {
+			line = append(line, fmt.Sprintf("%%%02X", b)...)
+		} else {
+			line = append(line, b)
+		}
+		if len(line) >= assuanMaxLine-4 {
+			w.Write(append(line, '\n'))
+			line = []byte("D ")
+		}
+	}
+	if len(line) > 2 {
+		w.Write(append(line, '\n'))
+	}
+	w.WriteString("END\n")
+	return w.Flush()
+}
+
+// assuanDescription returns the description of an ERR response, which
+// consists of a numeric error code and a description.
+func assuanDescription(args string) string {
+	fields := strings.SplitN(args, " ", 2)
+	if len(fields) == 2 {
+		return fields[1]
+	}
+	if code, err := strconv.Atoi(args); err == nil {
+		return fmt.Sprintf("error code %d", code)
+	}
+	return args
+}
+
+// assuanEscape escapes a command parameter, which may contain spaces.
+func assuanEscape(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case b == ' ':
+			buf.WriteByte('+')
+		case b < 0x20 || b == '%' || b == '+':
+			fmt.Fprintf(&buf, "%%%02X", b)
+		default:
+			buf.WriteByte(b)
+		}
+	}
+	return buf.String()
+}
+
+// assuanUnescape decodes the percent-escaped data of a D line.
+func assuanUnescape(s string) []byte {
+	var data []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err == nil {
+				data = append(data, byte(b))
+				i += 2
+				continue
+			}
+		}
+		data = append(data, s[i])
+	}
+	return data
+}
+
+// sexp is a canonical S-expression as used by gpg-agent. Its elements are
+// either []byte (atoms) or sexp (lists).
+type sexp []interface{}
+
+// parseSexp parses the given canonical S-expression, which has to be a
+// list.
+func parseSexp(data []byte) (sexp, error) {
+	list, rest, err := parseSexpList(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 && !(len(rest) == 1 && rest[0] == 0) {
+		return nil, errors.New("trailing data after S-expression")
+	}
+	return list, nil
+}
+
+// parseSexpList parses the list at the start of data and returns the
+// remaining data.
+func parseSexpList(data []byte) (sexp, []byte, error) {
+	if len(data) == 0 || data[0] != '(' {
+		return nil, nil, errors.New("S-expression does not start with a list")
+	}
+	data = data[1:]
+	list := sexp{}
+	for {
+		switch {
+		case len(data) == 0:
+			return nil, nil, errors.New("unterminated S-expression")
+		case data[0] == ')':
+			return list, data[1:], nil
+		case data[0] == '(':
+			sub, rest, err := parseSexpList(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, sub)
+			data = rest
+		default:
+			colon := bytes.IndexByte(data, ':')
+			if colon < 1 {
+				return nil, nil, errors.New("invalid S-expression atom")
+			}
+			length, err := strconv.Atoi(string(data[:colon]))
+			if err != nil || length < 0 || length > len(data)-colon-1 {
+				return nil, nil, errors.New("invalid S-expression atom length")
+			}
+			list = append(list, data[colon+1:colon+1+length])
+			data = data[colon+1+length:]
+		}
+	}
+}
+
+// find returns the value of the first list (searched depth-first) which
+// consists of the given name and one atom, e.g. (s <signature>).
+func (s sexp) find(name string) []byte {
+	if len(s) == 2 {
+		key, keyOk := s[0].([]byte)
+		value, valueOk := s[1].([]byte)
+		if keyOk && valueOk && string(key) == name {
+			return value
+		}
+	}
+	for _, element := range s {
+		if sub, ok := element.(sexp); ok {
+			if value := sub.find(name); value != nil {
+				return value
+			}
+		}
+	}
+	return nil
+}
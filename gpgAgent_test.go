@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	. "gopkg.in/check.v1"
+)
+
+// GPGAgentSuite tests the keybox and gpg-agent support using a throwaway
+// GnuPG home directory. It is skipped if GnuPG is not installed.
+type GPGAgentSuite struct {
+	home  string
+	keyID string
+	grips []string
+}
+
+var _ = Suite(&GPGAgentSuite{})
+
+// gpg runs gpg with the suite's home directory and returns its output.
+func (s *GPGAgentSuite) gpg(c *C, args ...string) string {
+	cmd := exec.Command("gpg", append([]string{"--homedir", s.home, "--batch", "--passphrase", ""},
+		args...)...)
+	out, err := cmd.Output()
+	c.Assert(err, IsNil, Commentf("gpg %s", strings.Join(args, " ")))
+	return string(out)
+}
+
+func (s *GPGAgentSuite) SetUpSuite(c *C) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		c.Skip("gpg is not installed")
+	}
+	if _, err := exec.LookPath("gpgconf"); err != nil {
+		c.Skip("gpgconf is not installed")
+	}
+	var err error
+	// the agent's socket path must not be too long, so c.MkDir is not used
+	s.home, err = ioutil.TempDir("", "lemoncrypt-gnupg")
+	c.Assert(err, IsNil)
+	s.gpg(c, "--quick-gen-key", "Test <test@example.org>", "rsa2048", "sign", "never")
+	fingerprint := ""
+	for _, line := range strings.Split(s.gpg(c, "--with-colons", "--with-keygrip", "--list-keys"), "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case fields[0] == "fpr" && fingerprint == "":
+			fingerprint = fields[9]
+			s.keyID = fingerprint[len(fingerprint)-8:]
+		case fields[0] == "grp":
+			s.grips = append(s.grips, fields[9])
+		}
+	}
+	s.gpg(c, "--quick-add-key", fingerprint, "rsa2048", "encr", "never")
+	s.grips = nil
+	for _, line := range strings.Split(s.gpg(c, "--with-colons", "--with-keygrip", "--list-keys"), "\n") {
+		if fields := strings.Split(line, ":"); fields[0] == "grp" {
+			s.grips = append(s.grips, fields[9])
+		}
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(s.home, "export.asc"), []byte(s.gpg(c, "--armor", "--export")),
+		0600), IsNil)
+}
+
+func (s *GPGAgentSuite) TearDownSuite(c *C) {
+	if s.home == "" {
+		return
+	}
+	exec.Command("gpgconf", "--homedir", s.home, "--kill", "gpg-agent").Run()
+	os.RemoveAll(s.home)
+}
+
+func (s *GPGAgentSuite) TestKeybox(c *C) {
+	keyring, err := readKeyring(filepath.Join(s.home, "pubring.kbx"))
+	c.Assert(err, IsNil)
+	c.Assert(keyring, HasLen, 1)
+	c.Assert(keyring[0].PrimaryKey.KeyIdShortString(), Equals, s.keyID)
+	c.Assert(keyring[0].Subkeys, HasLen, 1)
+	c.Assert(keyring[0].PrivateKey, IsNil)
+
+	_, err = parseKeybox([]byte("not a keybox"))
+	c.Assert(err, ErrorMatches, "not a keybox file")
+}
+
+func (s *GPGAgentSuite) TestArmored(c *C) {
+	keyring, err := readKeyring(filepath.Join(s.home, "export.asc"))
+	c.Assert(err, IsNil)
+	c.Assert(keyring, HasLen, 1)
+	c.Assert(keyring[0].PrimaryKey.KeyIdShortString(), Equals, s.keyID)
+}
+
+func (s *GPGAgentSuite) TestKeygrip(c *C) {
+	agent, err := NewGPGAgent(s.home)
+	c.Assert(err, IsNil)
+	keyring, err := readKeyring(filepath.Join(s.home, "pubring.kbx"))
+	c.Assert(err, IsNil)
+	key, err := agent.PrivateKey(keyring[0])
+	c.Assert(err, IsNil)
+	c.Assert(key, NotNil)
+	c.Assert([]string{key.PrivateKey.PrivateKey.(*agentKey).grip,
+		key.Subkeys[0].PrivateKey.PrivateKey.(*agentKey).grip}, DeepEquals, s.grips)
+	// the public keyring is not modified
+	c.Assert(keyring[0].PrivateKey, IsNil)
+	c.Assert(keyring[0].Subkeys[0].PrivateKey, IsNil)
+
+	other, err := openpgp.NewEntity("Other", "", "other@example.org", nil)
+	c.Assert(err, IsNil)
+	key, err = agent.PrivateKey(other)
+	c.Assert(err, IsNil)
+	c.Assert(key, IsNil)
+}
+
+func (s *GPGAgentSuite) TestRoundTrip(c *C) {
+	agent, err := NewGPGAgent(s.home)
+	c.Assert(err, IsNil)
+	path := filepath.Join(s.home, "pubring.kbx")
+	t := NewPGPTransformer([]string{"Subject"})
+	t.SetAgent(agent)
+	c.Assert(t.LoadEncryptionKeys(path, []string{s.keyID}, nil, nil), IsNil)
+	c.Assert(t.LoadSigningKey(path, s.keyID, nil), IsNil)
+	recipients, err := t.Recipients([]string{s.keyID})
+	c.Assert(err, IsNil)
+
+	e, err := t.NewEncryptor(recipients)
+	c.Assert(err, IsNil)
+	_, err = e.Write([]byte("Subject: agent\r\nMessage-Id: <1@example.org>\r\n\r\nhello\r\n"))
+	c.Assert(err, IsNil)
+	encMail, err := e.GetLiteral()
+	c.Assert(err, IsNil)
+	defer closeLiteral(encMail)
+
+	d := t.NewDecryptor()
+	defer d.Close()
+	_, err = encMail.WriteTo(d)
+	c.Assert(err, IsNil)
+	r, err := d.GetNonVerifyingReader()
+	c.Assert(err, IsNil)
+	plain, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasSuffix(plain, []byte("\r\n\r\nhello\r\n")), Equals, true)
+	c.Assert(d.Verify(), IsNil)
+}
+
+func (s *GPGAgentSuite) TestWithoutAgent(c *C) {
+	path := filepath.Join(s.home, "pubring.kbx")
+	t := NewPGPTransformer(nil)
+	c.Assert(t.LoadSigningKey(path, s.keyID, nil), ErrorMatches, "key with keyid=.* lacks private key")
+}
+
+func (s *GPGAgentSuite) TestSexp(c *C) {
+	sexp, err := parseSexp([]byte("(7:sig-val(3:rsa(1:s3:a)b)))"))
+	c.Assert(err, IsNil)
+	c.Assert(sexp.find("s"), DeepEquals, []byte("a)b"))
+	c.Assert(sexp.find("value"), IsNil)
+	_, err = parseSexp([]byte("(5:value9:abc)"))
+	c.Assert(err, NotNil)
+	c.Assert(assuanUnescape("a%25b%0A"), DeepEquals, []byte("a%b\n"))
+	c.Assert(assuanEscape("50% of a+b"), Equals, "50%25+of+a%2Bb")
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"io"
+	"net/textproto"
 	"strings"
 )
 
@@ -20,9 +22,16 @@ import (
 type HeaderBuffer struct {
 	buf             *bytes.Buffer
 	headersComplete bool
+	tooLarge        bool
 	headerBytes     []byte
+	prev            byte
 }
 
+// maxHeaderSize is the maximum size of a header block which is recorded by
+// HeaderBuffer. This protects against keeping huge messages without any
+// header/body separation in memory.
+const maxHeaderSize = 1024 * 1024
+
 // NewHeaderBuffer returns a new HeaderBuffer instance.
 func NewHeaderBuffer() *HeaderBuffer {
 	return &HeaderBuffer{buf: &bytes.Buffer{}}
@@ -33,6 +42,9 @@ func NewHeaderBuffer() *HeaderBuffer {
 // The final double new line is included. An error is returned if no complete
 // header block has been found.
 func (hb *HeaderBuffer) Read(buf []byte) (int, error) {
+	if hb.tooLarge {
+		return 0, errors.New("header block too large")
+	}
 	if !hb.headersComplete {
 		return 0, errors.New("unterminated or empty header block")
 	}
@@ -43,33 +55,40 @@ func (hb *HeaderBuffer) Read(buf []byte) (int, error) {
 // to detect the end of the header block.
 // All header block data is written to an internal buffer.
 func (hb *HeaderBuffer) Write(data []byte) (int, error) {
-	if hb.headersComplete {
+	if hb.headersComplete || hb.tooLarge {
 		// quick return if we are not awaiting any more header data
 		return len(data), nil
 	}
-	hb.headerBytes = append(hb.headerBytes, data...)
-	hb.checkForCompleteHeader()
-	if hb.headersComplete {
+	end := hb.findHeaderEnd(data)
+	if end >= 0 {
+		hb.headerBytes = append(hb.headerBytes, data[:end]...)
+		hb.headersComplete = true
 		hb.storeHeaderBlock()
+		return len(data), nil
 	}
+	if len(hb.headerBytes)+len(data) > maxHeaderSize {
+		hb.headerBytes = nil
+		hb.tooLarge = true
+		return len(data), nil
+	}
+	hb.headerBytes = append(hb.headerBytes, data...)
 	return len(data), nil
 }
 
-// checkForCompleteHeader analyzes the buffer content in order to find out if
-// the header block has been completed. If it has, headersComplete is set to true
-// and headerBytes is adjusted so that it contains just the header.
-func (hb *HeaderBuffer) checkForCompleteHeader() {
-	var prev byte
-	for idx, char := range hb.headerBytes {
-		if prev == '\n' && char == '\n' {
-			hb.headerBytes = hb.headerBytes[:idx+1]
-			hb.headersComplete = true
-			return
+// findHeaderEnd analyzes the given data, which directly follows all previously
+// written data, in order to find out if the header block has been completed.
+// It returns the length of the part of data which belongs to the header
+// block or -1 if the header block continues.
+func (hb *HeaderBuffer) findHeaderEnd(data []byte) int {
+	for idx, char := range data {
+		if hb.prev == '\n' && char == '\n' {
+			return idx + 1
 		}
 		if char != '\r' {
-			prev = char
+			hb.prev = char
 		}
 	}
+	return -1
 }
 
 // storeHeaderBlock grabs the header block bytes from the buffer, removes all
@@ -85,3 +104,13 @@ func (hb *HeaderBuffer) storeHeaderBlock() {
 		hb.buf.Write([]byte("\n"))
 	}
 }
+
+// readHeaders returns the parsed MIME headers of the given message.
+// Parsing errors are ignored; the headers which could be parsed up to that
+// point are returned.
+func readHeaders(msg io.WriterTo) textproto.MIMEHeader {
+	hb := NewHeaderBuffer()
+	msg.WriteTo(hb)
+	headers, _ := textproto.NewReader(bufio.NewReader(hb)).ReadMIMEHeader()
+	return headers
+}
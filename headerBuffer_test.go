@@ -44,3 +44,26 @@ func (s *HeaderBufferSuite) TestIncomplete(c *C) {
 	c.Assert(err, Not(IsNil))
 	c.Assert(data, DeepEquals, []byte{})
 }
+
+func (s *HeaderBufferSuite) TestChunked(c *C) {
+	for _, tt := range headerBufferTests {
+		hb := NewHeaderBuffer()
+		for i := range tt.in {
+			hb.Write(tt.in[i : i+1])
+		}
+		data, err := ioutil.ReadAll(hb)
+		c.Assert(err, IsNil)
+		c.Assert(data, DeepEquals, tt.out)
+	}
+}
+
+func (s *HeaderBufferSuite) TestTooLarge(c *C) {
+	hb := NewHeaderBuffer()
+	line := []byte("Foo: Bar\n")
+	for i := 0; i <= maxHeaderSize/len(line); i++ {
+		hb.Write(line)
+	}
+	hb.Write([]byte("\n"))
+	_, err := ioutil.ReadAll(hb)
+	c.Assert(err, ErrorMatches, "header block too large")
+}
@@ -2,31 +2,118 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/mxk/go-imap/imap"
 )
 
-func init() {
-	// needed to handle large mailboxes (search result list)
-	imap.BufferSize = 20 * 1024 * 1024
-}
+// Supported values for the server.security config option.
+const (
+	// SecurityTLS uses implicit TLS (IMAPS, usually port 993).
+	SecurityTLS = "tls"
+
+	// SecuritySTARTTLS connects in plain text and requires a successful
+	// STARTTLS upgrade before doing anything else (usually port 143).
+	SecuritySTARTTLS = "starttls"
+
+	// SecurityNone connects in plain text without any encryption.
+	SecurityNone = "none"
+)
+
+// Defaults for reconnecting after the connection has been lost.
+const (
+	// DefaultMaxRetries is the default number of reconnect attempts per
+	// operation.
+	DefaultMaxRetries = 5
+
+	// retryBaseDelay is the delay before the first reconnect attempt; it is
+	// doubled for each further attempt.
+	retryBaseDelay = time.Second
+
+	// retryMaxDelay is the maximum delay between two reconnect attempts.
+	retryMaxDelay = 2 * time.Minute
+)
+
+// ErrUIDValidityChanged is returned if the UIDVALIDITY of a mailbox changes
+// while it is being processed. All UIDs which have been obtained before are
+// meaningless then, so the mailbox must not be modified any further.
+var ErrUIDValidityChanged = errors.New("UIDVALIDITY of the mailbox has changed")
 
 // IMAPConnection handles an IMAP connection.
+// If the connection is lost, it is re-established transparently for all
+// operations which are run using .retry().
 type IMAPConnection struct {
-	conn *imap.Client
+	conn              *imap.Client
+	tlsConfig         *tls.Config
+	encrypted         bool
+	allowInsecureAuth bool
+	server            *ServerConfig
+	username          string
+	password          []byte
+	tokens            *OAuth2TokenSource
+	mailbox           string
+	readOnly          bool
+	uidValidity       uint32
+	maxRetries        int
+	retryDelay        time.Duration
 }
 
 // NewIMAPConnection returns a new IMAPConnection instance.
 func NewIMAPConnection() *IMAPConnection {
-	return &IMAPConnection{}
+	return &IMAPConnection{
+		maxRetries: DefaultMaxRetries,
+		retryDelay: retryBaseDelay,
+	}
 }
 
-// Dial connects to the given address.
-func (c *IMAPConnection) Dial(address string) error {
-	logger.Debugf("connecting to %s", address)
-	tlsConfig := &tls.Config{}
-	var err error
-	c.conn, err = imap.DialTLS(address, tlsConfig)
+// SetMaxRetries configures how often an operation is retried after the
+// connection has been lost. 0 disables reconnecting.
+func (c *IMAPConnection) SetMaxRetries(maxRetries int) {
+	c.maxRetries = maxRetries
+}
+
+// validateSecurity returns an error if the given value is not a supported
+// server.security setting.
+func validateSecurity(security string) error {
+	switch security {
+	case "", SecurityTLS, SecuritySTARTTLS, SecurityNone:
+		return nil
+	}
+	return fmt.Errorf("unsupported security mode '%s' (expected %s, %s or %s)",
+		security, SecurityTLS, SecuritySTARTTLS, SecurityNone)
+}
+
+// Dial connects to the configured address using the configured security
+// mode. An empty security mode defaults to implicit TLS.
+func (c *IMAPConnection) Dial(server *ServerConfig) error {
+	logger.Debugf("connecting to %s (security=%s)", server.Address, server.Security)
+	c.server = server
+	c.allowInsecureAuth = server.AllowInsecureAuth
+	host, _, err := net.SplitHostPort(server.Address)
+	if err != nil {
+		host = server.Address
+	}
+	c.tlsConfig, err = newTLSConfig(server, host)
+	if err != nil {
+		logger.Errorf("invalid TLS settings: %s", err)
+		return err
+	}
+	switch server.Security {
+	case "", SecurityTLS:
+		err = c.dialTLS(server.Address)
+	case SecuritySTARTTLS:
+		err = c.dialSTARTTLS(server.Address)
+	case SecurityNone:
+		err = c.dialPlain(server.Address)
+	default:
+		err = validateSecurity(server.Security)
+	}
 	if err != nil {
 		logger.Errorf("failed to connect: %s", err)
 		return err
@@ -35,11 +122,185 @@ func (c *IMAPConnection) Dial(address string) error {
 	return nil
 }
 
-// Login authenticates with the server using the provided credentials.
-func (c *IMAPConnection) Login(username, password string) error {
-	logger.Debugf("attempting to login as %s", username)
-	_, err := imap.Wait(c.conn.Login(username, password))
+// dialTLS connects to the given address using implicit TLS.
+func (c *IMAPConnection) dialTLS(address string) error {
+	var err error
+	c.conn, err = imap.DialTLS(address, c.tlsConfig)
+	if err != nil {
+		return err
+	}
+	c.encrypted = true
+	return c.ensureCapabilities()
+}
+
+// dialSTARTTLS connects to the given address in plain text and upgrades the
+// connection using STARTTLS. The connection is closed if the server does not
+// support STARTTLS or if the upgrade fails.
+func (c *IMAPConnection) dialSTARTTLS(address string) error {
+	err := c.dialPlain(address)
+	if err != nil {
+		return err
+	}
+	if !c.conn.Caps["STARTTLS"] {
+		c.conn.Logout(0)
+		return errors.New("server does not support STARTTLS")
+	}
+	logger.Debugf("negotiating STARTTLS")
+	_, err = imap.Wait(c.conn.StartTLS(c.tlsConfig))
+	if err != nil {
+		c.conn.Logout(0)
+		return fmt.Errorf("STARTTLS failed: %s", err)
+	}
+	c.encrypted = true
+	// the capabilities announced before STARTTLS must not be trusted and
+	// usually differ, e.g. regarding LOGINDISABLED
+	return c.readCapabilities()
+}
+
+// dialPlain connects to the given address without any encryption.
+func (c *IMAPConnection) dialPlain(address string) error {
+	var err error
+	c.conn, err = imap.Dial(address)
+	c.encrypted = false
+	if err != nil {
+		return err
+	}
+	return c.ensureCapabilities()
+}
+
+// ensureCapabilities requests the server's capabilities unless they have
+// been announced in the greeting already.
+func (c *IMAPConnection) ensureCapabilities() error {
+	if len(c.conn.Caps) > 0 {
+		logger.Debugf("server capabilities: %s", strings.Join(sortedKeys(c.conn.Caps), " "))
+		return nil
+	}
+	return c.readCapabilities()
+}
+
+// readCapabilities requests the server's capabilities.
+func (c *IMAPConnection) readCapabilities() error {
+	_, err := imap.Wait(c.conn.Capability())
+	if err != nil {
+		c.conn.Logout(0)
+		return fmt.Errorf("CAPABILITY failed: %s", err)
+	}
+	logger.Debugf("server capabilities: %s", strings.Join(sortedKeys(c.conn.Caps), " "))
+	return nil
+}
+
+// Mechanism returns the auth mechanism which is used for logging in, i.e.
+// the configured one or the best one offered by the server. An error is
+// returned if the server does not support the configured mechanism.
+func (c *IMAPConnection) Mechanism() (string, error) {
+	return chooseMechanism(c.server, c.conn.Caps)
+}
+
+// Login authenticates with the server using the provided credentials and
+// the LOGIN, PLAIN or EXTERNAL mechanism (see Mechanism), the latter of which
+// ignores the credentials.
+// Credentials are never sent over an unencrypted connection unless this
+// has explicitly been allowed. A copy of the password is kept for
+// reconnecting until the connection is closed.
+func (c *IMAPConnection) Login(username string, password []byte) error {
+	err := c.login(username, password)
+	if err != nil {
+		return err
+	}
+	// remembered for reconnecting
+	c.username = username
+	zeroBytes(c.password)
+	c.password = append([]byte(nil), password...)
+	return nil
+}
+
+// LoginOAuth2 authenticates with the server using the configured OAuth2
+// SASL mechanism (server.auth) and an access token from the given token
+// source. The token source is kept for reconnecting.
+func (c *IMAPConnection) LoginOAuth2(username string, tokens *OAuth2TokenSource) error {
+	err := c.authenticateOAuth2(username, tokens)
 	if err != nil {
+		return err
+	}
+	// remembered for reconnecting
+	c.username = username
+	c.tokens = tokens
+	return nil
+}
+
+// checkInsecureAuth returns an error if credentials must not be sent over
+// the current connection.
+func (c *IMAPConnection) checkInsecureAuth() error {
+	if !c.encrypted && !c.allowInsecureAuth {
+		err := errors.New("refusing to send credentials over an unencrypted connection " +
+			"(set server.allow_insecure_auth to override)")
+		logger.Errorf("login failed: %s", err)
+		return err
+	}
+	return nil
+}
+
+// login sends the given credentials to the server.
+func (c *IMAPConnection) login(username string, password []byte) error {
+	err := c.checkInsecureAuth()
+	if err != nil {
+		return err
+	}
+	mechanism, err := c.Mechanism()
+	if err != nil {
+		logger.Errorf("login failed: %s", err)
+		return err
+	}
+	logger.Debugf("attempting to login as %s using %s", username, mechanism)
+	switch mechanism {
+	case AuthLogin:
+		_, err = imap.Wait(c.conn.Login(username, string(password)))
+	case AuthPlain:
+		auth := &plainAuth{authzid: c.server.AuthzID, username: username, password: password}
+		_, err = imap.Wait(c.conn.Auth(auth))
+		auth.clear()
+	case AuthExternal:
+		_, err = imap.Wait(c.conn.Auth(&externalAuth{authzid: c.server.AuthzID}))
+	default:
+		err = fmt.Errorf("auth mechanism %s requires an OAuth2 access token", mechanism)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s authentication failed: %s", strings.ToUpper(mechanism), err)
+		logger.Errorf("login failed: %s", err)
+		return err
+	}
+	logger.Debugf("logged in")
+	return nil
+}
+
+// authenticateOAuth2 authenticates using an access token from the given
+// token source. A rejected token is discarded, so that a new one is
+// requested when reconnecting.
+func (c *IMAPConnection) authenticateOAuth2(username string, tokens *OAuth2TokenSource) error {
+	err := c.checkInsecureAuth()
+	if err != nil {
+		return err
+	}
+	mechanism, err := c.Mechanism()
+	if err == nil && !isOAuth2(mechanism) {
+		err = fmt.Errorf("auth mechanism %s does not use OAuth2 access tokens", mechanism)
+	}
+	if err != nil {
+		logger.Errorf("login failed: %s", err)
+		return err
+	}
+	token, err := tokens.Token()
+	if err != nil {
+		logger.Errorf("login failed: %s", err)
+		return err
+	}
+	auth := newOAuth2Auth(mechanism, username, token, c.server.Address)
+	defer auth.clear()
+	logger.Debugf("attempting to authenticate as %s using %s", username, mechanism)
+	_, err = imap.Wait(c.conn.Auth(auth))
+	if err != nil {
+		tokens.Invalidate()
+		err = fmt.Errorf("%s authentication failed: %s", strings.ToUpper(mechanism), auth.authError(err))
 		logger.Errorf("login failed: %s", err)
 		return err
 	}
@@ -47,11 +308,126 @@ func (c *IMAPConnection) Login(username, password string) error {
 	return nil
 }
 
+// selectMailbox selects the given mailbox and remembers it, so that it is
+// selected again after reconnecting.
+func (c *IMAPConnection) selectMailbox(mailbox string, readOnly bool) error {
+	_, err := imap.Wait(c.conn.Select(mailbox, readOnly))
+	if err != nil {
+		return err
+	}
+	c.mailbox = mailbox
+	c.readOnly = readOnly
+	c.uidValidity = c.conn.Mailbox.UIDValidity
+	return nil
+}
+
+// retry invokes op and, if it fails because the connection has been lost,
+// reconnects and invokes it again. Reconnecting is attempted up to the
+// configured number of times with exponentially growing, randomized delays.
+// op has to be safe to be invoked again after an unknown part of it has
+// been executed.
+func (c *IMAPConnection) retry(name string, op func() error) error {
+	err := op()
+	for attempt := 0; attempt < c.maxRetries && c.isBroken(err); attempt++ {
+		delay := backoffDelay(c.retryDelay, attempt)
+		logger.Warningf("%s failed due to a connection problem (%s), reconnecting in %s (attempt %d/%d)",
+			name, err, delay, attempt+1, c.maxRetries)
+		time.Sleep(delay)
+		err = c.reconnect()
+		if err != nil {
+			logger.Warningf("reconnecting failed: %s", err)
+			continue
+		}
+		err = op()
+	}
+	return err
+}
+
+// isBroken returns true if the given error has been caused by a lost
+// connection. imap.ErrTimeout only means that a single command did not
+// complete in time, so it is returned to the caller instead.
+func (c *IMAPConnection) isBroken(err error) bool {
+	if err == nil {
+		return false
+	}
+	if c.conn == nil || c.conn.State() == imap.Closed {
+		return true
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, imap.ErrAborted:
+		return true
+	}
+	_, isNetError := err.(net.Error)
+	return isNetError
+}
+
+// reconnect re-establishes the connection, logs in again and selects the
+// previously selected mailbox. ErrUIDValidityChanged is returned if that
+// mailbox's UIDVALIDITY has changed in the meantime.
+func (c *IMAPConnection) reconnect() error {
+	if c.conn != nil {
+		c.conn.Logout(0)
+	}
+	err := c.Dial(c.server)
+	if err != nil {
+		return err
+	}
+	if c.tokens != nil {
+		err = c.authenticateOAuth2(c.username, c.tokens)
+	} else {
+		err = c.login(c.username, c.password)
+	}
+	if err != nil {
+		return err
+	}
+	if c.mailbox == "" {
+		return nil
+	}
+	uidValidity := c.uidValidity
+	logger.Debugf("selecting mailbox '%s' again", c.mailbox)
+	err = c.selectMailbox(c.mailbox, c.readOnly)
+	if err != nil {
+		return err
+	}
+	if c.uidValidity != uidValidity {
+		logger.Errorf("uidvalidity of mailbox '%s' changed from %d to %d while reconnecting",
+			c.mailbox, uidValidity, c.uidValidity)
+		// UIDs known so far refer to the previous uidvalidity
+		c.uidValidity = uidValidity
+		return ErrUIDValidityChanged
+	}
+	logger.Infof("reconnected successfully")
+	return nil
+}
+
+// backoffDelay returns the delay before the given (zero-based) reconnect
+// attempt. The delay doubles with each attempt up to retryMaxDelay; a
+// random jitter of up to half the delay avoids all clients reconnecting at
+// once.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	half := int64(delay / 2)
+	if half == 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
 // Close ends the server connection.
 //
 // Note: Calling this is required to clean up properly.
 func (c *IMAPConnection) Close() error {
 	logger.Debugf("logging out")
+	zeroBytes(c.password)
+	if c.conn == nil {
+		return nil
+	}
 	_, err := c.conn.Logout(0)
 	return err
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/mxk/go-imap/imap"
@@ -9,97 +13,391 @@ import (
 // IMAP date format (rfc3501)
 const IMAPDateFormat = "_2-Jan-2006"
 
+// encryptedSearchFilter selects all messages which have been encrypted by
+// lemoncrypt.
+const encryptedSearchFilter = "UNDELETED (HEADER " + CustomHeader + " \"\")"
+
 // IMAPSource provides support for traversing mails of an IMAP mailbox.
 type IMAPSource struct {
 	*IMAPConnection
-	callbackFunc      IMAPSourceCallback
+	callbackFunc      MessageCallback
 	deletionSet       *imap.SeqSet
+	deletionUIDs      []uint32
+	flaggedUIDs       []uint32
 	deletePlainCopies bool
+	expungeFallback   string
+	dryRun            bool
 	minAge            time.Duration
+	journal           *Journal
+	jobs              int
+	batchSize         int
+	batchBytes        int64
+	sampleSize        int
+	spooler           *Spooler
+	stopRequested     int32
 }
 
-// IMAPSourceCallback is the type for the IMAPSource callback parameter
-type IMAPSourceCallback func(imap.FlagSet, *time.Time, imap.Literal) error
-
 // The duration of a day
 const Day = 24 * time.Hour
 
+// Supported values for the mailbox.expunge_fallback config option, which
+// controls what happens on servers without UIDPLUS support.
+const (
+	// ExpungeGlobal removes all messages marked as deleted, including those
+	// marked by other clients.
+	ExpungeGlobal = "global"
+
+	// ExpungeSkip leaves messages marked as deleted in place.
+	ExpungeSkip = "skip"
+)
+
+// Defaults for the mailbox.batch_size and mailbox.batch_size_mb config
+// options, which limit how many messages are fetched with one command.
+const (
+	DefaultBatchSize   = 200
+	DefaultBatchSizeMB = 50
+)
+
+// searchWindowSize is the number of messages which are searched with one
+// command. This keeps the server's responses small, even for mailboxes with
+// hundreds of thousands of messages.
+const searchWindowSize = 5000
+
 // NewIMAPSource returns a new IMAPSource instance.
-func NewIMAPSource(deletePlainCopies bool, minAgeInDays time.Duration) *IMAPSource {
+// In dry-run mode, mailboxes are opened read-only and messages are never
+// marked as deleted or expunged.
+// expungeFallback is one of ExpungeGlobal or ExpungeSkip and is used if the
+// server does not support UIDPLUS.
+func NewIMAPSource(deletePlainCopies, dryRun bool, expungeFallback string,
+	minAgeInDays time.Duration) *IMAPSource {
 	return &IMAPSource{
 		IMAPConnection:    NewIMAPConnection(),
 		deletePlainCopies: deletePlainCopies,
+		expungeFallback:   expungeFallback,
+		dryRun:            dryRun,
 		minAge:            minAgeInDays * Day,
+		batchSize:         DefaultBatchSize,
+		batchBytes:        DefaultBatchSizeMB * 1024 * 1024,
+	}
+}
+
+// validateExpungeFallback returns an error if the given value is not a
+// supported mailbox.expunge_fallback setting.
+func validateExpungeFallback(fallback string) error {
+	switch fallback {
+	case "", ExpungeGlobal, ExpungeSkip:
+		return nil
 	}
+	return fmt.Errorf("unsupported expunge_fallback '%s' (expected %s or %s)",
+		fallback, ExpungeGlobal, ExpungeSkip)
 }
 
-// Iterate loops through the given mailbox, filters the results by the currently
-// static search filter and invokes the callback for each message.
-func (w *IMAPSource) Iterate(mailbox string, callbackFunc IMAPSourceCallback) error {
+// SetJournal configures the journal which is used to record the progress of
+// each message.
+func (w *IMAPSource) SetJournal(journal *Journal) {
+	w.journal = journal
+}
+
+// SetJobs configures the number of messages which are transformed
+// concurrently.
+func (w *IMAPSource) SetJobs(jobs int) {
+	w.jobs = jobs
+}
+
+// SetBatchLimits configures the maximum number of messages and the maximum
+// total size of the messages which are fetched with one command. The
+// progress is committed (i.e. processed messages are marked as deleted)
+// after each batch. A message which is larger than maxBytes is fetched on
+// its own.
+func (w *IMAPSource) SetBatchLimits(maxMessages int, maxBytes int64) {
+	w.batchSize = maxMessages
+	w.batchBytes = maxBytes
+}
+
+// SetSampleSize limits each iteration to a random sample of at most n of
+// the matching messages; the others are not even fetched. 0 disables
+// sampling.
+func (w *IMAPSource) SetSampleSize(n int) {
+	w.sampleSize = n
+}
+
+// SetSpooler configures the spooler which is used for buffering large
+// messages until they have been processed.
+func (w *IMAPSource) SetSpooler(spooler *Spooler) {
+	w.spooler = spooler
+}
+
+// Stop makes the current and all further iterations finish after the batch
+// which is currently being processed. It may be called from any goroutine.
+func (w *IMAPSource) Stop() {
+	atomic.StoreInt32(&w.stopRequested, 1)
+}
+
+// stopped returns true if Stop has been called.
+func (w *IMAPSource) stopped() bool {
+	return atomic.LoadInt32(&w.stopRequested) != 0
+}
+
+// Iterate loops through the given mailbox, selects all messages which match
+// the given filter and are older than the configured minimum age and invokes
+// the callback for each message.
+func (w *IMAPSource) Iterate(mailbox string, filter *SearchFilter, callbackFunc MessageCallback) error {
+	searchFilter, err := filter.Query(w.minAge, time.Now())
+	if err != nil {
+		logger.Errorf("invalid search filter: %s", err)
+		return err
+	}
+	return w.IterateSearch(mailbox, searchFilter, callbackFunc)
+}
+
+// IterateEncrypted loops through the given mailbox and invokes the callback
+// for each message which has been encrypted by lemoncrypt.
+func (w *IMAPSource) IterateEncrypted(mailbox string, callbackFunc MessageCallback) error {
+	return w.IterateSearch(mailbox, encryptedSearchFilter, callbackFunc)
+}
+
+// IterateSearch loops through the given mailbox, filters the results by the
+// given IMAP search filter and invokes the callback for each message.
+// Messages are fetched in batches, see SetBatchLimits.
+// All messages are addressed by UID. If the mailbox's UIDVALIDITY changes,
+// processing is aborted and ErrUIDValidityChanged is returned.
+func (w *IMAPSource) IterateSearch(mailbox, searchFilter string, callbackFunc MessageCallback) error {
 	w.callbackFunc = callbackFunc
 	logger.Debugf("selecting mailbox '%s'", mailbox)
-	_, err := w.conn.Select(mailbox, false /* read-write */)
+	err := w.retry("SELECT", func() error {
+		return w.selectMailbox(mailbox, w.dryRun /* read-only in dry-run mode */)
+	})
 	if err != nil {
 		logger.Errorf("failed to select mailbox: %s", err)
 		return err
 	}
-	date := time.Now().Add(-w.minAge)
-	dateStr := date.Format(IMAPDateFormat)
-	searchFilter := ("UNDELETED SEEN UNFLAGGED (NOT HEADER X-Lemoncrypt \"\") " +
-		"(OR SENTBEFORE " + dateStr + " BEFORE " + dateStr + ")")
-	logger.Debugf("searching for: %s", searchFilter)
-	cmd, err := imap.Wait(w.conn.Search(searchFilter))
+	w.flaggedUIDs = nil
+	logger.Debugf("mailbox has uidvalidity=%d", w.uidValidity)
+	for _, old := range w.journal.UIDValidities(mailbox) {
+		if old != w.uidValidity {
+			logger.Warningf("uidvalidity of mailbox '%s' has changed since a previous run (%d, now %d); "+
+				"messages which were being stored when that run was interrupted may be stored twice",
+				mailbox, old, w.uidValidity)
+		}
+	}
+	uids, err := w.search(searchFilter)
 	if err != nil {
-		logger.Errorf("search failed: %s", err)
 		return err
 	}
-	logger.Debugf("found %d result sets", len(cmd.Data))
-	for idx, rsp := range cmd.Data {
-		results := rsp.SearchResults()
-		logger.Debugf("result set #%d contains %d results", idx, len(results))
-		if len(results) == 0 {
-			continue
+	logger.Infof("found %d matching messages", len(uids))
+	if w.sampleSize > 0 && len(uids) > w.sampleSize {
+		logger.Infof("processing a random sample of %d messages", w.sampleSize)
+		uids = sampleUIDs(uids, w.sampleSize)
+	}
+	for start := 0; start < len(uids) && !w.stopped(); start += w.batchSize {
+		end := start + w.batchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		logger.Infof("processing messages %d-%d of %d", start+1, end, len(uids))
+		sizes, err := w.fetchSizes(uids[start:end])
+		if err != nil {
+			return err
+		}
+		for _, batch := range splitBatch(uids[start:end], sizes, w.batchBytes) {
+			if w.stopped() {
+				logger.Infof("stop requested, skipping the remaining messages")
+				break
+			}
+			err = w.fetchUIDs(batch)
+			if err == ErrUIDValidityChanged {
+				return err
+			}
 		}
-		_ = w.fetchIDs(results)
 	}
-	logger.Debugf("finally removing mail marked for deletion")
-	_, err = imap.Wait(w.conn.Expunge(nil))
-	if err != nil {
-		logger.Errorf("failed to remove mail marked for deletion: %s", err)
+	return w.expunge()
+}
+
+// sampleUIDs returns n randomly chosen UIDs from the given ones in ascending
+// order.
+func sampleUIDs(uids []uint32, n int) []uint32 {
+	sample := make([]uint32, 0, n)
+	for _, i := range rand.Perm(len(uids))[:n] {
+		sample = append(sample, uids[i])
 	}
-	return err
+	sort.Slice(sample, func(i, j int) bool { return sample[i] < sample[j] })
+	return sample
 }
 
-// fetchIDs downloads the messages with the given IDs and invokes the callback for
-// each message.
-func (w *IMAPSource) fetchIDs(ids []uint32) error {
-	set, _ := imap.NewSeqSet("")
-	set.AddNum(ids...)
-	w.deletionSet, _ = imap.NewSeqSet("")
-	cmd, err := w.conn.Fetch(set, "RFC822", "UID", "FLAGS", "INTERNALDATE")
+// checkUIDValidity returns ErrUIDValidityChanged if the UIDVALIDITY of the
+// selected mailbox differs from the one seen when it was selected.
+func (w *IMAPSource) checkUIDValidity() error {
+	if w.conn.Mailbox == nil {
+		logger.Errorf("mailbox '%s' is no longer selected", w.mailbox)
+		return ErrUIDValidityChanged
+	}
+	if current := w.conn.Mailbox.UIDValidity; current != w.uidValidity {
+		logger.Errorf("uidvalidity of mailbox '%s' changed from %d to %d", w.mailbox, w.uidValidity, current)
+		return ErrUIDValidityChanged
+	}
+	return nil
+}
+
+// expunge removes the messages which have been marked as deleted by us.
+// If the server supports UIDPLUS, exactly those messages are removed.
+// Otherwise, the configured fallback decides whether all messages marked
+// as deleted (even by other clients) are removed or none at all.
+func (w *IMAPSource) expunge() error {
+	if !w.deletePlainCopies {
+		return nil
+	}
+	if w.dryRun {
+		logger.Infof("dry run: not removing mail marked for deletion")
+		return nil
+	}
+	// the journal also knows about messages flagged by previous runs
+	uids := w.flaggedUIDs
+	if w.journal != nil {
+		uids = w.journal.UIDs(w.mailbox, w.uidValidity, JournalFlagged)
+	}
+	var set *imap.SeqSet
+	if w.conn.Caps["UIDPLUS"] {
+		if len(uids) == 0 {
+			return nil
+		}
+		set, _ = imap.NewSeqSet("")
+		set.AddNum(uids...)
+		logger.Debugf("finally removing mail marked for deletion (uids=%s)", set.String())
+	} else if w.expungeFallback == ExpungeSkip {
+		logger.Infof("server lacks UIDPLUS, not removing mail marked for deletion")
+		return nil
+	} else {
+		logger.Debugf("server lacks UIDPLUS, finally removing all mail marked for deletion")
+	}
+	err := w.checkUIDValidity()
 	if err != nil {
-		logger.Errorf("FETCH failed: %s", err)
 		return err
 	}
-	for cmd.InProgress() {
-		w.conn.Recv(-1)
-		for _, rsp := range cmd.Data {
-			_ = w.handleMessage(rsp)
+	err = w.retry("EXPUNGE", func() error {
+		_, err := imap.Wait(w.conn.Expunge(set))
+		return err
+	})
+	if err != nil {
+		logger.Errorf("failed to remove mail marked for deletion: %s", err)
+		return err
+	}
+	for _, uid := range uids {
+		err = w.journal.Record(w.mailbox, w.uidValidity, uid).SetState(JournalExpunged)
+		if err != nil {
+			logger.Errorf("%s", err)
+			return err
 		}
-		cmd.Data = nil
+	}
+	return nil
+}
 
-		// Consume other server data
-		for _ = range w.conn.Data {
+// search returns the UIDs of all messages which match the given IMAP search
+// filter in ascending order. The mailbox is searched in windows of
+// searchWindowSize messages. The windows are given as sequence numbers, but
+// they only limit the size of each response: if other clients remove messages
+// concurrently, messages may at worst be missed and processed in the next run.
+func (w *IMAPSource) search(searchFilter string) ([]uint32, error) {
+	total := w.conn.Mailbox.Messages
+	found := make(map[uint32]bool)
+	var uids []uint32
+	for lo := uint32(1); lo <= total; lo += searchWindowSize {
+		hi := lo + searchWindowSize - 1
+		if hi > total {
+			hi = total
+		}
+		query := fmt.Sprintf("%d:%d %s", lo, hi, searchFilter)
+		logger.Debugf("searching for: %s", query)
+		var cmd *imap.Command
+		err := w.retry("SEARCH", func() error {
+			var err error
+			cmd, err = imap.Wait(w.conn.UIDSearch(query))
+			return err
+		})
+		if err != nil {
+			logger.Errorf("search failed: %s", err)
+			return nil, err
+		}
+		for _, rsp := range cmd.Data {
+			// messages may appear in two windows if other clients
+			// remove messages concurrently.
+			for _, uid := range rsp.SearchResults() {
+				if !found[uid] {
+					found[uid] = true
+					uids = append(uids, uid)
+				}
+			}
 		}
 		w.conn.Data = nil
 	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// fetchSizes returns the sizes of the messages with the given UIDs.
+func (w *IMAPSource) fetchSizes(uids []uint32) (map[uint32]uint32, error) {
+	set, _ := imap.NewSeqSet("")
+	set.AddNum(uids...)
+	var cmd *imap.Command
+	err := w.retry("FETCH", func() error {
+		var err error
+		cmd, err = imap.Wait(w.conn.UIDFetch(set, "RFC822.SIZE"))
+		return err
+	})
+	if err != nil {
+		logger.Errorf("failed to fetch message sizes: %s", err)
+		return nil, err
+	}
+	sizes := make(map[uint32]uint32, len(uids))
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		sizes[info.UID] = info.Size
+	}
+	w.conn.Data = nil
+	return sizes, nil
+}
 
-	if rsp, err := cmd.Result(imap.OK); err != nil {
-		if err == imap.ErrAborted {
-			logger.Errorf("FETCH command aborted")
-		} else {
-			logger.Errorf("FETCH error: %s", rsp.Info)
+// splitBatch splits the given UIDs into consecutive batches whose messages
+// have a total size of at most maxBytes. A message which is larger than
+// maxBytes forms a batch of its own.
+func splitBatch(uids []uint32, sizes map[uint32]uint32, maxBytes int64) [][]uint32 {
+	var batches [][]uint32
+	var batch []uint32
+	var batchBytes int64
+	for _, uid := range uids {
+		size := int64(sizes[uid])
+		if len(batch) > 0 && batchBytes+size > maxBytes {
+			batches = append(batches, batch)
+			batch = nil
+			batchBytes = 0
 		}
+		batch = append(batch, uid)
+		batchBytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// fetchUIDs downloads the messages with the given UIDs and invokes the
+// callback for each message. Afterwards, all successfully processed messages
+// are marked as deleted.
+// If the connection is lost, only the messages which have not been received
+// yet are fetched again after reconnecting.
+func (w *IMAPSource) fetchUIDs(uids []uint32) error {
+	w.deletionSet, _ = imap.NewSeqSet("")
+	w.deletionUIDs = nil
+	pipeline := NewPipeline(w.jobs)
+	received := make(map[uint32]bool)
+	err := w.retry("FETCH", func() error {
+		return w.fetchMessages(pipeline, uids, received)
+	})
+	pipeline.Close()
+	if err == ErrUIDValidityChanged {
+		return err
+	}
+	if err != nil {
+		logger.Errorf("FETCH error: %s", err)
 	} else {
 		logger.Debugf("FETCH completed without errors")
 	}
@@ -112,42 +410,130 @@ func (w *IMAPSource) fetchIDs(ids []uint32) error {
 		return nil
 	}
 
+	if w.dryRun {
+		logger.Infof("dry run: not marking set=%v as deleted", w.deletionSet.String())
+		return nil
+	}
+
+	err = w.checkUIDValidity()
+	if err != nil {
+		return err
+	}
 	logger.Debugf("marking mails as deleted")
-	_, err = imap.Wait(w.conn.UIDStore(w.deletionSet, "+FLAGS", "(\\Deleted)"))
+	err = w.retry("STORE", func() error {
+		_, err := imap.Wait(w.conn.UIDStore(w.deletionSet, "+FLAGS", "(\\Deleted)"))
+		return err
+	})
 	if err != nil {
 		logger.Errorf("failed to mark set=%v for deletion: %s", w.deletionSet.String(), err)
+		return err
 	}
-	return err
+	w.flaggedUIDs = append(w.flaggedUIDs, w.deletionUIDs...)
+	for _, uid := range w.deletionUIDs {
+		err = w.journal.Record(w.mailbox, w.uidValidity, uid).SetState(JournalFlagged)
+		if err != nil {
+			logger.Errorf("%s", err)
+			return err
+		}
+	}
+	return nil
 }
 
-// handleMessage processes one message, invokes the callback and deletes it on
-// success.
-func (w *IMAPSource) handleMessage(rsp *imap.Response) error {
-	msgInfo := rsp.MessageInfo()
-	err := w.invokeMessageCallback(msgInfo)
+// fetchMessages downloads those of the given messages which have not been
+// received yet and submits them to the pipeline.
+func (w *IMAPSource) fetchMessages(pipeline *Pipeline, uids []uint32, received map[uint32]bool) error {
+	set, _ := imap.NewSeqSet("")
+	for _, uid := range uids {
+		if !received[uid] {
+			set.AddNum(uid)
+		}
+	}
+	if set.Empty() {
+		return nil
+	}
+	cmd, err := w.conn.UIDFetch(set, "RFC822", "UID", "FLAGS", "INTERNALDATE")
 	if err != nil {
 		return err
 	}
-	uid := imap.AsNumber(msgInfo.Attrs["UID"])
-	logger.Debugf("internally marking message uid=%d for deletion", uid)
-	w.deletionSet.AddNum(uid)
+	for cmd.InProgress() {
+		err = w.conn.Recv(-1)
+		for _, rsp := range cmd.Data {
+			received[w.handleMessage(pipeline, rsp)] = true
+		}
+		cmd.Data = nil
+
+		// Consume other server data
+		for _ = range w.conn.Data {
+		}
+		w.conn.Data = nil
+		if err != nil {
+			return err
+		}
+	}
+	_, err = cmd.Result(imap.OK)
 	return err
 }
 
-// invokeMessageCallback extracts the relevant data from the passed FETCH response
-// and invokes the user-provided callback.
-func (w *IMAPSource) invokeMessageCallback(msgInfo *imap.MessageInfo) error {
-	logger.Debugf("handling mail uid=%d", msgInfo.Attrs["UID"])
+// handleMessage submits one message to the pipeline, which invokes the
+// callback and deletes the message on success. Messages which have already
+// been stored according to the journal are not passed to the callback again.
+// The message's UID is returned.
+func (w *IMAPSource) handleMessage(pipeline *Pipeline, rsp *imap.Response) uint32 {
+	msgInfo := rsp.MessageInfo()
+	uid := imap.AsNumber(msgInfo.Attrs["UID"])
+	rec := w.journal.Record(w.mailbox, w.uidValidity, uid)
+	switch rec.State() {
+	case JournalAppended, JournalFlagged:
+		logger.Infof("message uid=%d has already been stored (target uid=%d), skipping",
+			uid, rec.TargetUID())
+		pipeline.Submit(func() MessageStoreFunc { return nil }, w.completeFunc(uid, nil))
+		return uid
+	}
 	flags := imap.AsFlagSet(msgInfo.Attrs["FLAGS"])
 	idate := imap.AsDateTime(msgInfo.Attrs["INTERNALDATE"])
-	mailBytes := imap.AsBytes(msgInfo.Attrs["RFC822"])
-	mailLiteral := imap.NewLiteral(mailBytes)
-	logger.Debugf("invoking message transformer")
-	err := w.callbackFunc(flags, &idate, mailLiteral)
-	if err == nil {
-		logger.Debugf("message transformation successful")
-	} else {
-		logger.Warningf("message transformation failed: %s", err)
+	mail, err := w.spoolMessage(msgInfo)
+	if err != nil {
+		pipeline.Submit(func() MessageStoreFunc {
+			return func() error { return err }
+		}, w.completeFunc(uid, mail))
+		return uid
+	}
+	transform := func() MessageStoreFunc {
+		logger.Debugf("invoking message transformer for uid=%d", uid)
+		return w.callbackFunc(rec, flags, &idate, mail)
+	}
+	pipeline.Submit(transform, w.completeFunc(uid, mail))
+	return uid
+}
+
+// spoolMessage copies the message contained in the given FETCH response to a
+// SpoolBuffer, so that the response can be released and large messages do not
+// have to be kept in memory while they are waiting to be processed.
+func (w *IMAPSource) spoolMessage(msgInfo *imap.MessageInfo) (*SpoolBuffer, error) {
+	logger.Debugf("handling mail uid=%d", msgInfo.Attrs["UID"])
+	mail := w.spooler.NewBuffer()
+	_, err := mail.Write(imap.AsBytes(msgInfo.Attrs["RFC822"]))
+	if err != nil {
+		mail.Close()
+		return nil, err
+	}
+	return mail, nil
+}
+
+// completeFunc returns the function which is invoked after the message with
+// the given UID has been processed. It releases the spooled message and marks
+// the message for deletion on success.
+func (w *IMAPSource) completeFunc(uid uint32, mail *SpoolBuffer) PipelineCompleteFunc {
+	return func(err error) {
+		if mail != nil {
+			mail.Close()
+		}
+		if err != nil {
+			logger.Warningf("message transformation failed (uid=%d): %s", uid, err)
+			return
+		}
+		logger.Debugf("internally marking message uid=%d for deletion", uid)
+		w.deletionSet.AddNum(uid)
+		w.deletionUIDs = append(w.deletionUIDs, uid)
 	}
-	return err
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type IMAPSourceSuite struct{}
+
+var _ = Suite(&IMAPSourceSuite{})
+
+func (s *IMAPSourceSuite) TestSplitBatch(c *C) {
+	sizes := map[uint32]uint32{1: 10, 2: 20, 3: 50, 4: 5, 5: 100, 6: 1}
+	batches := splitBatch([]uint32{1, 2, 3, 4, 5, 6}, sizes, 60)
+	c.Assert(batches, DeepEquals, [][]uint32{{1, 2}, {3, 4}, {5}, {6}})
+}
+
+func (s *IMAPSourceSuite) TestSplitBatchUnknownSize(c *C) {
+	batches := splitBatch([]uint32{7, 8}, map[uint32]uint32{}, 1)
+	c.Assert(batches, DeepEquals, [][]uint32{{7, 8}})
+	c.Assert(splitBatch(nil, nil, 1), HasLen, 0)
+}
+
+// newTestSource returns an IMAPSource which deletes processed messages, is
+// logged in to the given fake server and uses a new journal.
+func newTestSource(c *C, srv *fakeIMAPServer, dryRun bool, expungeFallback string) *IMAPSource {
+	src := NewIMAPSource(true, dryRun, expungeFallback, 0)
+	err := src.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv)})
+	c.Assert(err, IsNil)
+	c.Assert(src.Login("user", []byte("secret")), IsNil)
+	journal, err := OpenJournal(filepath.Join(c.MkDir(), "test.journal"))
+	c.Assert(err, IsNil)
+	src.SetJournal(journal)
+	src.SetJobs(1)
+	return src
+}
+
+// addTestMessages stores a message which is going to be processed
+// successfully (uid=1), one whose processing fails (uid=2), one which has
+// been marked as deleted by another client (uid=3) and one which has been
+// marked as deleted by a previous run (uid=4).
+func addTestMessages(c *C, srv *fakeIMAPServer, src *IMAPSource) {
+	srv.addMessage("Subject: ok\r\n\r\nhello\r\n")
+	srv.addMessage("Subject: fail\r\n\r\nhello\r\n")
+	srv.addMessage("Subject: other\r\n\r\nhello\r\n", "\\Deleted")
+	uid := srv.addMessage("Subject: previous\r\n\r\nhello\r\n", "\\Deleted")
+	c.Assert(src.journal.Record("INBOX", 1, uid).SetState(JournalFlagged), IsNil)
+}
+
+// processTestMessage is a MessageCallback which fails for messages whose
+// subject is "fail".
+func processTestMessage(rec *JournalRecord, flags imap.FlagSet, idate *time.Time,
+	mail imap.Literal) MessageStoreFunc {
+	var buf bytes.Buffer
+	mail.WriteTo(&buf)
+	return func() error {
+		if strings.HasPrefix(buf.String(), "Subject: fail\r\n") {
+			return errors.New("processing failed")
+		}
+		return nil
+	}
+}
+
+// journalUIDs returns the UIDs of the messages in the given state in
+// ascending order.
+func journalUIDs(src *IMAPSource, state JournalState) []uint32 {
+	uids := src.journal.UIDs("INBOX", 1, state)
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+func (s *IMAPSourceSuite) TestExpungeUIDPlus(c *C) {
+	srv := newFakeIMAPServer(c, []string{"UIDPLUS"}, true)
+	defer srv.Close()
+	src := newTestSource(c, srv, false, ExpungeSkip)
+	defer src.Close()
+	addTestMessages(c, srv, src)
+
+	c.Assert(src.IterateSearch("INBOX", "UNDELETED", processTestMessage), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "SELECT+tls", "UID SEARCH+tls",
+		"UID FETCH+tls", "UID FETCH+tls", "UID STORE+tls", "UID EXPUNGE+tls"})
+	// the message marked as deleted by another client is kept
+	c.Assert(srv.UIDs(), DeepEquals, []uint32{2, 3})
+	c.Assert(journalUIDs(src, JournalExpunged), DeepEquals, []uint32{1, 4})
+}
+
+func (s *IMAPSourceSuite) TestExpungeFallbackGlobal(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	src := newTestSource(c, srv, false, ExpungeGlobal)
+	defer src.Close()
+	addTestMessages(c, srv, src)
+
+	c.Assert(src.IterateSearch("INBOX", "UNDELETED", processTestMessage), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "SELECT+tls", "UID SEARCH+tls",
+		"UID FETCH+tls", "UID FETCH+tls", "UID STORE+tls", "EXPUNGE+tls"})
+	c.Assert(srv.UIDs(), DeepEquals, []uint32{2})
+	c.Assert(journalUIDs(src, JournalExpunged), DeepEquals, []uint32{1, 4})
+}
+
+func (s *IMAPSourceSuite) TestExpungeFallbackSkip(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	src := newTestSource(c, srv, false, ExpungeSkip)
+	defer src.Close()
+	addTestMessages(c, srv, src)
+
+	c.Assert(src.IterateSearch("INBOX", "UNDELETED", processTestMessage), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "SELECT+tls", "UID SEARCH+tls",
+		"UID FETCH+tls", "UID FETCH+tls", "UID STORE+tls"})
+	c.Assert(srv.UIDs(), DeepEquals, []uint32{1, 2, 3, 4})
+	c.Assert(journalUIDs(src, JournalFlagged), DeepEquals, []uint32{1, 4})
+}
+
+func (s *IMAPSourceSuite) TestDryRun(c *C) {
+	srv := newFakeIMAPServer(c, []string{"UIDPLUS"}, true)
+	defer srv.Close()
+	src := newTestSource(c, srv, true, ExpungeGlobal)
+	defer src.Close()
+	addTestMessages(c, srv, src)
+
+	summary := NewSummary()
+	summary.StartFolder("INBOX")
+	err := src.IterateSearch("INBOX", "UNDELETED", func(rec *JournalRecord, flags imap.FlagSet,
+		idate *time.Time, mail imap.Literal) MessageStoreFunc {
+		summary.Record(idate, mail, mail, nil)
+		return processTestMessage(rec, flags, idate, mail)
+	})
+	c.Assert(err, IsNil)
+	// the mailbox is opened read-only and nothing is stored or removed
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "EXAMINE+tls", "UID SEARCH+tls",
+		"UID FETCH+tls", "UID FETCH+tls"})
+	for _, cmd := range srv.Commands() {
+		c.Assert(cmd, Not(Matches), ".*(STORE|EXPUNGE|APPEND).*")
+	}
+	c.Assert(srv.UIDs(), DeepEquals, []uint32{1, 2, 3, 4})
+	c.Assert(journalUIDs(src, JournalFlagged), DeepEquals, []uint32{4})
+	c.Assert(summary.folders[0].Messages, Equals, 2)
+}
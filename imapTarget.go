@@ -1,6 +1,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/mxk/go-imap/imap"
@@ -26,7 +30,9 @@ func (w *IMAPTarget) SelectMailbox(mailbox string) error {
 	_, err := imap.Wait(w.conn.Create(mailbox))
 	logger.Debugf("mailbox creation ended with err=%s", err)
 	logger.Debugf("selecting mailbox '%s'", mailbox)
-	_, err = imap.Wait(w.conn.Select(mailbox, false /* readonly=false */))
+	err = w.retry("SELECT", func() error {
+		return w.selectMailbox(mailbox, false /* readonly=false */)
+	})
 	if err != nil {
 		logger.Errorf("unable to select mailbox '%s': %s", mailbox, err)
 	}
@@ -34,13 +40,226 @@ func (w *IMAPTarget) SelectMailbox(mailbox string) error {
 }
 
 // Append adds the given message to the given mailbox with the given flags and internal
-// date.
-func (w *IMAPTarget) Append(flags imap.FlagSet, idate *time.Time, msg imap.Literal) error {
+// date. It returns the UID of the new message if the server reports it
+// (UIDPLUS) or 0 otherwise.
+// If the connection is lost, the message is only appended again after
+// reconnecting if no message with the given Message-Id and the size of the
+// given message has been stored, as the interrupted APPEND may have stored
+// it partially.
+func (w *IMAPTarget) Append(flags imap.FlagSet, idate *time.Time, msg imap.Literal,
+	msgID string) (uint32, error) {
 	logger.Debugf("appending mail to mailbox '%s'", w.curMailbox)
-	delete(flags, "\\Recent")
-	_, err := imap.Wait(w.conn.Append(w.curMailbox, flags, idate, msg))
+	flags = w.permanentFlags(flags)
+	var uid uint32
+	attempted := false
+	err := w.retry("APPEND", func() error {
+		if attempted {
+			if msgID == "" {
+				return errors.New("unable to tell whether the interrupted APPEND succeeded " +
+					"(no Message-Id to look it up by)")
+			}
+			uids, err := w.searchMessageID(msgID)
+			if err != nil {
+				return err
+			}
+			if len(uids) > 0 {
+				uid, err = w.storedUID(uids, msg)
+				if err != nil {
+					return err
+				}
+				if uid != 0 {
+					logger.Infof("interrupted APPEND succeeded (uid=%d)", uid)
+					return nil
+				}
+				logger.Warningf("interrupted APPEND stored an incomplete message, appending it again")
+			}
+		}
+		attempted = true
+		var err error
+		uid, err = w.append(flags, idate, msg)
+		return err
+	})
 	if err != nil {
 		logger.Errorf("failed to store message: %s", err)
 	}
-	return err
+	return uid, err
+}
+
+// permanentFlags returns the given flags without those which cannot be
+// stored in the current mailbox, as reported by PERMANENTFLAGS. This matters
+// when the source mailbox is on a different server, which may support other
+// keywords. \Recent is always removed as it can only be set by the server.
+func (w *IMAPTarget) permanentFlags(flags imap.FlagSet) imap.FlagSet {
+	var perm imap.FlagSet
+	if w.conn != nil && w.conn.Mailbox != nil {
+		perm = w.conn.Mailbox.PermFlags
+	}
+	return filterFlags(flags, perm)
+}
+
+// filterFlags returns the flags which may be stored according to the given
+// PERMANENTFLAGS. If perm is empty, the server did not send PERMANENTFLAGS,
+// which means that all flags may be stored (rfc3501, 7.1).
+func filterFlags(flags, perm imap.FlagSet) imap.FlagSet {
+	result := make(imap.FlagSet)
+	for flag := range flags {
+		switch {
+		case flag == "\\Recent":
+			continue
+		case len(perm) == 0 || perm[flag]:
+		case perm["\\*"] && !strings.HasPrefix(flag, "\\"):
+			// new keywords may be created
+		default:
+			logger.Warningf("target mailbox does not support flag %s, dropping it", flag)
+			continue
+		}
+		result[flag] = true
+	}
+	return result
+}
+
+// append performs a single APPEND command.
+func (w *IMAPTarget) append(flags imap.FlagSet, idate *time.Time, msg imap.Literal) (uint32, error) {
+	cmd, err := imap.Wait(w.conn.Append(w.curMailbox, flags, idate, msg))
+	if err != nil {
+		return 0, err
+	}
+	rsp, err := cmd.Result(imap.OK)
+	if err != nil || rsp.Label != "APPENDUID" || len(rsp.Fields) < 2 {
+		return 0, nil
+	}
+	uid := imap.AsNumber(rsp.Fields[len(rsp.Fields)-1])
+	logger.Debugf("message has been stored with uid=%d", uid)
+	return uid, nil
+}
+
+// FindMessageID searches the current mailbox for a message with the given
+// Message-Id and returns its UID or 0 if there is no such message.
+func (w *IMAPTarget) FindMessageID(msgID string) (uint32, error) {
+	var uids []uint32
+	err := w.retry("SEARCH", func() error {
+		var err error
+		uids, err = w.searchMessageID(msgID)
+		return err
+	})
+	if err != nil || len(uids) == 0 {
+		return 0, err
+	}
+	return uids[0], nil
+}
+
+// searchMessageID returns the UIDs of all messages in the current mailbox
+// with the given Message-Id.
+func (w *IMAPTarget) searchMessageID(msgID string) ([]uint32, error) {
+	if msgID == "" {
+		return nil, errors.New("empty message id")
+	}
+	quoted, err := quoteSearchString(msgID)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported message id: %s", err)
+	}
+	cmd, err := imap.Wait(w.conn.UIDSearch("HEADER Message-Id " + quoted))
+	if err != nil {
+		logger.Errorf("search failed: %s", err)
+		return nil, err
+	}
+	var uids []uint32
+	for _, rsp := range cmd.Data {
+		uids = append(uids, rsp.SearchResults()...)
+	}
+	return uids, nil
+}
+
+// ConfirmStored proves that the given message has been stored in the
+// current mailbox. The stored message is looked up by the UID reported by
+// the server (if uid is non-zero) or by its Message-Id otherwise (if msgID is
+// non-empty) and its size is checked by storedUID.
+// The UID of the stored message is returned.
+func (w *IMAPTarget) ConfirmStored(uid uint32, msgID string, msg imap.Literal) (uint32, error) {
+	uids := []uint32{uid}
+	if uid == 0 && msgID == "" {
+		return 0, errors.New("unable to confirm that the message has been stored: the server did not " +
+			"report its uid (UIDPLUS) and there is no Message-Id to look it up by")
+	}
+	if uid == 0 {
+		err := w.retry("SEARCH", func() error {
+			var err error
+			uids, err = w.searchMessageID(msgID)
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("unable to look up stored message: %s", err)
+		}
+		if len(uids) == 0 {
+			return 0, fmt.Errorf("stored message with message-id=%s not found", msgID)
+		}
+	}
+	var storedUID uint32
+	err := w.retry("FETCH", func() error {
+		var err error
+		storedUID, err = w.storedUID(uids, msg)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch stored message: %s", err)
+	}
+	if storedUID == 0 {
+		return 0, fmt.Errorf("unable to confirm that the message has been stored (uids=%v)", uids)
+	}
+	return storedUID, nil
+}
+
+// storedUID returns the UID of the first of the given messages whose size
+// matches the size of the given message, either as-is or with line endings
+// converted to CRLF as some servers do, or 0 if there is none.
+func (w *IMAPTarget) storedUID(uids []uint32, msg imap.Literal) (uint32, error) {
+	set, _ := imap.NewSeqSet("")
+	set.AddNum(uids...)
+	cmd, err := imap.Wait(w.conn.UIDFetch(set, "RFC822.SIZE"))
+	if err != nil {
+		return 0, err
+	}
+	size := msg.Info().Len
+	crlfSize := uint32(crlfLength(msg))
+	for _, rsp := range cmd.Data {
+		msgInfo := rsp.MessageInfo()
+		if msgInfo == nil {
+			continue
+		}
+		storedSize := imap.AsNumber(msgInfo.Attrs["RFC822.SIZE"])
+		storedUID := imap.AsNumber(msgInfo.Attrs["UID"])
+		if storedSize == size || storedSize == crlfSize {
+			logger.Debugf("confirmed stored message uid=%d (size=%d)", storedUID, storedSize)
+			return storedUID, nil
+		}
+		logger.Warningf("stored message uid=%d has size=%d, expected %d or %d",
+			storedUID, storedSize, size, crlfSize)
+	}
+	return 0, nil
+}
+
+// crlfCounter is a Writer which counts the bytes written to it as if all bare
+// LF line endings were converted to CRLF.
+type crlfCounter struct {
+	count int64
+	prev  byte
+}
+
+func (c *crlfCounter) Write(data []byte) (int, error) {
+	for _, char := range data {
+		if char == '\n' && c.prev != '\r' {
+			c.count++
+		}
+		c.count++
+		c.prev = char
+	}
+	return len(data), nil
+}
+
+// crlfLength returns the length of the given message after converting all
+// bare LF line endings to CRLF.
+func crlfLength(msg io.WriterTo) int64 {
+	c := &crlfCounter{}
+	msg.WriteTo(c)
+	return c.count
 }
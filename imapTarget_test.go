@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type IMAPTargetSuite struct{}
+
+var _ = Suite(&IMAPTargetSuite{})
+
+var crlfLengthTests = []struct {
+	in  string
+	out int64
+}{
+	{"", 0},
+	{"foo", 3},
+	{"foo\n", 5},
+	{"foo\r\n", 5},
+	{"a\nb\r\nc\n\n", 11},
+	{"\r\r\n", 3},
+}
+
+func (s *IMAPTargetSuite) TestCRLFLength(c *C) {
+	for _, tt := range crlfLengthTests {
+		c.Assert(crlfLength(bytes.NewBufferString(tt.in)), Equals, tt.out)
+	}
+}
+
+var filterFlagsTests = []struct {
+	perm imap.FlagSet
+	out  imap.FlagSet
+}{
+	{nil, imap.NewFlagSet("\\Seen", "\\Answered", "$Forwarded")},
+	{imap.NewFlagSet("\\Seen", "\\*"), imap.NewFlagSet("\\Seen", "$Forwarded")},
+	{imap.NewFlagSet("\\Seen", "\\Answered"), imap.NewFlagSet("\\Seen", "\\Answered")},
+}
+
+func (s *IMAPTargetSuite) TestFilterFlags(c *C) {
+	for _, tt := range filterFlagsTests {
+		flags := imap.NewFlagSet("\\Seen", "\\Recent", "\\Answered", "$Forwarded")
+		c.Assert(filterFlags(flags, tt.perm), DeepEquals, tt.out)
+	}
+}
+
+// newTestTarget returns an IMAPTarget which is logged in to the given fake
+// server and has selected INBOX.
+func newTestTarget(c *C, srv *fakeIMAPServer) *IMAPTarget {
+	return &IMAPTarget{IMAPConnection: newReconnectTestConnection(c, srv), curMailbox: "INBOX"}
+}
+
+func (s *IMAPTargetSuite) TestAppendRetryIncomplete(c *C) {
+	// the interrupted APPEND stored only part of the message, which must
+	// not be taken for the complete one
+	srv := newFakeIMAPServer(c, []string{"UIDPLUS"}, true)
+	defer srv.Close()
+	w := newTestTarget(c, srv)
+	defer w.Close()
+	body := "Message-Id: <1@example.org>\r\n\r\nhello\r\n"
+	srv.addMessage(body[:20])
+	srv.dropOnce("APPEND")
+
+	uid, err := w.Append(nil, nil, imap.NewLiteral([]byte(body)), "<1@example.org>")
+	c.Assert(err, IsNil)
+	c.Assert(uid, Equals, uint32(2))
+	c.Assert(srv.UIDs(), DeepEquals, []uint32{1, 2})
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "SELECT+tls", "APPEND+tls",
+		"LOGIN+tls", "SELECT+tls", "UID SEARCH+tls", "UID FETCH+tls", "APPEND+tls"})
+}
+
+func (s *IMAPTargetSuite) TestAppendRetryComplete(c *C) {
+	srv := newFakeIMAPServer(c, []string{"UIDPLUS"}, true)
+	defer srv.Close()
+	w := newTestTarget(c, srv)
+	defer w.Close()
+	body := "Message-Id: <1@example.org>\r\n\r\nhello\r\n"
+	srv.addMessage(body)
+	srv.dropOnce("APPEND")
+
+	uid, err := w.Append(nil, nil, imap.NewLiteral([]byte(body)), "<1@example.org>")
+	c.Assert(err, IsNil)
+	c.Assert(uid, Equals, uint32(1))
+	c.Assert(srv.UIDs(), DeepEquals, []uint32{1})
+}
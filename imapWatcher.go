@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+const (
+	// idleRefreshInterval is the interval after which IDLE is re-issued, as
+	// servers may drop connections which have been idle for 30 minutes
+	// (rfc2177).
+	idleRefreshInterval = 25 * time.Minute
+
+	// idlePollInterval is the interval in which an IMAPWatcher checks
+	// whether it should stop.
+	idlePollInterval = 2 * time.Second
+)
+
+// IMAPWatcher waits for changes in a single mailbox using IMAP IDLE (rfc2177).
+// It uses its own connection as the mailbox is selected for the whole time.
+type IMAPWatcher struct {
+	*IMAPConnection
+	mailbox string
+}
+
+// NewIMAPWatcher returns a new IMAPWatcher instance for the given mailbox.
+func NewIMAPWatcher(mailbox string) *IMAPWatcher {
+	return &IMAPWatcher{
+		IMAPConnection: NewIMAPConnection(),
+		mailbox:        mailbox,
+	}
+}
+
+// Watch sends the mailbox name to changes whenever messages are added to,
+// removed from or changed in the mailbox, until stop is closed. Lost
+// connections are re-established. Sending does not block; if changes is
+// full, the notification is dropped.
+func (w *IMAPWatcher) Watch(changes chan<- string, stop <-chan struct{}) error {
+	if !w.conn.Caps["IDLE"] {
+		return errors.New("server does not support IDLE")
+	}
+	err := w.retry("SELECT", func() error {
+		return w.selectMailbox(w.mailbox, true /* readonly */)
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		done := false
+		err = w.retry("IDLE", func() error {
+			var err error
+			done, err = w.idle(changes, stop)
+			return err
+		})
+		if err == ErrUIDValidityChanged {
+			// irrelevant for watching, but all messages have to be rescanned;
+			// later reconnects compare against the new uidvalidity
+			w.uidValidity = w.conn.Mailbox.UIDValidity
+			w.notify(changes)
+			continue
+		}
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// notify sends the mailbox name to changes unless it is full.
+func (w *IMAPWatcher) notify(changes chan<- string) {
+	select {
+	case changes <- w.mailbox:
+	default:
+	}
+}
+
+// idle runs a single IDLE command until stop is closed (in which case true
+// is returned) or until it has to be refreshed.
+func (w *IMAPWatcher) idle(changes chan<- string, stop <-chan struct{}) (bool, error) {
+	logger.Debugf("waiting for changes in mailbox '%s'", w.mailbox)
+	_, err := w.conn.Idle()
+	if err != nil {
+		return false, err
+	}
+	refresh := time.Now().Add(idleRefreshInterval)
+	for time.Now().Before(refresh) {
+		err = w.conn.Recv(idlePollInterval)
+		if err != nil && err != imap.ErrTimeout {
+			return false, err
+		}
+		if w.hasChanges() {
+			logger.Debugf("mailbox '%s' has changed", w.mailbox)
+			w.notify(changes)
+		}
+		select {
+		case <-stop:
+			_, err = imap.Wait(w.conn.IdleTerm())
+			return true, err
+		default:
+		}
+	}
+	_, err = imap.Wait(w.conn.IdleTerm())
+	return false, err
+}
+
+// hasChanges consumes the data received from the server and returns true if
+// it indicates that messages have been added, removed or changed.
+func (w *IMAPWatcher) hasChanges() bool {
+	changed := false
+	for _, rsp := range w.conn.Data {
+		switch rsp.Label {
+		case "EXISTS", "EXPUNGE", "FETCH":
+			changed = true
+		}
+	}
+	w.conn.Data = nil
+	return changed
+}
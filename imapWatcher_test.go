@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type IMAPWatcherSuite struct{}
+
+var _ = Suite(&IMAPWatcherSuite{})
+
+// newTestWatcher returns a watcher which is connected to the given fake
+// server.
+func newTestWatcher(c *C, srv *fakeIMAPServer) *IMAPWatcher {
+	w := NewIMAPWatcher("INBOX")
+	w.retryDelay = time.Millisecond
+	err := w.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv)})
+	c.Assert(err, IsNil)
+	c.Assert(w.Login("user", []byte("secret")), IsNil)
+	return w
+}
+
+func (s *IMAPWatcherSuite) TestNotifyAndStop(c *C) {
+	srv := newFakeIMAPServer(c, []string{"IDLE"}, true)
+	defer srv.Close()
+	w := newTestWatcher(c, srv)
+	changes := make(chan string, 1)
+	stop := make(chan struct{})
+	result := make(chan error)
+	go func() {
+		result <- w.Watch(changes, stop)
+	}()
+
+	select {
+	case folder := <-changes:
+		c.Assert(folder, Equals, "INBOX")
+	case <-time.After(5 * time.Second):
+		c.Fatal("no change reported")
+	}
+	close(stop)
+	c.Assert(<-result, IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "EXAMINE+tls", "IDLE+tls",
+		"LOGOUT+tls"})
+}
+
+func (s *IMAPWatcherSuite) TestIdleUnsupported(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	w := newTestWatcher(c, srv)
+	defer w.Close()
+	err := w.Watch(make(chan string, 1), make(chan struct{}))
+	c.Assert(err, ErrorMatches, "server does not support IDLE")
+}
+
+func (s *IMAPWatcherSuite) TestReconnectUIDValidityChanged(c *C) {
+	srv := newFakeIMAPServer(c, []string{"IDLE"}, true)
+	defer srv.Close()
+	w := newTestWatcher(c, srv)
+	srv.setUIDValidityOnDrop(2)
+	srv.dropOnce("IDLE")
+	srv.dropOnce("IDLE")
+	changes := make(chan string, 10)
+	stop := make(chan struct{})
+	result := make(chan error)
+	go func() {
+		result <- w.Watch(changes, stop)
+	}()
+
+	// the first reconnect reports the changed uidvalidity, the second one
+	// must not report it again, so the only other change is the new message
+	for i := 0; i < 2; i++ {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			c.Fatal("no change reported")
+		}
+	}
+	close(stop)
+	c.Assert(<-result, IsNil)
+	c.Assert(changes, HasLen, 0)
+	c.Assert(w.uidValidity, Equals, uint32(2))
+	c.Assert(w.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "EXAMINE+tls", "IDLE+tls",
+		"LOGIN+tls", "EXAMINE+tls", "IDLE+tls", "LOGIN+tls", "EXAMINE+tls", "IDLE+tls", "LOGOUT+tls"})
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+// fakeIMAPServer is a minimal scripted IMAP server which is just good enough
+// to test connection setup, authentication and the processing of messages.
+// All mailboxes share the same messages.
+type fakeIMAPServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	caps        []string
+	mu          sync.Mutex
+	commands    []string
+	uidValidity uint32
+	drops       map[string]int
+	dropChanges uint32
+	validToken  string
+	authData    []string
+	messages    []*fakeMessage
+	nextUID     uint32
+}
+
+// fakeMessage is a message stored by a fakeIMAPServer.
+type fakeMessage struct {
+	uid   uint32
+	flags map[string]bool
+	body  string
+}
+
+// flagList returns the message's flags as IMAP list.
+func (m *fakeMessage) flagList() string {
+	var flags []string
+	for flag := range m.flags {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+// newFakeIMAPServer starts listening on a random local port and serves
+// connections in the background until Close is called.
+func newFakeIMAPServer(c *C, caps []string, implicitTLS bool) *fakeIMAPServer {
+	s := &fakeIMAPServer{
+		tlsConfig:   newTestTLSConfig(c),
+		implicitTLS: implicitTLS,
+		caps:        caps,
+		uidValidity: 1,
+		drops:       make(map[string]int),
+		validToken:  "valid",
+	}
+	var err error
+	if implicitTLS {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	c.Assert(err, IsNil)
+	go s.serve()
+	return s
+}
+
+// Address returns the host:port where the server is listening.
+func (s *fakeIMAPServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server.
+func (s *fakeIMAPServer) Close() {
+	s.listener.Close()
+}
+
+// Commands returns the names of all received commands, suffixed with "+tls"
+// if they have been received over an encrypted connection.
+func (s *fakeIMAPServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *fakeIMAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeIMAPServer) record(cmd string, encrypted bool) {
+	if encrypted {
+		cmd += "+tls"
+	}
+	s.mu.Lock()
+	s.commands = append(s.commands, cmd)
+	s.mu.Unlock()
+}
+
+// dropOnce makes the server close the connection without responding when it
+// receives the given command the next time.
+func (s *fakeIMAPServer) dropOnce(cmd string) {
+	s.mu.Lock()
+	s.drops[cmd]++
+	s.mu.Unlock()
+}
+
+// shouldDrop returns true if the connection should be closed instead of
+// responding to the given command.
+func (s *fakeIMAPServer) shouldDrop(cmd string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drops[cmd] == 0 {
+		return false
+	}
+	s.drops[cmd]--
+	if s.dropChanges != 0 {
+		s.uidValidity = s.dropChanges
+		s.dropChanges = 0
+	}
+	return true
+}
+
+// setUIDValidityOnDrop changes the UIDVALIDITY which is reported for all
+// mailboxes as soon as the next connection is dropped, as if the mailbox had
+// been recreated while the client was disconnected.
+func (s *fakeIMAPServer) setUIDValidityOnDrop(uidValidity uint32) {
+	s.mu.Lock()
+	s.dropChanges = uidValidity
+	s.mu.Unlock()
+}
+
+// setUIDValidity changes the UIDVALIDITY which is reported for all mailboxes.
+func (s *fakeIMAPServer) setUIDValidity(uidValidity uint32) {
+	s.mu.Lock()
+	s.uidValidity = uidValidity
+	s.mu.Unlock()
+}
+
+// addMessage stores a message with the given body and flags and returns its
+// UID.
+func (s *fakeIMAPServer) addMessage(body string, flags ...string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextUID++
+	msg := &fakeMessage{uid: s.nextUID, flags: make(map[string]bool), body: body}
+	for _, flag := range flags {
+		msg.flags[flag] = true
+	}
+	s.messages = append(s.messages, msg)
+	return msg.uid
+}
+
+// UIDs returns the UIDs of all stored messages.
+func (s *fakeIMAPServer) UIDs() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var uids []uint32
+	for _, msg := range s.messages {
+		uids = append(uids, msg.uid)
+	}
+	return uids
+}
+
+func (s *fakeIMAPServer) hasCap(cap string) bool {
+	for _, c := range s.caps {
+		if c == cap {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUIDSet returns the UIDs contained in the given sequence set.
+func parseUIDSet(set string) map[uint32]bool {
+	uids := make(map[uint32]bool)
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		lo, _ := strconv.ParseUint(bounds[0], 10, 32)
+		hi := lo
+		if len(bounds) == 2 {
+			hi, _ = strconv.ParseUint(bounds[1], 10, 32)
+		}
+		for uid := lo; uid <= hi; uid++ {
+			uids[uint32(uid)] = true
+		}
+	}
+	return uids
+}
+
+// search responds with the UIDs of all messages, except those marked as
+// deleted if the criteria contain UNDELETED. Other criteria are ignored.
+func (s *fakeIMAPServer) search(conn net.Conn, tag string, criteria []string) {
+	undeleted := false
+	for _, key := range criteria {
+		undeleted = undeleted || strings.ToUpper(key) == "UNDELETED"
+	}
+	s.mu.Lock()
+	rsp := "* SEARCH"
+	for _, msg := range s.messages {
+		if !undeleted || !msg.flags["\\Deleted"] {
+			rsp += fmt.Sprintf(" %d", msg.uid)
+		}
+	}
+	s.mu.Unlock()
+	conn.Write([]byte(rsp + "\r\n" + tag + " OK SEARCH completed\r\n"))
+}
+
+// fetch responds with all attributes of the messages in the given UID set.
+func (s *fakeIMAPServer) fetch(conn net.Conn, tag, set string) {
+	uids := parseUIDSet(set)
+	s.mu.Lock()
+	var rsp string
+	for i, msg := range s.messages {
+		if uids[msg.uid] {
+			rsp += fmt.Sprintf("* %d FETCH (UID %d RFC822.SIZE %d FLAGS %s "+
+				"INTERNALDATE \"01-Feb-2020 10:00:00 +0000\" RFC822 {%d}\r\n%s)\r\n",
+				i+1, msg.uid, len(msg.body), msg.flagList(), len(msg.body), msg.body)
+		}
+	}
+	s.mu.Unlock()
+	conn.Write([]byte(rsp + tag + " OK FETCH completed\r\n"))
+}
+
+// store adds the given flags to the messages in the given UID set.
+func (s *fakeIMAPServer) store(conn net.Conn, tag string, args []string) {
+	if len(args) < 3 || strings.ToUpper(args[1]) != "+FLAGS" {
+		conn.Write([]byte(tag + " BAD unsupported STORE\r\n"))
+		return
+	}
+	uids := parseUIDSet(args[0])
+	flags := strings.Fields(strings.Trim(strings.Join(args[2:], " "), "()"))
+	s.mu.Lock()
+	for _, msg := range s.messages {
+		if uids[msg.uid] {
+			for _, flag := range flags {
+				msg.flags[flag] = true
+			}
+		}
+	}
+	s.mu.Unlock()
+	conn.Write([]byte(tag + " OK STORE completed\r\n"))
+}
+
+// expunge removes the messages which are marked as deleted and, if uids is
+// not nil, contained in uids.
+func (s *fakeIMAPServer) expunge(conn net.Conn, tag string, uids map[uint32]bool) {
+	s.mu.Lock()
+	var rsp string
+	var kept []*fakeMessage
+	for _, msg := range s.messages {
+		if msg.flags["\\Deleted"] && (uids == nil || uids[msg.uid]) {
+			rsp += fmt.Sprintf("* %d EXPUNGE\r\n", len(kept)+1)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	s.messages = kept
+	s.mu.Unlock()
+	conn.Write([]byte(rsp + tag + " OK EXPUNGE completed\r\n"))
+}
+
+// appendMessage receives the literal of an APPEND command and stores the
+// message. The UID is reported if the server supports UIDPLUS.
+func (s *fakeIMAPServer) appendMessage(conn net.Conn, r *bufio.Reader, tag, line string) bool {
+	line = strings.TrimSpace(line)
+	start := strings.LastIndex(line, "{")
+	size, err := strconv.Atoi(strings.TrimSuffix(line[start+1:], "}"))
+	if start < 0 || err != nil {
+		conn.Write([]byte(tag + " BAD missing literal\r\n"))
+		return true
+	}
+	conn.Write([]byte("+ ready\r\n"))
+	body := make([]byte, size)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return false
+	}
+	if _, err = r.ReadString('\n'); err != nil {
+		return false
+	}
+	var flags []string
+	if open := strings.Index(line, "("); open >= 0 && open < start {
+		flags = strings.Fields(line[open+1 : strings.Index(line, ")")])
+	}
+	uid := s.addMessage(string(body), flags...)
+	if s.hasCap("UIDPLUS") {
+		s.mu.Lock()
+		uidValidity := s.uidValidity
+		s.mu.Unlock()
+		conn.Write([]byte(fmt.Sprintf("%s OK [APPENDUID %d %d] APPEND completed\r\n", tag, uidValidity, uid)))
+	} else {
+		conn.Write([]byte(tag + " OK APPEND completed\r\n"))
+	}
+	return true
+}
+
+func (s *fakeIMAPServer) capabilities(encrypted bool) string {
+	caps := []string{"IMAP4rev1"}
+	for _, cap := range s.caps {
+		if encrypted && (cap == "STARTTLS" || cap == "LOGINDISABLED") {
+			continue
+		}
+		caps = append(caps, cap)
+	}
+	return strings.Join(caps, " ")
+}
+
+func (s *fakeIMAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	encrypted := s.implicitTLS
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("* OK [CAPABILITY " + s.capabilities(encrypted) + "] fake server ready\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			conn.Write([]byte("* BAD missing command\r\n"))
+			continue
+		}
+		tag, cmd := fields[0], strings.ToUpper(fields[1])
+		if cmd == "UID" && len(fields) > 3 {
+			cmd += " " + strings.ToUpper(fields[2])
+		}
+		s.record(cmd, encrypted)
+		if s.shouldDrop(cmd) {
+			return
+		}
+		switch cmd {
+		case "CAPABILITY":
+			conn.Write([]byte("* CAPABILITY " + s.capabilities(encrypted) + "\r\n" +
+				tag + " OK CAPABILITY completed\r\n"))
+		case "STARTTLS":
+			conn.Write([]byte(tag + " OK begin TLS negotiation now\r\n"))
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			encrypted = true
+		case "AUTHENTICATE":
+			if !s.authenticate(conn, r, fields[2:]) {
+				conn.Write([]byte(tag + " NO AUTHENTICATE failed\r\n"))
+				continue
+			}
+			conn.Write([]byte(tag + " OK AUTHENTICATE completed\r\n"))
+		case "LOGIN", "NOOP":
+			conn.Write([]byte(tag + " OK " + cmd + " completed\r\n"))
+		case "SELECT", "EXAMINE":
+			s.mu.Lock()
+			uidValidity, exists := s.uidValidity, len(s.messages)
+			s.mu.Unlock()
+			conn.Write([]byte(fmt.Sprintf("* %d EXISTS\r\n* OK [UIDVALIDITY %d] UIDs valid\r\n"+
+				"%s OK [READ-WRITE] SELECT completed\r\n", exists, uidValidity, tag)))
+		case "UID SEARCH":
+			s.search(conn, tag, fields[3:])
+		case "UID FETCH":
+			s.fetch(conn, tag, fields[3])
+		case "UID STORE":
+			s.store(conn, tag, fields[3:])
+		case "UID EXPUNGE":
+			if !s.hasCap("UIDPLUS") {
+				conn.Write([]byte(tag + " BAD UIDPLUS not supported\r\n"))
+				continue
+			}
+			s.expunge(conn, tag, parseUIDSet(fields[3]))
+		case "EXPUNGE":
+			s.expunge(conn, tag, nil)
+		case "APPEND":
+			if !s.appendMessage(conn, r, tag, line) {
+				return
+			}
+		case "IDLE":
+			// report a new message right away and wait for DONE
+			conn.Write([]byte("+ idling\r\n* 1 EXISTS\r\n"))
+			line, err = r.ReadString('\n')
+			if err != nil || strings.TrimSpace(line) != "DONE" {
+				return
+			}
+			conn.Write([]byte(tag + " OK IDLE terminated\r\n"))
+		case "LOGOUT":
+			conn.Write([]byte("* BYE logging out\r\n" + tag + " OK LOGOUT completed\r\n"))
+			return
+		default:
+			conn.Write([]byte(tag + " BAD unsupported command\r\n"))
+		}
+	}
+}
+
+// authenticate handles the PLAIN, EXTERNAL, XOAUTH2 and OAUTHBEARER
+// mechanisms with or without an initial response and returns true if the
+// client sent the valid credentials. EXTERNAL is always accepted.
+func (s *fakeIMAPServer) authenticate(conn net.Conn, r *bufio.Reader, args []string) bool {
+	if len(args) < 2 {
+		conn.Write([]byte("+ \r\n"))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		args = append(args, strings.TrimSpace(line))
+	}
+	ir, err := base64.StdEncoding.DecodeString(args[1])
+	if args[1] == "=" {
+		ir, err = nil, nil
+	}
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	s.authData = append(s.authData, string(ir))
+	s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PLAIN":
+		return strings.HasSuffix(string(ir), "\x00user\x00secret")
+	case "EXTERNAL":
+		return true
+	}
+	if strings.Contains(string(ir), "\x01auth=Bearer "+s.validToken+"\x01\x01") {
+		return true
+	}
+	conn.Write([]byte("+ " + base64.StdEncoding.EncodeToString([]byte(`{"status":"401"}`)) + "\r\n"))
+	r.ReadString('\n')
+	return false
+}
+
+// newTestTLSConfig generates a self-signed certificate for 127.0.0.1 and
+// returns a server-side TLS config using it.
+func newTestTLSConfig(c *C) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lemoncrypt test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// writeCAFile stores the given fake server's certificate in a PEM file and
+// returns its path.
+func writeCAFile(c *C, s *fakeIMAPServer) string {
+	path := filepath.Join(c.MkDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: s.tlsConfig.Certificates[0].Certificate[0]}
+	c.Assert(ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600), IsNil)
+	return path
+}
+
+// serverPin returns the SPKI fingerprint of the given fake server's certificate.
+func serverPin(c *C, s *fakeIMAPServer) string {
+	cert, err := x509.ParseCertificate(s.tlsConfig.Certificates[0].Certificate[0])
+	c.Assert(err, IsNil)
+	return spkiFingerprint(cert)
+}
+
+type IMAPConnectionSuite struct{}
+
+var _ = Suite(&IMAPConnectionSuite{})
+
+func (s *IMAPConnectionSuite) TestImplicitTLS(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv)})
+	c.Assert(err, IsNil)
+	c.Assert(conn.Login("user", []byte("secret")), IsNil)
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "LOGOUT+tls"})
+}
+
+func (s *IMAPConnectionSuite) TestSTARTTLS(c *C) {
+	srv := newFakeIMAPServer(c, []string{"STARTTLS"}, false)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecuritySTARTTLS,
+		CAFile: writeCAFile(c, srv)})
+	c.Assert(err, IsNil)
+	c.Assert(conn.Login("user", []byte("secret")), IsNil)
+	c.Assert(conn.Close(), IsNil)
+	cmds := srv.Commands()
+	c.Assert(cmds[0], Equals, "STARTTLS")
+	c.Assert(cmds[len(cmds)-2:], DeepEquals, []string{"LOGIN+tls", "LOGOUT+tls"})
+}
+
+func (s *IMAPConnectionSuite) TestSTARTTLSUnsupported(c *C) {
+	srv := newFakeIMAPServer(c, nil, false)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecuritySTARTTLS,
+		CAFile: writeCAFile(c, srv)})
+	c.Assert(err, ErrorMatches, ".*does not support STARTTLS.*")
+	for _, cmd := range srv.Commands() {
+		c.Assert(cmd, Not(Equals), "LOGIN")
+	}
+}
+
+func (s *IMAPConnectionSuite) TestSTARTTLSUntrustedCertificate(c *C) {
+	srv := newFakeIMAPServer(c, []string{"STARTTLS"}, false)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecuritySTARTTLS})
+	c.Assert(err, ErrorMatches, "STARTTLS failed: .*certificate verification failed: .*"+
+		"server presented sha256/"+regexp.QuoteMeta(serverPin(c, srv))+".*")
+}
+
+func (s *IMAPConnectionSuite) TestPinnedCertificate(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		TLSPinSHA256: "sha256/" + serverPin(c, srv)})
+	c.Assert(err, IsNil)
+	c.Assert(conn.Close(), IsNil)
+}
+
+func (s *IMAPConnectionSuite) TestPinMismatch(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv), TLSPinSHA256: wrongPin})
+	c.Assert(err, ErrorMatches, ".*certificate pin mismatch: server presented sha256/"+
+		regexp.QuoteMeta(serverPin(c, srv))+".*")
+}
+
+func (s *IMAPConnectionSuite) TestMinVersion(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	srv.tlsConfig.MaxVersion = tls.VersionTLS12
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv), TLSMinVersion: "1.3"})
+	c.Assert(err, NotNil)
+}
+
+func (s *IMAPConnectionSuite) TestInvalidTLSSettings(c *C) {
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: "127.0.0.1:0", TLSMinVersion: "2.0"})
+	c.Assert(err, ErrorMatches, "unsupported tls_min_version '2.0'")
+	err = conn.Dial(&ServerConfig{Address: "127.0.0.1:0", TLSPinSHA256: "abc"})
+	c.Assert(err, ErrorMatches, "tls_pin_sha256 must be .*")
+	err = conn.Dial(&ServerConfig{Address: "127.0.0.1:0", ClientCertFile: "cert.pem"})
+	c.Assert(err, ErrorMatches, "client_cert_file and client_key_file .*")
+}
+
+func (s *IMAPConnectionSuite) TestPlainRefusesLogin(c *C) {
+	srv := newFakeIMAPServer(c, nil, false)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityNone})
+	c.Assert(err, IsNil)
+	err = conn.Login("user", []byte("secret"))
+	c.Assert(err, ErrorMatches, "refusing to send credentials .*")
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGOUT"})
+}
+
+func (s *IMAPConnectionSuite) TestPlainAllowInsecureAuth(c *C) {
+	srv := newFakeIMAPServer(c, nil, false)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityNone,
+		AllowInsecureAuth: true})
+	c.Assert(err, IsNil)
+	c.Assert(conn.Login("user", []byte("secret")), IsNil)
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN", "LOGOUT"})
+}
+
+func (s *IMAPConnectionSuite) TestOAuth2(c *C) {
+	srv := newFakeIMAPServer(c, []string{"AUTH=XOAUTH2", "AUTH=OAUTHBEARER"}, true)
+	defer srv.Close()
+	for _, auth := range []string{AuthXOAuth2, AuthOAuthBearer} {
+		conn := NewIMAPConnection()
+		err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+			CAFile: writeCAFile(c, srv), Auth: auth})
+		c.Assert(err, IsNil)
+		tokens := NewOAuth2TokenSource(&OAuth2Config{TokenCommand: "echo valid"})
+		c.Assert(conn.LoginOAuth2("user", tokens), IsNil)
+		c.Assert(conn.Close(), IsNil)
+	}
+	c.Assert(srv.Commands(), DeepEquals, []string{"AUTHENTICATE+tls", "LOGOUT+tls",
+		"AUTHENTICATE+tls", "LOGOUT+tls"})
+}
+
+func (s *IMAPConnectionSuite) TestOAuth2Rejected(c *C) {
+	srv := newFakeIMAPServer(c, []string{"AUTH=XOAUTH2"}, true)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv), Auth: AuthXOAuth2})
+	c.Assert(err, IsNil)
+	tokens := NewOAuth2TokenSource(&OAuth2Config{TokenCommand: "echo expired"})
+	err = conn.LoginOAuth2("user", tokens)
+	c.Assert(err, ErrorMatches, `.*\(server reported: {"status":"401"}\)`)
+}
+
+func (s *IMAPConnectionSuite) TestPlain(c *C) {
+	srv := newFakeIMAPServer(c, []string{"AUTH=PLAIN"}, true)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv), AuthzID: "doe"})
+	c.Assert(err, IsNil)
+	mechanism, err := conn.Mechanism()
+	c.Assert(err, IsNil)
+	c.Assert(mechanism, Equals, AuthPlain)
+	c.Assert(conn.Login("user", []byte("secret")), IsNil)
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"AUTHENTICATE+tls", "LOGOUT+tls"})
+	c.Assert(srv.authData, DeepEquals, []string{"doe\x00user\x00secret"})
+}
+
+func (s *IMAPConnectionSuite) TestExternal(c *C) {
+	srv := newFakeIMAPServer(c, []string{"AUTH=EXTERNAL"}, true)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv), Auth: AuthExternal})
+	c.Assert(err, IsNil)
+	c.Assert(conn.Login("user", nil), IsNil)
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"AUTHENTICATE+tls", "LOGOUT+tls"})
+	c.Assert(srv.authData, DeepEquals, []string{""})
+}
+
+func (s *IMAPConnectionSuite) TestMechanismUnsupported(c *C) {
+	srv := newFakeIMAPServer(c, []string{"AUTH=PLAIN"}, true)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv), Auth: AuthXOAuth2})
+	c.Assert(err, IsNil)
+	err = conn.LoginOAuth2("user", NewOAuth2TokenSource(&OAuth2Config{TokenCommand: "echo valid"}))
+	c.Assert(err, ErrorMatches, "server does not support AUTH=XOAUTH2 \\(available mechanisms: PLAIN, LOGIN command\\)")
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGOUT+tls"})
+}
+
+func (s *IMAPConnectionSuite) TestLoginDisabledBeforeSTARTTLS(c *C) {
+	srv := newFakeIMAPServer(c, []string{"STARTTLS", "LOGINDISABLED"}, false)
+	defer srv.Close()
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecuritySTARTTLS,
+		CAFile: writeCAFile(c, srv)})
+	c.Assert(err, IsNil)
+	c.Assert(conn.Login("user", []byte("secret")), IsNil)
+	c.Assert(conn.Close(), IsNil)
+	cmds := srv.Commands()
+	c.Assert(cmds[0], Equals, "STARTTLS")
+	c.Assert(cmds[len(cmds)-3:], DeepEquals, []string{"CAPABILITY+tls", "LOGIN+tls", "LOGOUT+tls"})
+}
+
+func (s *IMAPConnectionSuite) TestInvalidSecurity(c *C) {
+	conn := NewIMAPConnection()
+	err := conn.Dial(&ServerConfig{Address: "127.0.0.1:0", Security: "ssl"})
+	c.Assert(err, ErrorMatches, "unsupported security mode 'ssl'.*")
+}
+
+// newReconnectTestConnection returns a connection to the given fake server
+// which has selected INBOX and retries quickly.
+func newReconnectTestConnection(c *C, srv *fakeIMAPServer) *IMAPConnection {
+	conn := NewIMAPConnection()
+	conn.retryDelay = time.Millisecond
+	err := conn.Dial(&ServerConfig{Address: srv.Address(), Security: SecurityTLS,
+		CAFile: writeCAFile(c, srv)})
+	c.Assert(err, IsNil)
+	c.Assert(conn.Login("user", []byte("secret")), IsNil)
+	c.Assert(conn.selectMailbox("INBOX", false), IsNil)
+	return conn
+}
+
+// noop is a retryable operation which sends NOOP.
+func noop(conn *IMAPConnection) func() error {
+	return func() error {
+		_, err := imap.Wait(conn.conn.Noop())
+		return err
+	}
+}
+
+func (s *IMAPConnectionSuite) TestReconnect(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := newReconnectTestConnection(c, srv)
+	srv.dropOnce("NOOP")
+	c.Assert(conn.retry("NOOP", noop(conn)), IsNil)
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(srv.Commands(), DeepEquals, []string{"LOGIN+tls", "SELECT+tls", "NOOP+tls",
+		"LOGIN+tls", "SELECT+tls", "NOOP+tls", "LOGOUT+tls"})
+}
+
+func (s *IMAPConnectionSuite) TestReconnectGivesUp(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := newReconnectTestConnection(c, srv)
+	conn.SetMaxRetries(2)
+	for i := 0; i < 3; i++ {
+		srv.dropOnce("NOOP")
+	}
+	c.Assert(conn.retry("NOOP", noop(conn)), NotNil)
+}
+
+func (s *IMAPConnectionSuite) TestReconnectUIDValidityChanged(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := newReconnectTestConnection(c, srv)
+	srv.dropOnce("NOOP")
+	srv.setUIDValidity(2)
+	c.Assert(conn.retry("NOOP", noop(conn)), Equals, ErrUIDValidityChanged)
+	// the source still compares against the uidvalidity of its UIDs
+	c.Assert(conn.uidValidity, Equals, uint32(1))
+	c.Assert(conn.conn.Mailbox.UIDValidity, Equals, uint32(2))
+}
+
+func (s *IMAPConnectionSuite) TestCloseWithoutConnection(c *C) {
+	conn := NewIMAPConnection()
+	conn.password = []byte("secret")
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(conn.password, DeepEquals, []byte{0, 0, 0, 0, 0, 0})
+}
+
+func (s *IMAPConnectionSuite) TestNoRetryOnTimeout(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := newReconnectTestConnection(c, srv)
+	defer conn.Close()
+	calls := 0
+	err := conn.retry("TEST", func() error {
+		calls++
+		return imap.ErrTimeout
+	})
+	c.Assert(err, Equals, imap.ErrTimeout)
+	c.Assert(calls, Equals, 1)
+	c.Assert(conn.isBroken(imap.ErrAborted), Equals, true)
+}
+
+func (s *IMAPConnectionSuite) TestNoRetryOnCommandError(c *C) {
+	srv := newFakeIMAPServer(c, nil, true)
+	defer srv.Close()
+	conn := newReconnectTestConnection(c, srv)
+	calls := 0
+	err := conn.retry("TEST", func() error {
+		calls++
+		return errors.New("NO failed")
+	})
+	c.Assert(err, ErrorMatches, "NO failed")
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *IMAPConnectionSuite) TestBackoffDelay(c *C) {
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		delay := backoffDelay(time.Second, attempt)
+		c.Assert(delay >= expected/2 && delay <= expected, Equals, true)
+	}
+	delay := backoffDelay(time.Second, 100)
+	c.Assert(delay >= retryMaxDelay/2 && delay <= retryMaxDelay, Equals, true)
+}
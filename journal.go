@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournalState describes how far the processing of a single source message
+// has progressed.
+type JournalState string
+
+const (
+	// JournalEncrypted means that the message has been transformed and is
+	// about to be appended to the target mailbox. It is unknown whether the
+	// append succeeded.
+	JournalEncrypted JournalState = "encrypted"
+
+	// JournalAppended means that the transformed message has been stored in
+	// the target mailbox.
+	JournalAppended JournalState = "appended"
+
+	// JournalFlagged means that the source message has been marked as
+	// deleted.
+	JournalFlagged JournalState = "flagged"
+
+	// JournalExpunged means that the source message has been removed.
+	JournalExpunged JournalState = "expunged"
+)
+
+// journalKey uniquely identifies a message on an IMAP server.
+type journalKey struct {
+	folder      string
+	uidValidity uint32
+	uid         uint32
+}
+
+// journalEntry contains the recorded progress for a single message.
+type journalEntry struct {
+	state     JournalState
+	targetUID uint32
+	messageID string
+}
+
+// Journal persistently records the progress of processing each source message
+// so that interrupted runs can be resumed without storing messages twice.
+// The journal is an append-only text file with one line per state change;
+// it is compacted whenever it is opened.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	fd      *os.File
+	entries map[journalKey]*journalEntry
+}
+
+// OpenJournal loads the journal from the given path, creating it (and its
+// parent directory) if necessary.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		entries: make(map[journalKey]*journalEntry),
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create journal directory: %s", err)
+	}
+	err = j.load()
+	if err != nil {
+		return nil, err
+	}
+	err = j.compact()
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("journal %s contains %d entries", path, len(j.entries))
+	return j, nil
+}
+
+// load reads all existing entries from the journal file.
+func (j *Journal) load() error {
+	fd, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open journal: %s", err)
+	}
+	defer fd.Close()
+	s := bufio.NewScanner(fd)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		key, entry, err := parseJournalLine(s.Text())
+		if err != nil {
+			// a crash while writing may have left a truncated last line.
+			logger.Warningf("ignoring invalid journal line %d: %s", lineNo, err)
+			continue
+		}
+		j.entries[key] = entry
+	}
+	return s.Err()
+}
+
+// compact rewrites the journal file so that it contains exactly one line
+// per message. Messages which have been expunged are dropped as their UIDs
+// will never be used again.
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+	fd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write journal: %s", err)
+	}
+	for key, entry := range j.entries {
+		if entry.state == JournalExpunged {
+			delete(j.entries, key)
+			continue
+		}
+		_, err = fd.WriteString(formatJournalLine(key, entry))
+		if err != nil {
+			fd.Close()
+			return fmt.Errorf("unable to write journal: %s", err)
+		}
+	}
+	err = fd.Sync()
+	if err != nil {
+		fd.Close()
+		return fmt.Errorf("unable to sync journal: %s", err)
+	}
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		fd.Close()
+		return fmt.Errorf("unable to replace journal: %s", err)
+	}
+	j.fd = fd
+	return nil
+}
+
+// parseJournalLine decodes a single journal line.
+func parseJournalLine(line string) (journalKey, *journalEntry, error) {
+	var key journalKey
+	fields := strings.Split(line, "\t")
+	if len(fields) != 6 {
+		return key, nil, fmt.Errorf("expected 6 fields, got %d", len(fields))
+	}
+	nums := make([]uint32, 3)
+	for idx, field := range fields[1:4] {
+		num, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return key, nil, err
+		}
+		nums[idx] = uint32(num)
+	}
+	folder, err := strconv.Unquote(fields[4])
+	if err != nil {
+		return key, nil, fmt.Errorf("invalid folder: %s", err)
+	}
+	messageID, err := strconv.Unquote(fields[5])
+	if err != nil {
+		return key, nil, fmt.Errorf("invalid message id: %s", err)
+	}
+	key = journalKey{folder: folder, uidValidity: nums[0], uid: nums[1]}
+	entry := &journalEntry{state: JournalState(fields[0]), targetUID: nums[2], messageID: messageID}
+	return key, entry, nil
+}
+
+// formatJournalLine encodes a single journal line.
+func formatJournalLine(key journalKey, entry *journalEntry) string {
+	return fmt.Sprintf("%s\t%d\t%d\t%d\t%s\t%s\n", entry.state, key.uidValidity, key.uid,
+		entry.targetUID, strconv.Quote(key.folder), strconv.Quote(entry.messageID))
+}
+
+// Record returns the journal record for the given message.
+// A nil Journal returns nil records, which silently ignore all updates.
+func (j *Journal) Record(folder string, uidValidity, uid uint32) *JournalRecord {
+	if j == nil {
+		return nil
+	}
+	return &JournalRecord{
+		journal: j,
+		key:     journalKey{folder: folder, uidValidity: uidValidity, uid: uid},
+	}
+}
+
+// UIDs returns the UIDs of all messages in the given folder which are in the
+// given state.
+func (j *Journal) UIDs(folder string, uidValidity uint32, state JournalState) []uint32 {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var uids []uint32
+	for key, entry := range j.entries {
+		if key.folder == folder && key.uidValidity == uidValidity && entry.state == state {
+			uids = append(uids, key.uid)
+		}
+	}
+	return uids
+}
+
+// UIDValidities returns all UIDVALIDITY values for which messages in the
+// given folder have been recorded.
+func (j *Journal) UIDValidities(folder string) []uint32 {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	seen := make(map[uint32]bool)
+	var uidValidities []uint32
+	for key := range j.entries {
+		if key.folder == folder && !seen[key.uidValidity] {
+			seen[key.uidValidity] = true
+			uidValidities = append(uidValidities, key.uidValidity)
+		}
+	}
+	return uidValidities
+}
+
+// update stores the given entry and appends it to the journal file.
+func (j *Journal) update(key journalKey, entry *journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries[key] = entry
+	_, err := j.fd.WriteString(formatJournalLine(key, entry))
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %s", err)
+	}
+	err = j.fd.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync journal: %s", err)
+	}
+	return nil
+}
+
+// get returns a copy of the entry for the given key.
+func (j *Journal) get(key journalKey) journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, exists := j.entries[key]
+	if !exists {
+		return journalEntry{}
+	}
+	return *entry
+}
+
+// Close closes the underlying file handle.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.fd.Close()
+}
+
+// JournalRecord provides access to the journal entry of a single message.
+type JournalRecord struct {
+	journal *Journal
+	key     journalKey
+}
+
+// State returns the recorded state or an empty string if the message is
+// unknown.
+func (r *JournalRecord) State() JournalState {
+	if r == nil {
+		return ""
+	}
+	return r.journal.get(r.key).state
+}
+
+// TargetUID returns the UID of the transformed message in the target mailbox,
+// if known.
+func (r *JournalRecord) TargetUID() uint32 {
+	if r == nil {
+		return 0
+	}
+	return r.journal.get(r.key).targetUID
+}
+
+// MessageID returns the Message-Id of the transformed message.
+func (r *JournalRecord) MessageID() string {
+	if r == nil {
+		return ""
+	}
+	return r.journal.get(r.key).messageID
+}
+
+// SetTarget records the given state along with information about the
+// transformed message.
+func (r *JournalRecord) SetTarget(state JournalState, targetUID uint32, messageID string) error {
+	if r == nil {
+		return nil
+	}
+	return r.journal.update(r.key, &journalEntry{
+		state:     state,
+		targetUID: targetUID,
+		messageID: messageID,
+	})
+}
+
+// SetState records the given state and retains the information about the
+// transformed message.
+func (r *JournalRecord) SetState(state JournalState) error {
+	if r == nil {
+		return nil
+	}
+	entry := r.journal.get(r.key)
+	entry.state = state
+	return r.journal.update(r.key, &entry)
+}
+
+// journalFileName returns the journal file name for the given account.
+func journalFileName(server *ServerConfig) string {
+	name := server.Username + "@" + server.Address + ".journal"
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// decryptJournalPath returns the path of the journal which is used when
+// restoring messages instead of the given one, e.g. foo.decrypt.journal for
+// foo.journal.
+func decryptJournalPath(path string) string {
+	return strings.TrimSuffix(path, ".journal") + ".decrypt.journal"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type JournalSuite struct{}
+
+var _ = Suite(&JournalSuite{})
+
+func (s *JournalSuite) TestPersistence(c *C) {
+	path := filepath.Join(c.MkDir(), "sub", "test.journal")
+	j, err := OpenJournal(path)
+	c.Assert(err, IsNil)
+	rec := j.Record("INBOX", 42, 1)
+	c.Assert(rec.State(), Equals, JournalState(""))
+	c.Assert(rec.SetTarget(JournalEncrypted, 0, "<lemoncrypt.1@example.org>"), IsNil)
+	c.Assert(rec.SetTarget(JournalAppended, 100, "<lemoncrypt.1@example.org>"), IsNil)
+	c.Assert(rec.SetState(JournalFlagged), IsNil)
+	c.Assert(j.Record("INBOX\t\"odd\"", 42, 2).SetTarget(JournalEncrypted, 0, ""), IsNil)
+	c.Assert(j.Close(), IsNil)
+
+	j, err = OpenJournal(path)
+	c.Assert(err, IsNil)
+	defer j.Close()
+	rec = j.Record("INBOX", 42, 1)
+	c.Assert(rec.State(), Equals, JournalFlagged)
+	c.Assert(rec.TargetUID(), Equals, uint32(100))
+	c.Assert(rec.MessageID(), Equals, "<lemoncrypt.1@example.org>")
+	c.Assert(j.Record("INBOX\t\"odd\"", 42, 2).State(), Equals, JournalEncrypted)
+	c.Assert(j.Record("INBOX", 43, 1).State(), Equals, JournalState(""))
+	c.Assert(j.UIDs("INBOX", 42, JournalFlagged), DeepEquals, []uint32{1})
+	c.Assert(j.UIDs("INBOX", 43, JournalFlagged), IsNil)
+	c.Assert(j.UIDValidities("INBOX"), DeepEquals, []uint32{42})
+	c.Assert(j.UIDValidities("Archive"), IsNil)
+}
+
+func (s *JournalSuite) TestCompaction(c *C) {
+	path := filepath.Join(c.MkDir(), "test.journal")
+	j, err := OpenJournal(path)
+	c.Assert(err, IsNil)
+	c.Assert(j.Record("INBOX", 1, 1).SetTarget(JournalAppended, 10, ""), IsNil)
+	c.Assert(j.Record("INBOX", 1, 1).SetState(JournalFlagged), IsNil)
+	c.Assert(j.Record("INBOX", 1, 1).SetState(JournalExpunged), IsNil)
+	c.Assert(j.Record("INBOX", 1, 2).SetTarget(JournalAppended, 11, ""), IsNil)
+	c.Assert(j.Close(), IsNil)
+
+	j, err = OpenJournal(path)
+	c.Assert(err, IsNil)
+	c.Assert(j.Close(), IsNil)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "appended\t1\t2\t11\t\"INBOX\"\t\"\"\n")
+}
+
+func (s *JournalSuite) TestTruncatedLine(c *C) {
+	path := filepath.Join(c.MkDir(), "test.journal")
+	content := "appended\t1\t2\t11\t\"INBOX\"\t\"\"\nflagged\t1\t2"
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0600), IsNil)
+	j, err := OpenJournal(path)
+	c.Assert(err, IsNil)
+	defer j.Close()
+	c.Assert(j.Record("INBOX", 1, 2).State(), Equals, JournalAppended)
+}
+
+func (s *JournalSuite) TestNilJournal(c *C) {
+	var j *Journal
+	rec := j.Record("INBOX", 1, 1)
+	c.Assert(rec.SetTarget(JournalAppended, 1, ""), IsNil)
+	c.Assert(rec.State(), Equals, JournalState(""))
+	c.Assert(j.Close(), IsNil)
+}
+
+func (s *JournalSuite) TestFileName(c *C) {
+	name := journalFileName(&ServerConfig{Username: "doe/x", Address: "example.org:993"})
+	c.Assert(name, Equals, "doe_x@example.org_993.journal")
+	c.Assert(strings.ContainsRune(name, os.PathSeparator), Equals, false)
+}
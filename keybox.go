@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Blob types of the GnuPG keybox format (pubring.kbx), which is used by
+// GnuPG 2.1 and later.
+const (
+	keyboxBlobHeader  = 1
+	keyboxBlobOpenPGP = 2
+)
+
+// keyboxMagic identifies keybox files; it is part of the header blob.
+var keyboxMagic = []byte("KBXf")
+
+// isKeybox returns true if the given file contents start with a keybox
+// header blob.
+func isKeybox(data []byte) bool {
+	return len(data) >= 12 && data[4] == keyboxBlobHeader && bytes.Equal(data[8:12], keyboxMagic)
+}
+
+// parseKeybox returns the OpenPGP keys contained in the given keybox file
+// contents. Each OpenPGP blob contains one key in the usual binary format
+// along with metadata (fingerprints, user id offsets, checksums), which is
+// not needed and ignored. X.509 certificates are skipped.
+func parseKeybox(data []byte) (openpgp.EntityList, error) {
+	if !isKeybox(data) {
+		return nil, errors.New("not a keybox file")
+	}
+	var keyring openpgp.EntityList
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 5 {
+			return nil, fmt.Errorf("truncated keybox blob at offset %d", offset)
+		}
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		if length < 5 || length > len(data)-offset {
+			return nil, fmt.Errorf("invalid keybox blob length %d at offset %d", length, offset)
+		}
+		blob := data[offset : offset+length]
+		offset += length
+		if blob[4] != keyboxBlobOpenPGP {
+			continue
+		}
+		if len(blob) < 16 {
+			return nil, errors.New("truncated OpenPGP keybox blob")
+		}
+		start := int(binary.BigEndian.Uint32(blob[8:]))
+		size := int(binary.BigEndian.Uint32(blob[12:]))
+		if start < 16 || size > len(blob)-start {
+			return nil, errors.New("invalid keyblock in OpenPGP keybox blob")
+		}
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(blob[start : start+size]))
+		if err != nil {
+			// keys using unsupported algorithms (e.g. ed25519) cannot be
+			// parsed, but should not prevent using the other keys
+			logger.Debugf("skipping unsupported key in keybox: %s", err)
+			continue
+		}
+		keyring = append(keyring, entities...)
+	}
+	return keyring, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// localSource contains the functionality which is shared by the sources
+// which read messages from local files.
+type localSource struct {
+	deletePlainCopies bool
+	dryRun            bool
+	minAge            time.Duration
+	jobs              int
+	spooler           *Spooler
+	stopRequested     int32
+
+	// sampleSize limits iterations to a random sample of the matching
+	// messages, see SetSampleSize. sample contains the messages selected so
+	// far out of seen matching messages.
+	sampleSize int
+	sample     []sampledMessage
+	seen       int
+}
+
+// sampledMessage is a message which has been selected for processing while
+// sampling, see localSource.submit.
+type sampledMessage struct {
+	desc     string
+	msg      imap.Literal
+	flags    imap.FlagSet
+	idate    time.Time
+	callback MessageCallback
+	remove   func() error
+}
+
+// newLocalSource returns a localSource with the given settings, see
+// NewIMAPSource.
+func newLocalSource(deletePlainCopies, dryRun bool, minAgeInDays time.Duration) localSource {
+	return localSource{
+		deletePlainCopies: deletePlainCopies,
+		dryRun:            dryRun,
+		minAge:            minAgeInDays * Day,
+	}
+}
+
+// SetJobs configures the number of messages which are transformed
+// concurrently.
+func (s *localSource) SetJobs(jobs int) {
+	s.jobs = jobs
+}
+
+// SetSampleSize limits each iteration to a random sample of at most n of
+// the matching messages. 0 disables sampling.
+func (s *localSource) SetSampleSize(n int) {
+	s.sampleSize = n
+}
+
+// SetSpooler configures the spooler which is used for buffering large
+// messages until they have been processed.
+func (s *localSource) SetSpooler(spooler *Spooler) {
+	s.spooler = spooler
+}
+
+// Stop makes the current and all further iterations finish after the
+// messages which are currently being processed.
+func (s *localSource) Stop() {
+	atomic.StoreInt32(&s.stopRequested, 1)
+}
+
+// stopped returns true if Stop has been called.
+func (s *localSource) stopped() bool {
+	return atomic.LoadInt32(&s.stopRequested) != 0
+}
+
+// Close implements the MessageSource interface. Local sources do not keep
+// any resources open between iterations.
+func (s *localSource) Close() error {
+	return nil
+}
+
+// selects returns true if the given message should be processed. If filter
+// is nil, all messages encrypted by lemoncrypt are selected.
+func (s *localSource) selects(msg imap.Literal, flags imap.FlagSet, idate time.Time,
+	filter *SearchFilter) bool {
+	headers := readHeaders(msg)
+	if filter == nil {
+		return !flags["\\Deleted"] && isEncrypted(headers)
+	}
+	return filter.Matches(flags, idate, msg.Info().Len, headers, s.minAge, time.Now())
+}
+
+// submit passes the given message to the pipeline, which invokes the
+// callback. The message is released afterwards. If the message has been
+// stored successfully and plain copies should be deleted, remove is invoked.
+// When sampling, the message is only kept if it is part of the sample so
+// far (reservoir sampling); the sample is passed to the pipeline by
+// submitSample once all messages have been seen.
+func (s *localSource) submit(pipeline *Pipeline, desc string, msg imap.Literal, flags imap.FlagSet,
+	idate time.Time, callback MessageCallback, remove func() error) {
+	if s.sampleSize > 0 {
+		s.seen++
+		m := sampledMessage{desc, msg, flags, idate, callback, remove}
+		if len(s.sample) < s.sampleSize {
+			s.sample = append(s.sample, m)
+			return
+		}
+		i := rand.Intn(s.seen)
+		if i >= s.sampleSize {
+			closeLiteral(msg)
+			return
+		}
+		closeLiteral(s.sample[i].msg)
+		s.sample[i] = m
+		return
+	}
+	s.process(pipeline, desc, msg, flags, idate, callback, remove)
+}
+
+// submitSample passes the sampled messages to the pipeline and resets the
+// sample for the next iteration. It has to be called at the end of each
+// iteration; discardSample has to be called if the iteration fails.
+func (s *localSource) submitSample(pipeline *Pipeline) {
+	if s.sampleSize > 0 && s.seen > 0 {
+		logger.Infof("processing a random sample of %d messages", len(s.sample))
+	}
+	for _, m := range s.sample {
+		if s.stopped() {
+			closeLiteral(m.msg)
+			continue
+		}
+		s.process(pipeline, m.desc, m.msg, m.flags, m.idate, m.callback, m.remove)
+	}
+	s.sample = nil
+	s.seen = 0
+}
+
+// discardSample releases the sampled messages which have not been submitted,
+// e.g. because the iteration failed.
+func (s *localSource) discardSample() {
+	for _, m := range s.sample {
+		closeLiteral(m.msg)
+	}
+	s.sample = nil
+	s.seen = 0
+}
+
+// process passes the given message to the pipeline, see submit.
+func (s *localSource) process(pipeline *Pipeline, desc string, msg imap.Literal, flags imap.FlagSet,
+	idate time.Time, callback MessageCallback, remove func() error) {
+	transform := func() MessageStoreFunc {
+		logger.Debugf("invoking message transformer for %s", desc)
+		return callback(nil, flags, &idate, msg)
+	}
+	pipeline.Submit(transform, func(err error) {
+		closeLiteral(msg)
+		if err != nil {
+			logger.Warningf("message transformation failed (%s): %s", desc, err)
+			return
+		}
+		if !s.deletePlainCopies {
+			return
+		}
+		if s.dryRun {
+			logger.Infof("dry run: not deleting %s", desc)
+			return
+		}
+		err = remove()
+		if err != nil {
+			logger.Errorf("failed to delete %s: %s", desc, err)
+		}
+	})
+}
+
+// localFolderName checks that the given folder name, which uses '/' as the
+// hierarchy separator, refers to a path below the backend's root directory
+// and returns it.
+func localFolderName(folder string) (string, error) {
+	for _, part := range strings.Split(folder, "/") {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, "\\") {
+			return "", fmt.Errorf("unsupported folder name '%s'", folder)
+		}
+	}
+	return folder, nil
+}
+
+// syncDir flushes the given directory's entries to disk, so that renamed and
+// created files survive crashes.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+// fileLiteral is an imap.Literal which is backed by a file. The file is read
+// whenever the literal is written.
+type fileLiteral struct {
+	path string
+	size int64
+}
+
+// WriteTo implements the io.WriterTo interface.
+func (l *fileLiteral) WriteTo(w io.Writer) (int64, error) {
+	fd, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	return io.Copy(w, io.LimitReader(fd, l.size))
+}
+
+// Info implements the imap.Literal interface.
+func (l *fileLiteral) Info() *imap.LiteralInfo {
+	return &imap.LiteralInfo{Len: uint32(l.size)}
+}
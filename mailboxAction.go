@@ -0,0 +1,714 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/mxk/go-imap/imap"
+	"github.com/naoina/toml"
+)
+
+// MailboxAction provides the context which is shared by all actions which
+// read from and write to the configured mailbox.
+type MailboxAction struct {
+	ctx     *cli.Context
+	cfg     *Config
+	source  MessageSource
+	target  MessageSink
+	pgp     *PGPTransformer
+	dryRun  bool
+	summary *Summary
+	journal *Journal
+	jobs    int
+	spooler *Spooler
+
+	// sourceServer and targetServer are the servers which messages are
+	// read from and written to.
+	sourceServer *ServerConfig
+	targetServer *ServerConfig
+
+	// passwords and tokenSources contain the credentials of the servers
+	// until they are cleared by clearCredentials.
+	passwords    map[*ServerConfig][]byte
+	tokenSources map[*ServerConfig]*OAuth2TokenSource
+
+	// parallelAccounts is the number of accounts which are processed
+	// concurrently.
+	parallelAccounts int
+
+	// encrypting is true for the actions which encrypt messages; they
+	// require a recovery key.
+	encrypting bool
+
+	// restoring is true for the decrypt action. The original messages may
+	// still exist in the target mailbox, so restored messages must not be
+	// looked up by their Message-Id.
+	restoring bool
+}
+
+// flagString returns the value of the given command line flag, which may be
+// one of the sub command's flags or a global flag. Global flags have to be
+// passed before the sub command name.
+func (a *MailboxAction) flagString(name string) string {
+	val := a.ctx.String(name)
+	if val == "" {
+		val = a.ctx.GlobalString(name)
+	}
+	return val
+}
+
+// flagInt returns the value of the given command line flag, which may be one
+// of the sub command's flags or a global flag (see flagString).
+func (a *MailboxAction) flagInt(name string) int {
+	val := a.ctx.Int(name)
+	if val == 0 {
+		val = a.ctx.GlobalInt(name)
+	}
+	return val
+}
+
+// flagStringSlice returns the values of the given command line flag, which
+// may be one of the sub command's flags or a global flag (see flagString).
+func (a *MailboxAction) flagStringSlice(name string) []string {
+	val := a.ctx.StringSlice(name)
+	if len(val) == 0 {
+		val = a.ctx.GlobalStringSlice(name)
+	}
+	return val
+}
+
+// loadConfig reads and parses the config file.
+// If no error occurs, the config is available in the cfg field
+// afterwards.
+func (a *MailboxAction) loadConfig() error {
+	a.dryRun = a.ctx.Bool("dry-run") || a.ctx.GlobalBool("dry-run")
+	if a.dryRun {
+		logger.Infof("dry run: the mailbox will not be modified")
+	}
+
+	a.jobs = a.flagInt("jobs")
+	if a.jobs < 1 {
+		a.jobs = 1
+	}
+	a.parallelAccounts = a.flagInt("parallel-accounts")
+	if a.parallelAccounts < 1 {
+		a.parallelAccounts = 1
+	}
+
+	path := a.flagString("config")
+	if path == "" {
+		path = "lemoncrypt.cfg"
+	}
+
+	logger.Debugf("trying to load config file %s", path)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Errorf("failed to read config file: %s", err)
+		return err
+	}
+
+	a.cfg = &Config{}
+	err = toml.Unmarshal(content, a.cfg)
+	if err != nil {
+		logger.Errorf("unable to parse config file: %s", err)
+		return err
+	}
+
+	logger.Debugf("config loaded successfully")
+	return nil
+}
+
+// accounts returns one MailboxAction per account selected using the
+// --account command line flag (or all accounts), each with a validated
+// config.
+func (a *MailboxAction) accounts() ([]*MailboxAction, error) {
+	configs, err := a.cfg.AccountConfigs(a.flagStringSlice("account"))
+	if err != nil {
+		logger.Errorf("invalid account configuration: %s", err)
+		return nil, err
+	}
+	journals := make(map[string]string)
+	var accounts []*MailboxAction
+	for _, cfg := range configs {
+		account := &MailboxAction{
+			ctx:        a.ctx,
+			cfg:        cfg,
+			dryRun:     a.dryRun,
+			jobs:       a.jobs,
+			encrypting: a.encrypting,
+			restoring:  a.restoring,
+		}
+		if a.dryRun {
+			account.summary = NewSummary()
+		}
+		err = account.validateConfig()
+		if err != nil {
+			if cfg.AccountName() != "" {
+				err = fmt.Errorf("account %s: %s", cfg.AccountName(), err)
+			}
+			logger.Errorf("config validation failed: %s", err)
+			return nil, err
+		}
+		path := cfg.Mailbox.JournalPath
+		if other, exists := journals[path]; exists && path != "" {
+			err = fmt.Errorf("accounts %s and %s use the same journal %s", other, cfg.AccountName(), path)
+			logger.Errorf("config validation failed: %s", err)
+			return nil, err
+		}
+		journals[path] = cfg.AccountName()
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// runAccounts invokes run for each of the given accounts, processing up to
+// parallel accounts concurrently, and prints the dry-run summaries
+// afterwards. An error is returned if any of the accounts failed; the
+// remaining accounts are processed anyway.
+func (a *MailboxAction) runAccounts(accounts []*MailboxAction, parallel int,
+	run func(account *MailboxAction) error) error {
+	var failed error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallel)
+	for _, account := range accounts {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(account *MailboxAction) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			name := account.cfg.AccountName()
+			if name != "" {
+				logger.Infof("working on account=%s", name)
+			}
+			err := run(account)
+			if err == nil {
+				return
+			}
+			if name != "" {
+				logger.Errorf("processing account=%s failed: %s", name, err)
+			}
+			mu.Lock()
+			failed = err
+			mu.Unlock()
+		}(account)
+	}
+	wg.Wait()
+	for _, account := range accounts {
+		account.printSummary(os.Stdout)
+	}
+	return failed
+}
+
+// validateConfig performs basic upfront sanity checks on certain config values and
+// returns an error on failure.
+func (a *MailboxAction) validateConfig() error {
+	if len(a.cfg.Mailbox.Folders) < 1 {
+		return errors.New("no folders configured (mailbox.folders)")
+	}
+	a.sourceServer = a.cfg.SourceServer()
+	a.targetServer = a.cfg.TargetServer()
+	err := validateServer(a.sourceServer)
+	if err != nil {
+		return fmt.Errorf("invalid source server: %s", err)
+	}
+	if a.targetServer != a.sourceServer {
+		err = validateServer(a.targetServer)
+		if err != nil {
+			return fmt.Errorf("invalid target server: %s", err)
+		}
+	}
+	if a.restoring {
+		// the encrypted messages are read from the target server and
+		// restored to the source server
+		a.sourceServer, a.targetServer = a.targetServer, a.sourceServer
+	}
+	err = validateExpungeFallback(a.cfg.Mailbox.ExpungeFallback)
+	if err != nil {
+		return err
+	}
+	err = a.cfg.Mailbox.Filter.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid mailbox.filter: %s", err)
+	}
+	for folder, filter := range a.cfg.Mailbox.FolderFilters {
+		if _, exists := a.cfg.Mailbox.Folders[folder]; !exists {
+			return fmt.Errorf("filter configured for unknown folder %s", folder)
+		}
+		err = filter.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid mailbox.folder_filters for %s: %s", folder, err)
+		}
+	}
+	if a.cfg.Mailbox.BatchSize < 0 || a.cfg.Mailbox.BatchSizeMB < 0 {
+		return errors.New("mailbox.batch_size and mailbox.batch_size_mb must not be negative")
+	}
+	if a.cfg.Mailbox.BatchSize == 0 {
+		a.cfg.Mailbox.BatchSize = DefaultBatchSize
+	}
+	if a.cfg.Mailbox.BatchSizeMB == 0 {
+		a.cfg.Mailbox.BatchSizeMB = DefaultBatchSizeMB
+	}
+	if a.cfg.Spool.ThresholdMB < 0 {
+		return errors.New("spool.threshold_mb must not be negative")
+	}
+	if a.cfg.Spool.ThresholdMB == 0 {
+		a.cfg.Spool.ThresholdMB = DefaultSpoolThresholdMB
+	}
+	if a.cfg.PGP.GPGAgent {
+		// the public keys of GnuPG 2.1 and later are kept in a keybox
+		if a.cfg.PGP.EncryptionKeyPath == "" {
+			a.cfg.PGP.EncryptionKeyPath = filepath.Join(a.cfg.PGP.gnupgHome(), "pubring.kbx")
+		}
+		if a.cfg.PGP.SigningKeyPath == "" {
+			a.cfg.PGP.SigningKeyPath = a.cfg.PGP.EncryptionKeyPath
+		}
+	}
+	if a.cfg.PGP.EncryptionKeyPath == "" {
+		return errors.New("missing encryption key path")
+	}
+	if a.encrypting && a.cfg.PGP.RecoveryKey == "" {
+		return errors.New("missing pgp.recovery_key, every message has to be encrypted to a recovery key")
+	}
+	if a.cfg.PGP.EncryptionKeyID != "" && len(a.cfg.PGP.EncryptionKeyIDs) > 0 {
+		return errors.New("pgp.encryption_key_id and pgp.encryption_key_ids must not be used together")
+	}
+	for folder, ids := range a.cfg.PGP.FolderEncryptionKeyIDs {
+		if _, exists := a.cfg.Mailbox.Folders[folder]; !exists {
+			return fmt.Errorf("encryption keys configured for unknown folder %s", folder)
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("empty pgp.folder_encryption_key_ids for %s", folder)
+		}
+	}
+	if len(a.cfg.PGP.PlainHeaders) == 0 {
+		a.cfg.PGP.PlainHeaders = []string{
+			"From", "To", "Cc", "Bcc", "Date", "Subject"}
+	}
+
+	if a.cfg.Mailbox.JournalPath == "" && !isLocalBackend(a.sourceServer.Type) {
+		a.cfg.Mailbox.JournalPath = "~/.lemoncrypt/" + journalFileName(a.sourceServer)
+	}
+	if a.restoring && a.cfg.Mailbox.JournalPath != "" {
+		// the records of the encrypt action must not be taken for the
+		// progress of restoring the messages
+		a.cfg.Mailbox.JournalPath = decryptJournalPath(a.cfg.Mailbox.JournalPath)
+	}
+	a.cfg.Mailbox.JournalPath = expandTilde(a.cfg.Mailbox.JournalPath)
+	a.cfg.Spool.Dir = expandTilde(a.cfg.Spool.Dir)
+	a.cfg.PGP.EncryptionKeyPath = expandTilde(a.cfg.PGP.EncryptionKeyPath)
+	a.cfg.PGP.SigningKeyPath = expandTilde(a.cfg.PGP.SigningKeyPath)
+	if a.cfg.PGP.RecoveryKeyPath == "" {
+		a.cfg.PGP.RecoveryKeyPath = a.cfg.PGP.EncryptionKeyPath
+	}
+	a.cfg.PGP.RecoveryKeyPath = expandTilde(a.cfg.PGP.RecoveryKeyPath)
+	a.cfg.PGP.accountRecoveryKeyPath = expandTilde(a.cfg.PGP.accountRecoveryKeyPath)
+	err = a.cfg.PGP.EncryptionKeyPassphraseSecret().Validate()
+	if err != nil {
+		return fmt.Errorf("invalid encryption key passphrase: %s", err)
+	}
+	err = a.cfg.PGP.SigningKeyPassphraseSecret().Validate()
+	if err != nil {
+		return fmt.Errorf("invalid signing key passphrase: %s", err)
+	}
+	err = a.cfg.PGP.RecoveryKeyPassphraseSecret().Validate()
+	if err != nil {
+		return fmt.Errorf("invalid recovery key passphrase: %s", err)
+	}
+	return nil
+}
+
+// validateServer checks the given server settings and applies the defaults.
+func validateServer(server *ServerConfig) error {
+	err := validateBackend(server.Type)
+	if err != nil {
+		return err
+	}
+	if isLocalBackend(server.Type) {
+		if server.Path == "" {
+			return errors.New("missing path")
+		}
+		server.Path = expandTilde(server.Path)
+		return nil
+	}
+	if server.Address == "" {
+		return errors.New("missing address")
+	}
+	err = validateSecurity(server.Security)
+	if err != nil {
+		return err
+	}
+	if server.MaxRetries == 0 {
+		server.MaxRetries = DefaultMaxRetries
+	}
+	if server.MaxRetries < 0 {
+		// explicitly disabled
+		server.MaxRetries = 0
+	}
+	err = validateAuth(server.Auth)
+	if err != nil {
+		return err
+	}
+	if server.AuthzID != "" && server.Auth != "" && server.Auth != AuthPlain && server.Auth != AuthExternal {
+		return fmt.Errorf("authzid is not supported by auth mechanism %s", server.Auth)
+	}
+	if server.Auth == AuthExternal && server.ClientCertFile == "" {
+		return errors.New("auth mechanism external requires client_cert_file")
+	}
+	if isOAuth2(server.Auth) {
+		err = server.OAuth2.Validate()
+	} else {
+		err = server.PasswordSecret().Validate()
+	}
+	if err != nil {
+		return fmt.Errorf("invalid credentials: %s", err)
+	}
+	server.CAFile = expandTilde(server.CAFile)
+	server.ClientCertFile = expandTilde(server.ClientCertFile)
+	server.ClientKeyFile = expandTilde(server.ClientKeyFile)
+	return nil
+}
+
+// setupSource initializes the spooler and the source backend.
+func (a *MailboxAction) setupSource() error {
+	a.spooler = NewSpooler(a.cfg.Spool.ThresholdMB*1024*1024, a.cfg.Spool.Dir)
+	switch a.sourceServer.Type {
+	case BackendMaildir:
+		source := NewMaildirSource(a.sourceServer.Path, a.cfg.Mailbox.DeletePlainCopies, a.dryRun,
+			a.cfg.Mailbox.MinAgeInDays)
+		source.SetJobs(a.jobs)
+		source.SetSpooler(a.spooler)
+		a.source = source
+		return nil
+	case BackendMbox:
+		source := NewMboxSource(a.sourceServer.Path, a.cfg.Mailbox.DeletePlainCopies, a.dryRun,
+			a.cfg.Mailbox.MinAgeInDays)
+		source.SetJobs(a.jobs)
+		source.SetSpooler(a.spooler)
+		a.source = source
+		return nil
+	}
+	source := NewIMAPSource(a.cfg.Mailbox.DeletePlainCopies, a.dryRun,
+		a.cfg.Mailbox.ExpungeFallback, a.cfg.Mailbox.MinAgeInDays)
+	source.SetJobs(a.jobs)
+	source.SetMaxRetries(a.sourceServer.MaxRetries)
+	source.SetBatchLimits(a.cfg.Mailbox.BatchSize, a.cfg.Mailbox.BatchSizeMB*1024*1024)
+	source.SetSpooler(a.spooler)
+	a.source = source
+	err := source.Dial(a.sourceServer)
+	if err != nil {
+		return err
+	}
+	return a.login(source.IMAPConnection, a.sourceServer)
+}
+
+// login authenticates the given connection with the given server using the
+// configured or best available mechanism. Only the credentials which are
+// needed for that mechanism are resolved.
+func (a *MailboxAction) login(conn *IMAPConnection, server *ServerConfig) error {
+	mechanism, err := conn.Mechanism()
+	if err != nil {
+		logger.Errorf("login failed: %s", err)
+		return err
+	}
+	switch mechanism {
+	case AuthXOAuth2, AuthOAuthBearer:
+		return conn.LoginOAuth2(server.Username, a.tokenSource(server))
+	case AuthExternal:
+		return conn.Login(server.Username, nil)
+	}
+	password, err := a.password(server)
+	if err != nil {
+		return err
+	}
+	return conn.Login(server.Username, password)
+}
+
+// tokenSource returns the OAuth2 token source of the given server, which is
+// shared by all connections to it.
+func (a *MailboxAction) tokenSource(server *ServerConfig) *OAuth2TokenSource {
+	if tokens, exists := a.tokenSources[server]; exists {
+		return tokens
+	}
+	if a.tokenSources == nil {
+		a.tokenSources = make(map[*ServerConfig]*OAuth2TokenSource)
+	}
+	tokens := NewOAuth2TokenSource(&server.OAuth2)
+	a.tokenSources[server] = tokens
+	return tokens
+}
+
+// password returns the password of the given server. It is resolved on the
+// first call and kept until clearCredentials is called, as further
+// connections may have to be established using the same credentials.
+func (a *MailboxAction) password(server *ServerConfig) ([]byte, error) {
+	if password, exists := a.passwords[server]; exists {
+		return password, nil
+	}
+	password, err := server.PasswordSecret().Resolve(
+		fmt.Sprintf("Password for %s at %s", server.Username, server.Address))
+	if err != nil {
+		logger.Errorf("failed to get password: %s", err)
+		return nil, err
+	}
+	if a.passwords == nil {
+		a.passwords = make(map[*ServerConfig][]byte)
+	}
+	a.passwords[server] = password
+	return password, nil
+}
+
+// clearCredentials overwrites all resolved passwords and access tokens in
+// memory.
+func (a *MailboxAction) clearCredentials() {
+	for server, password := range a.passwords {
+		zeroBytes(password)
+		delete(a.passwords, server)
+	}
+	for server, tokens := range a.tokenSources {
+		tokens.Clear()
+		delete(a.tokenSources, server)
+	}
+}
+
+// setupJournal opens the progress journal and attaches it to the source.
+// No journal is used in dry-run mode as nothing is modified. Local sources do
+// not use a journal either, as their messages have no UIDs.
+func (a *MailboxAction) setupJournal() error {
+	source, ok := a.source.(*IMAPSource)
+	if a.dryRun || !ok {
+		return nil
+	}
+	logger.Debugf("opening journal %s", a.cfg.Mailbox.JournalPath)
+	var err error
+	a.journal, err = OpenJournal(a.cfg.Mailbox.JournalPath)
+	if err != nil {
+		logger.Errorf("failed to open journal: %s", err)
+		return err
+	}
+	source.SetJournal(a.journal)
+	return nil
+}
+
+// closeJournal closes the progress journal.
+func (a *MailboxAction) closeJournal() error {
+	return a.journal.Close()
+}
+
+// setupTarget initializes the target backend.
+// In dry-run mode, nothing is set up as nothing will be written.
+func (a *MailboxAction) setupTarget() error {
+	if a.dryRun {
+		return nil
+	}
+	switch a.targetServer.Type {
+	case BackendMaildir:
+		a.target = NewMaildirSink(a.targetServer.Path)
+		return nil
+	case BackendMbox:
+		a.target = NewMboxSink(a.targetServer.Path)
+		return nil
+	}
+	target := NewIMAPTarget()
+	target.SetMaxRetries(a.targetServer.MaxRetries)
+	a.target = target
+	err := target.Dial(a.targetServer)
+	if err != nil {
+		return err
+	}
+	return a.login(target.IMAPConnection, a.targetServer)
+}
+
+// setupPGP initializes the PGP message converter. The ephemeral
+// verification key is only generated if messages are going to be encrypted.
+func (a *MailboxAction) setupPGP() error {
+	a.pgp = NewPGPTransformer(a.cfg.PGP.PlainHeaders)
+	a.pgp.SetSpooler(a.spooler)
+	agent, err := a.gpgAgent()
+	if err != nil {
+		return err
+	}
+	a.pgp.SetAgent(agent)
+	if a.encrypting && a.cfg.PGP.EphemeralVerification {
+		err = a.pgp.GenerateEphemeralKey()
+		if err != nil {
+			logger.Errorf("failed to generate ephemeral verification key: %s", err)
+			return err
+		}
+	}
+	ids := a.cfg.AllEncryptionKeyIDs()
+	// private keys for the round-trip verification are usually found in the
+	// secret keyring, which is also used for signing
+	privatePaths := []string{}
+	if a.cfg.PGP.SigningKeyPath != "" && a.cfg.PGP.SigningKeyPath != a.cfg.PGP.EncryptionKeyPath {
+		privatePaths = append(privatePaths, a.cfg.PGP.SigningKeyPath)
+	}
+	err = a.pgp.LoadEncryptionKeys(a.cfg.PGP.EncryptionKeyPath, ids, privatePaths,
+		func() ([]byte, error) {
+			return a.cfg.PGP.EncryptionKeyPassphraseSecret().Resolve(
+				"Passphrase for encryption keys " + strings.Join(ids, ", "))
+		})
+	if err != nil {
+		logger.Errorf("failed to load encryption keys: %s", err)
+		return err
+	}
+
+	if a.encrypting {
+		err = a.pgp.LoadRecoveryKey(a.cfg.PGP.RecoveryKeyPath, a.cfg.PGP.RecoveryKey)
+		if err != nil {
+			logger.Errorf("failed to load recovery key: %s", err)
+			return err
+		}
+	}
+	if a.encrypting && a.cfg.PGP.accountRecoveryKey != "" {
+		err = a.pgp.LoadRecoveryKey(a.cfg.PGP.accountRecoveryKeyPath, a.cfg.PGP.accountRecoveryKey)
+		if err != nil {
+			logger.Errorf("failed to load account recovery key: %s", err)
+			return err
+		}
+	}
+
+	err = a.pgp.LoadSigningKey(a.cfg.PGP.SigningKeyPath, a.cfg.PGP.SigningKeyID,
+		func() ([]byte, error) {
+			return a.cfg.PGP.SigningKeyPassphraseSecret().Resolve(
+				"Passphrase for signing key " + a.cfg.PGP.SigningKeyID)
+		})
+	if err != nil {
+		logger.Errorf("failed to load signing key: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// gpgAgent returns the gpg-agent to be used for private keys or nil if
+// using the agent has not been enabled.
+func (a *MailboxAction) gpgAgent() (*GPGAgent, error) {
+	if !a.cfg.PGP.GPGAgent {
+		return nil, nil
+	}
+	agent, err := NewGPGAgent(a.cfg.PGP.gnupgHome())
+	if err != nil {
+		logger.Errorf("%s", err)
+		return nil, err
+	}
+	return agent, nil
+}
+
+// closeSource cleans up the source backend.
+func (a *MailboxAction) closeSource() error {
+	return a.source.Close()
+}
+
+// closeTarget cleans up the target backend.
+func (a *MailboxAction) closeTarget() error {
+	if a.target == nil {
+		return nil
+	}
+	return a.target.Close()
+}
+
+// selectTarget selects the given target mailbox unless running in dry-run
+// mode.
+func (a *MailboxAction) selectTarget(mailbox string) error {
+	if a.dryRun {
+		return nil
+	}
+	err := a.target.SelectMailbox(mailbox)
+	if err != nil {
+		logger.Errorf("failed to select mailbox %s", mailbox)
+	}
+	return err
+}
+
+// reconcile checks whether a message, whose journal record says that it was
+// about to be appended when the previous run was interrupted, has actually
+// been stored completely in the current target mailbox. msg is the message
+// which would be stored now; a message found by its Message-Id has to be
+// confirmed against it like in store, as the interrupted append may have
+// stored it partially. If so, the record is updated and true is returned.
+func (a *MailboxAction) reconcile(rec *JournalRecord, msg imap.Literal) (bool, error) {
+	if rec.State() != JournalEncrypted {
+		return false, nil
+	}
+	msgID := rec.MessageID()
+	if a.restoring {
+		// a message with the same Message-Id may be the original one
+		logger.Infof("unable to reconcile interrupted restore of message-id=%s, restoring it again", msgID)
+		return false, nil
+	}
+	if msg == nil {
+		return false, nil
+	}
+	logger.Infof("reconciling interrupted append of message-id=%s", msgID)
+	uid, err := a.target.FindMessageID(msgID)
+	if err != nil {
+		logger.Warningf("unable to reconcile message, processing it again: %s", err)
+		return false, nil
+	}
+	if uid == 0 {
+		logger.Infof("message has not been stored yet, processing it again")
+		return false, nil
+	}
+	uid, err = a.target.ConfirmStored(uid, msgID, msg)
+	if err != nil {
+		logger.Warningf("found message has not been stored completely, processing it again: %s", err)
+		return false, nil
+	}
+	logger.Infof("message has already been stored with uid=%d", uid)
+	return true, rec.SetTarget(JournalAppended, uid, msgID)
+}
+
+// store appends the given transformed message to the target mailbox and
+// records the progress in the journal.
+// If the source message is going to be deleted, the stored message is looked
+// up again first, so that an error is returned (and the source message is
+// kept) unless there is proof that the message has actually been stored.
+// When restoring, the message is only confirmed by the UID reported by the
+// target, as a lookup by Message-Id could find the original message.
+func (a *MailboxAction) store(rec *JournalRecord, flags imap.FlagSet, idate *time.Time,
+	msg imap.Literal, msgID string) error {
+	err := rec.SetTarget(JournalEncrypted, 0, msgID)
+	if err != nil {
+		return err
+	}
+	lookupID := msgID
+	if a.restoring {
+		lookupID = ""
+	}
+	uid, err := a.target.Append(flags, idate, msg, lookupID)
+	if err != nil {
+		return err
+	}
+	if a.cfg.Mailbox.DeletePlainCopies {
+		uid, err = a.target.ConfirmStored(uid, lookupID, msg)
+		if err != nil {
+			logger.Errorf("not deleting source message: %s", err)
+			return err
+		}
+	}
+	return rec.SetTarget(JournalAppended, uid, msgID)
+}
+
+// printSummary writes the statistics which have been collected during a
+// dry run to the given writer.
+func (a *MailboxAction) printSummary(w io.Writer) {
+	if a.summary == nil {
+		return
+	}
+	if name := a.cfg.AccountName(); name != "" {
+		fmt.Fprintf(w, "\naccount %s:\n", name)
+	}
+	err := a.summary.Print(w)
+	if err != nil {
+		logger.Warningf("failed to print summary: %s", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type MailboxActionSuite struct{}
+
+var _ = Suite(&MailboxActionSuite{})
+
+func (s *MailboxActionSuite) TestReconcile(c *C) {
+	// the interrupted append stored only part of the message
+	sink := &fakeSink{existing: map[string]uint32{"<1@example.org>": 7}, incomplete: map[uint32]bool{7: true}}
+	a := &MailboxAction{target: sink, encrypting: true}
+	j, err := OpenJournal(filepath.Join(c.MkDir(), "test.journal"))
+	c.Assert(err, IsNil)
+	rec := j.Record("INBOX", 1, 5)
+	c.Assert(rec.SetTarget(JournalEncrypted, 0, "<1@example.org>"), IsNil)
+	msg := imap.NewLiteral([]byte("encrypted body"))
+
+	stored, err := a.reconcile(rec, msg)
+	c.Assert(err, IsNil)
+	c.Assert(stored, Equals, false)
+	c.Assert(sink.calls, DeepEquals, []string{"FindMessageID <1@example.org>", "ConfirmStored 7 <1@example.org>"})
+	c.Assert(rec.State(), Equals, JournalEncrypted)
+
+	// the message cannot be confirmed if it could not be transformed again
+	sink.calls = nil
+	stored, err = a.reconcile(rec, nil)
+	c.Assert(err, IsNil)
+	c.Assert(stored, Equals, false)
+	c.Assert(sink.calls, HasLen, 0)
+
+	delete(sink.incomplete, 7)
+	stored, err = a.reconcile(rec, msg)
+	c.Assert(err, IsNil)
+	c.Assert(stored, Equals, true)
+	c.Assert(rec.State(), Equals, JournalAppended)
+	c.Assert(rec.TargetUID(), Equals, uint32(7))
+}
+
+// testTargetConfig moves messages from one server to another.
+const testTargetConfig = `
+[server]
+address = "old.example.org:993"
+username = "doe"
+[target]
+address = "new.example.org:993"
+username = "doe"
+[mailbox]
+folders = {"INBOX" = ""}
+[pgp]
+encryption_key_path = "/global/pubring.gpg"
+recovery_key = "DEADBEEF"
+`
+
+func (s *MailboxActionSuite) TestJournalPaths(c *C) {
+	// by default, each action's journal is named after the server it reads
+	// from; decrypting reads the encrypted messages from the target server
+	encrypt := &MailboxAction{cfg: parseConfig(c, testTargetConfig), encrypting: true}
+	c.Assert(encrypt.validateConfig(), IsNil)
+	c.Assert(strings.HasSuffix(encrypt.cfg.Mailbox.JournalPath, "/.lemoncrypt/doe@old.example.org_993.journal"),
+		Equals, true)
+	decrypt := &MailboxAction{cfg: parseConfig(c, testTargetConfig), restoring: true}
+	c.Assert(decrypt.validateConfig(), IsNil)
+	c.Assert(decrypt.sourceServer.Address, Equals, "new.example.org:993")
+	c.Assert(decrypt.targetServer.Address, Equals, "old.example.org:993")
+	c.Assert(strings.HasSuffix(decrypt.cfg.Mailbox.JournalPath,
+		"/.lemoncrypt/doe@new.example.org_993.decrypt.journal"), Equals, true)
+}
+
+func (s *MailboxActionSuite) TestSharedJournalDir(c *C) {
+	// encrypting and decrypting with the same journal_path do not see each
+	// other's progress
+	path := filepath.Join(c.MkDir(), "doe.journal")
+	config := strings.Replace(testTargetConfig, "[mailbox]\n", "[mailbox]\njournal_path = \""+path+"\"\n", 1)
+	encrypt := &MailboxAction{cfg: parseConfig(c, config), encrypting: true}
+	c.Assert(encrypt.validateConfig(), IsNil)
+	decrypt := &MailboxAction{cfg: parseConfig(c, config), restoring: true}
+	c.Assert(decrypt.validateConfig(), IsNil)
+	c.Assert(encrypt.cfg.Mailbox.JournalPath, Equals, path)
+	c.Assert(decrypt.cfg.Mailbox.JournalPath, Equals, strings.TrimSuffix(path, ".journal")+".decrypt.journal")
+
+	encJournal, err := OpenJournal(encrypt.cfg.Mailbox.JournalPath)
+	c.Assert(err, IsNil)
+	defer encJournal.Close()
+	c.Assert(encJournal.Record("INBOX", 1, 5).SetTarget(JournalAppended, 7, "<1@example.org>"), IsNil)
+	decJournal, err := OpenJournal(decrypt.cfg.Mailbox.JournalPath)
+	c.Assert(err, IsNil)
+	defer decJournal.Close()
+	c.Assert(decJournal.Record("INBOX", 1, 5).State(), Not(Equals), JournalAppended)
+	c.Assert(decJournal.UIDs("INBOX", 1, JournalAppended), HasLen, 0)
+}
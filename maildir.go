@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// maildirFlags maps the Maildir info flags to IMAP flags. The letters are
+// sorted in ASCII order as required by the Maildir specification.
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', "\\Draft"},
+	{'F', "\\Flagged"},
+	{'P', "$Forwarded"},
+	{'R', "\\Answered"},
+	{'S', "\\Seen"},
+	{'T', "\\Deleted"},
+}
+
+// maildirCounter makes the names of new files unique within this process.
+var maildirCounter uint32
+
+// maildirPath returns the directory of the given folder in a Maildir++ tree:
+// INBOX is the root directory itself, all other folders are directories
+// below the root directory named after the folder with a leading dot and '.'
+// as the hierarchy separator. An "INBOX." prefix is ignored, i.e.
+// "INBOX.Archive/2015" and "Archive.2015" both map to ".Archive.2015".
+func maildirPath(root, folder string) (string, error) {
+	if strings.EqualFold(folder, "INBOX") {
+		return root, nil
+	}
+	if len(folder) > 6 && strings.EqualFold(folder[:6], "INBOX.") {
+		folder = folder[6:]
+	}
+	name, err := localFolderName(strings.Replace(folder, ".", "/", -1))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, "."+strings.Replace(name, "/", ".", -1)), nil
+}
+
+// parseMaildirFlags returns the IMAP flags encoded in the info part of the
+// given Maildir file name.
+func parseMaildirFlags(name string) imap.FlagSet {
+	flags := make(imap.FlagSet)
+	idx := strings.LastIndex(name, ":2,")
+	if idx < 0 {
+		return flags
+	}
+	for _, letter := range []byte(name[idx+3:]) {
+		for _, f := range maildirFlags {
+			if f.letter == letter {
+				flags[f.flag] = true
+			}
+		}
+	}
+	return flags
+}
+
+// maildirInfo returns the info part of a Maildir file name which encodes
+// the given IMAP flags. Flags which cannot be represented are logged and
+// dropped.
+func maildirInfo(flags imap.FlagSet) string {
+	info := ":2,"
+	for _, f := range maildirFlags {
+		if flags[f.flag] {
+			info += string(f.letter)
+		}
+	}
+	for flag := range flags {
+		supported := flag == "\\Recent"
+		for _, f := range maildirFlags {
+			supported = supported || f.flag == flag
+		}
+		if !supported {
+			logger.Warningf("maildir does not support flag %s, dropping it", flag)
+		}
+	}
+	return info
+}
+
+// maildirUniqueName returns a new unique name for a Maildir file.
+func maildirUniqueName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint32(&maildirCounter, 1), host)
+}
+
+// listMaildir returns the paths of all messages in the given Maildir
+// directory, sorted by name (i.e. by delivery time for most MDAs).
+func listMaildir(dir string) ([]string, error) {
+	var paths []string
+	for _, sub := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+				paths = append(paths, filepath.Join(dir, sub, fi.Name()))
+			}
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+	return paths, nil
+}
+
+// findMaildirMessageID returns the path of a message with the given
+// Message-Id in the given Maildir directory or an empty string.
+func findMaildirMessageID(dir, msgID string) (string, error) {
+	paths, err := listMaildir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if readHeaders(&fileLiteral{path: path, size: fi.Size()}).Get("Message-Id") == msgID {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+// MaildirSource provides support for traversing the mails of a local
+// Maildir++ directory tree. The file modification time is used as the
+// internal date.
+type MaildirSource struct {
+	localSource
+	root string
+}
+
+// NewMaildirSource returns a new MaildirSource instance for the Maildir++
+// tree in the given root directory. See NewIMAPSource for the other
+// parameters.
+func NewMaildirSource(root string, deletePlainCopies, dryRun bool,
+	minAgeInDays time.Duration) *MaildirSource {
+	return &MaildirSource{
+		localSource: newLocalSource(deletePlainCopies, dryRun, minAgeInDays),
+		root:        root,
+	}
+}
+
+// Iterate loops through the given folder, selects all messages which match
+// the given filter and are older than the configured minimum age and invokes
+// the callback for each message.
+func (s *MaildirSource) Iterate(folder string, filter *SearchFilter, callbackFunc MessageCallback) error {
+	return s.iterate(folder, filter, callbackFunc)
+}
+
+// IterateEncrypted loops through the given folder and invokes the callback
+// for each message which has been encrypted by lemoncrypt.
+func (s *MaildirSource) IterateEncrypted(folder string, callbackFunc MessageCallback) error {
+	return s.iterate(folder, nil, callbackFunc)
+}
+
+// iterate invokes the callback for all messages in the given folder which
+// are selected by the given filter, see localSource.selects.
+func (s *MaildirSource) iterate(folder string, filter *SearchFilter, callbackFunc MessageCallback) error {
+	dir, err := maildirPath(s.root, folder)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("reading maildir %s", dir)
+	paths, err := listMaildir(dir)
+	if err != nil {
+		logger.Errorf("failed to read maildir: %s", err)
+		return err
+	}
+	pipeline := NewPipeline(s.jobs)
+	defer s.discardSample()
+	defer pipeline.Close()
+	matching := 0
+	for _, path := range paths {
+		if s.stopped() {
+			logger.Infof("stop requested, skipping the remaining messages")
+			break
+		}
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// moved by another client in the meantime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msg := &fileLiteral{path: path, size: fi.Size()}
+		flags := parseMaildirFlags(fi.Name())
+		if !s.selects(msg, flags, fi.ModTime(), filter) {
+			continue
+		}
+		matching++
+		s.submit(pipeline, "file "+fi.Name(), msg, flags, fi.ModTime(), callbackFunc, func() error {
+			return os.Remove(path)
+		})
+	}
+	logger.Infof("found %d matching messages", matching)
+	s.submitSample(pipeline)
+	return nil
+}
+
+// MaildirSink provides support for writing mails to a local Maildir++
+// directory tree. The internal date is stored as the file modification time.
+type MaildirSink struct {
+	root     string
+	dir      string
+	lastPath string
+}
+
+// NewMaildirSink returns a new MaildirSink instance for the Maildir++ tree
+// in the given root directory.
+func NewMaildirSink(root string) *MaildirSink {
+	return &MaildirSink{root: root}
+}
+
+// SelectMailbox makes the given folder the one further messages are
+// appended to. It is created if necessary.
+func (s *MaildirSink) SelectMailbox(mailbox string) error {
+	dir, err := maildirPath(s.root, mailbox)
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		err = os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			logger.Errorf("unable to create maildir '%s': %s", dir, err)
+			return err
+		}
+	}
+	s.dir = dir
+	return nil
+}
+
+// Append stores the given message in the current folder. The message is
+// written to tmp/ and moved to cur/ once it is complete. Maildirs have no
+// UIDs, so 0 is returned.
+func (s *MaildirSink) Append(flags imap.FlagSet, idate *time.Time, msg imap.Literal,
+	msgID string) (uint32, error) {
+	name := maildirUniqueName()
+	tmpPath := filepath.Join(s.dir, "tmp", name)
+	logger.Debugf("writing mail to %s", tmpPath)
+	fd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create message file: %s", err)
+	}
+	_, err = msg.WriteTo(fd)
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && idate != nil {
+		err = os.Chtimes(tmpPath, *idate, *idate)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("unable to write message file: %s", err)
+	}
+	path := filepath.Join(s.dir, "cur", name+maildirInfo(flags))
+	err = os.Rename(tmpPath, path)
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to move message file: %s", err)
+	}
+	s.lastPath = path
+	return 0, nil
+}
+
+// FindMessageID searches the current folder for a message with the given
+// Message-Id and returns 1 if it exists or 0 otherwise. A found message is
+// the one checked by the next ConfirmStored.
+func (s *MaildirSink) FindMessageID(msgID string) (uint32, error) {
+	path, err := findMaildirMessageID(s.dir, msgID)
+	if err != nil || path == "" {
+		return 0, err
+	}
+	s.lastPath = path
+	return 1, nil
+}
+
+// ConfirmStored checks that the most recently appended message has been
+// stored completely.
+func (s *MaildirSink) ConfirmStored(uid uint32, msgID string, msg imap.Literal) (uint32, error) {
+	path := s.lastPath
+	if path == "" {
+		var err error
+		path, err = findMaildirMessageID(s.dir, msgID)
+		if err != nil || path == "" {
+			return 0, fmt.Errorf("stored message with message-id=%s not found", msgID)
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to check stored message: %s", err)
+	}
+	if fi.Size() != int64(msg.Info().Len) {
+		return 0, fmt.Errorf("stored message %s has size=%d, expected %d", path, fi.Size(), msg.Info().Len)
+	}
+	logger.Debugf("confirmed stored message %s (size=%d)", path, fi.Size())
+	return uid, nil
+}
+
+// Close implements the MessageSink interface.
+func (s *MaildirSink) Close() error {
+	return nil
+}
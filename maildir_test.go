@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type MaildirSuite struct{}
+
+var _ = Suite(&MaildirSuite{})
+
+// localTestMessage is a message as seen by a MessageCallback.
+type localTestMessage struct {
+	flags imap.FlagSet
+	idate time.Time
+	body  string
+}
+
+// collectMessages returns a MessageCallback which records all messages in
+// msgs. The store function fails for messages whose body contains fail.
+func collectMessages(msgs *[]localTestMessage, fail string) MessageCallback {
+	return func(rec *JournalRecord, flags imap.FlagSet, idate *time.Time, mail imap.Literal) MessageStoreFunc {
+		buf := &bytes.Buffer{}
+		mail.WriteTo(buf)
+		return func() error {
+			*msgs = append(*msgs, localTestMessage{flags, *idate, buf.String()})
+			if fail != "" && bytes.Contains(buf.Bytes(), []byte(fail)) {
+				return os.ErrInvalid
+			}
+			return nil
+		}
+	}
+}
+
+var maildirPathTests = []struct {
+	folder string
+	path   string
+}{
+	{"INBOX", "/m"},
+	{"INBOX.Archive", "/m/.Archive"},
+	{"Archive.2015", "/m/.Archive.2015"},
+	{"Archive/2015", "/m/.Archive.2015"},
+	{"../Archive", ""},
+	{"Archive..2015", ""},
+}
+
+func (s *MaildirSuite) TestPath(c *C) {
+	for _, tt := range maildirPathTests {
+		path, err := maildirPath("/m", tt.folder)
+		if tt.path == "" {
+			c.Assert(err, NotNil)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(path, Equals, tt.path)
+	}
+}
+
+func (s *MaildirSuite) TestFlags(c *C) {
+	flags := parseMaildirFlags("1234.M1P2Q3.host:2,FRS")
+	c.Assert(flags, DeepEquals, imap.NewFlagSet("\\Flagged", "\\Answered", "\\Seen"))
+	c.Assert(parseMaildirFlags("1234.M1P2Q3.host"), HasLen, 0)
+	c.Assert(maildirInfo(imap.NewFlagSet("\\Seen", "\\Draft", "$Forwarded", "$Junk")), Equals, ":2,DPS")
+}
+
+func (s *MaildirSuite) TestRoundTrip(c *C) {
+	root := c.MkDir()
+	sink := NewMaildirSink(root)
+	c.Assert(sink.SelectMailbox("Archive"), IsNil)
+	idate := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg := imap.NewLiteral([]byte("Message-Id: <1@example.org>\r\nSubject: test\r\n\r\nbody\r\n"))
+	_, err := sink.Append(imap.NewFlagSet("\\Seen", "\\Flagged"), &idate, msg, "<1@example.org>")
+	c.Assert(err, IsNil)
+	_, err = sink.ConfirmStored(0, "<1@example.org>", msg)
+	c.Assert(err, IsNil)
+	uid, err := sink.FindMessageID("<1@example.org>")
+	c.Assert(err, IsNil)
+	c.Assert(uid, Not(Equals), uint32(0))
+
+	source := NewMaildirSource(root, true, false, 30)
+	var msgs []localTestMessage
+	filter := &SearchFilter{Flagged: FilterInclude}
+	c.Assert(source.Iterate("INBOX.Archive", filter, collectMessages(&msgs, "")), IsNil)
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(msgs[0].flags, DeepEquals, imap.NewFlagSet("\\Seen", "\\Flagged"))
+	c.Assert(msgs[0].idate.Equal(idate), Equals, true)
+	c.Assert(msgs[0].body, Equals, "Message-Id: <1@example.org>\r\nSubject: test\r\n\r\nbody\r\n")
+
+	// the message has been deleted after storing it
+	paths, err := listMaildir(filepath.Join(root, ".Archive"))
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 0)
+}
+
+func (s *MaildirSuite) TestFilter(c *C) {
+	root := c.MkDir()
+	sink := NewMaildirSink(root)
+	c.Assert(sink.SelectMailbox("INBOX"), IsNil)
+	old := time.Now().Add(-60 * Day)
+	recent := time.Now()
+	for _, m := range []struct {
+		flags imap.FlagSet
+		idate *time.Time
+		body  string
+	}{
+		{imap.NewFlagSet("\\Seen"), &old, "old"},
+		{imap.NewFlagSet("\\Seen"), &recent, "recent"},
+		{imap.NewFlagSet(), &old, "unread"},
+		{imap.NewFlagSet("\\Seen", "\\Deleted"), &old, "deleted"},
+	} {
+		_, err := sink.Append(m.flags, m.idate, imap.NewLiteral([]byte("Subject: "+m.body+"\n\n"+m.body+"\n")), "")
+		c.Assert(err, IsNil)
+	}
+
+	source := NewMaildirSource(root, false, false, 30)
+	var msgs []localTestMessage
+	c.Assert(source.Iterate("INBOX", &SearchFilter{Date: DateInternal}, collectMessages(&msgs, "")), IsNil)
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(msgs[0].body, Equals, "Subject: old\n\nold\n")
+
+	paths, err := listMaildir(root)
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 4)
+}
+
+func (s *MaildirSuite) TestSample(c *C) {
+	root := c.MkDir()
+	sink := NewMaildirSink(root)
+	c.Assert(sink.SelectMailbox("INBOX"), IsNil)
+	idate := time.Now().Add(-60 * Day)
+	for i := 0; i < 10; i++ {
+		_, err := sink.Append(imap.NewFlagSet("\\Seen"), &idate,
+			imap.NewLiteral([]byte(CustomHeader+": 1\nContent-Type: multipart/encrypted\n\nbody\n")), "")
+		c.Assert(err, IsNil)
+	}
+
+	source := NewMaildirSource(root, false, false, 30)
+	source.SetSampleSize(3)
+	var msgs []localTestMessage
+	c.Assert(source.IterateEncrypted("INBOX", collectMessages(&msgs, "")), IsNil)
+	c.Assert(msgs, HasLen, 3)
+
+	// the sample is reset for further iterations
+	msgs = nil
+	c.Assert(source.IterateEncrypted("INBOX", collectMessages(&msgs, "")), IsNil)
+	c.Assert(msgs, HasLen, 3)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"runtime"
 
 	"github.com/codegangsta/cli"
 	"github.com/juju/loggo"
@@ -44,8 +45,58 @@ func setupCLI() {
 			Name:  "write-metrics",
 			Usage: "collect metrics and write them to the given file",
 		},
+		cli.IntFlag{
+			Name:  "jobs",
+			Value: runtime.NumCPU(),
+			Usage: "number of messages to encrypt and verify concurrently",
+		},
+		cli.StringSliceFlag{
+			Name:  "account",
+			Usage: "only process the account with the given name (may be repeated)",
+		},
+		cli.IntFlag{
+			Name:  "parallel-accounts",
+			Value: 1,
+			Usage: "number of accounts to process concurrently",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "process all matching messages without modifying the mailbox and print a summary",
+		},
 	}
 	ea := &EncryptAction{}
+	da := &DecryptAction{}
+	wa := &WatchAction{}
+	aa := &AuditAction{}
 	app.Action = ea.Run
+	app.Commands = []cli.Command{
+		{
+			Name:   "encrypt",
+			Usage:  "encrypt all matching messages (default)",
+			Action: ea.Run,
+		},
+		{
+			Name:   "decrypt",
+			Usage:  "restore the original messages from their encrypted copies",
+			Action: da.Run,
+		},
+		{
+			Name:   "watch",
+			Usage:  "keep running and encrypt new matching messages using IMAP IDLE",
+			Action: wa.Run,
+		},
+		{
+			Name:   "audit",
+			Usage:  "check that a sample of the encrypted messages can be decrypted using the recovery key",
+			Action: aa.Run,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "sample",
+					Value: DefaultAuditSampleSize,
+					Usage: "number of randomly chosen messages to check per folder",
+				},
+			},
+		},
+	}
 	app.Run(os.Args)
 }
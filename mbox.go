@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// mboxDateFormat is the format of the date in mbox "From " lines.
+const mboxDateFormat = "Mon Jan _2 15:04:05 2006"
+
+// mboxDateFormats are the formats which are accepted when parsing "From "
+// lines.
+var mboxDateFormats = []string{
+	mboxDateFormat,
+	"Mon Jan _2 15:04:05 MST 2006",
+	"Mon Jan _2 15:04:05 -0700 2006",
+}
+
+// mboxXStatusFlags maps the letters of the X-Status header to IMAP flags.
+var mboxXStatusFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'A', "\\Answered"},
+	{'F', "\\Flagged"},
+	{'T', "\\Draft"},
+	{'D', "\\Deleted"},
+}
+
+// mboxFlagHeaders are the headers which store flags in mbox files. They are
+// removed from messages which are read and generated for messages which are
+// written.
+var mboxFlagHeaders = []string{"Status:", "X-Status:", "X-Keywords:"}
+
+// mboxPath returns the path of the mbox file of the given folder: a file
+// named after the folder within the root directory, using '/' as the
+// hierarchy separator.
+func mboxPath(root, folder string) (string, error) {
+	name, err := localFolderName(folder)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(name)), nil
+}
+
+// isMboxFromLine returns true if the given line separates two messages.
+func isMboxFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// isQuotedMboxFromLine returns true if the given line starts with ">From "
+// preceded by any number of further '>' (mboxrd quoting).
+func isQuotedMboxFromLine(line []byte) bool {
+	return isMboxFromLine(bytes.TrimLeft(line, ">"))
+}
+
+// isBlankLine returns true if the given line is empty except for its line
+// ending.
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// mboxFlagHeader returns the name of the flag header which the given header
+// line starts with or an empty string.
+func mboxFlagHeader(line []byte) string {
+	for _, name := range mboxFlagHeaders {
+		if len(line) >= len(name) && strings.EqualFold(string(line[:len(name)]), name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseMboxDate parses the date of the given "From " line.
+func parseMboxDate(line []byte) (time.Time, error) {
+	fields := strings.SplitN(strings.TrimSpace(string(line)), " ", 3)
+	if len(fields) < 3 {
+		return time.Time{}, fmt.Errorf("invalid From line %q", line)
+	}
+	date := strings.Join(strings.Fields(fields[2]), " ")
+	for _, format := range mboxDateFormats {
+		t, err := time.Parse(format, date)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date in From line %q", line)
+}
+
+// parseMboxFlags adds the flags stored in the given flag header line to
+// flags.
+func parseMboxFlags(flags imap.FlagSet, name string, line []byte) {
+	value := strings.TrimSpace(string(line[len(name):]))
+	switch name {
+	case "Status:":
+		if strings.Contains(value, "R") {
+			flags["\\Seen"] = true
+		}
+	case "X-Status:":
+		for _, f := range mboxXStatusFlags {
+			if strings.IndexByte(value, f.letter) >= 0 {
+				flags[f.flag] = true
+			}
+		}
+	case "X-Keywords:":
+		for _, keyword := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == ' ' || r == ','
+		}) {
+			flags[keyword] = true
+		}
+	}
+}
+
+// mboxFlagHeaderLines returns the header lines which store the given flags,
+// terminated with the given line ending.
+func mboxFlagHeaderLines(flags imap.FlagSet, eol string) string {
+	status := "O"
+	if flags["\\Seen"] {
+		status = "RO"
+	}
+	lines := "Status: " + status + eol
+	xstatus := ""
+	for _, f := range mboxXStatusFlags {
+		if flags[f.flag] {
+			xstatus += string(f.letter)
+		}
+	}
+	if xstatus != "" {
+		lines += "X-Status: " + xstatus + eol
+	}
+	var keywords []string
+	for flag := range flags {
+		if !strings.HasPrefix(flag, "\\") {
+			keywords = append(keywords, flag)
+		}
+	}
+	if len(keywords) > 0 {
+		sort.Strings(keywords)
+		lines += "X-Keywords: " + strings.Join(keywords, " ") + eol
+	}
+	return lines
+}
+
+// mboxMessage is a single message read from an mbox file.
+type mboxMessage struct {
+	mail  *SpoolBuffer
+	flags imap.FlagSet
+	idate time.Time
+
+	// start and end are the offsets of the message (including its "From "
+	// line and the separating blank line) within the mbox file.
+	start, end int64
+}
+
+// mboxReader splits an mbox file (mboxrd format) into messages. "From "
+// quoting is reversed and the flag headers are converted to IMAP flags.
+type mboxReader struct {
+	r           *bufio.Reader
+	spooler     *Spooler
+	defaultDate time.Time
+	offset      int64
+	fromLine    []byte
+}
+
+// newMboxReader returns a new mboxReader which reads from r. Messages whose
+// "From " line does not contain a valid date get defaultDate as their
+// internal date.
+func newMboxReader(r io.Reader, spooler *Spooler, defaultDate time.Time) *mboxReader {
+	return &mboxReader{
+		r:           bufio.NewReaderSize(r, 64*1024),
+		spooler:     spooler,
+		defaultDate: defaultDate,
+	}
+}
+
+// readLine returns the next line or a part of it if it is longer than the
+// buffer. The returned slice is only valid until the next call.
+func (r *mboxReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	r.offset += int64(len(line))
+	return line, err
+}
+
+// Next returns the next message or io.EOF if there are no more messages.
+// The message has to be released by closing its mail.
+func (r *mboxReader) Next() (*mboxMessage, error) {
+	if r.fromLine == nil {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !isMboxFromLine(line) {
+			return nil, fmt.Errorf("not an mbox file (no From line at offset %d)", r.offset-int64(len(line)))
+		}
+		r.fromLine = append([]byte{}, line...)
+	}
+	msg := &mboxMessage{
+		mail:  r.spooler.NewBuffer(),
+		flags: make(imap.FlagSet),
+		start: r.offset - int64(len(r.fromLine)),
+	}
+	var err error
+	msg.idate, err = parseMboxDate(r.fromLine)
+	if err != nil {
+		logger.Warningf("%s, using the file's modification time", err)
+		msg.idate = r.defaultDate
+	}
+	r.fromLine = nil
+
+	err = r.readMessage(msg)
+	if err != nil {
+		msg.mail.Close()
+		return nil, err
+	}
+	msg.end = r.offset
+	if r.fromLine != nil {
+		msg.end -= int64(len(r.fromLine))
+	}
+	return msg, nil
+}
+
+// readMessage reads the lines up to the next "From " line (which is kept
+// for the next message) or the end of the file into msg.
+func (r *mboxReader) readMessage(msg *mboxMessage) error {
+	inHeader := true
+	lineStart := true
+	dropping := false
+	var blank []byte
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		atLineStart := lineStart
+		lineStart = line[len(line)-1] == '\n'
+		if atLineStart && isMboxFromLine(line) {
+			r.fromLine = append([]byte{}, line...)
+			return nil
+		}
+		if atLineStart && inHeader {
+			if name := mboxFlagHeader(line); name != "" {
+				parseMboxFlags(msg.flags, name, line)
+				dropping = true
+				continue
+			}
+			if dropping && (line[0] == ' ' || line[0] == '\t') {
+				continue
+			}
+			dropping = false
+		}
+		if atLineStart && isBlankLine(line) {
+			inHeader = false
+			// the blank line before the next "From " line is not part of
+			// the message
+			if blank != nil {
+				_, err = msg.mail.Write(blank)
+				if err != nil {
+					return err
+				}
+			}
+			blank = append(blank[:0], line...)
+			continue
+		}
+		if blank != nil {
+			_, err = msg.mail.Write(blank)
+			if err != nil {
+				return err
+			}
+			blank = nil
+		}
+		if atLineStart && isQuotedMboxFromLine(line) {
+			line = line[1:]
+		}
+		_, err = msg.mail.Write(line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeMboxMessage writes the given message to w in mboxrd format: lines
+// starting with "From " (after any number of '>') are quoted and the given
+// flags are stored in the corresponding headers, replacing any existing
+// ones. The message is terminated with a line ending if necessary.
+// The number of bytes read from msg is returned.
+func writeMboxMessage(w io.Writer, msg imap.Literal, flags imap.FlagSet) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := msg.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	r := bufio.NewReaderSize(pr, 64*1024)
+	var total int64
+	inHeader := true
+	lineStart := true
+	dropping := false
+	var last byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = nil
+		}
+		if err != nil && err != io.EOF {
+			return total, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		total += int64(len(line))
+		atLineStart := lineStart
+		lineStart = line[len(line)-1] == '\n'
+		last = line[len(line)-1]
+		if atLineStart && inHeader {
+			if mboxFlagHeader(line) != "" {
+				dropping = true
+				continue
+			}
+			if dropping && (line[0] == ' ' || line[0] == '\t') {
+				continue
+			}
+			dropping = false
+			if isBlankLine(line) {
+				inHeader = false
+				_, err = io.WriteString(w, mboxFlagHeaderLines(flags, string(line)))
+				if err != nil {
+					return total, err
+				}
+			}
+		}
+		if atLineStart && isQuotedMboxFromLine(line) {
+			_, err = w.Write([]byte(">"))
+			if err != nil {
+				return total, err
+			}
+		}
+		_, err = w.Write(line)
+		if err != nil {
+			return total, err
+		}
+	}
+	if last != '\n' && total > 0 {
+		_, err := w.Write([]byte("\n"))
+		if err != nil {
+			return total, err
+		}
+	}
+	if inHeader {
+		// message without body
+		_, err := io.WriteString(w, mboxFlagHeaderLines(flags, "\n"))
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// MboxSource provides support for traversing the mails of local mbox files
+// (mboxrd format). The date in the "From " line is used as the internal date.
+// Deleting messages rewrites the whole file; this is refused if the file has
+// been modified by other programs in the meantime.
+type MboxSource struct {
+	localSource
+	root string
+}
+
+// NewMboxSource returns a new MboxSource instance for the mbox files in the
+// given root directory. See NewIMAPSource for the other parameters.
+func NewMboxSource(root string, deletePlainCopies, dryRun bool,
+	minAgeInDays time.Duration) *MboxSource {
+	return &MboxSource{
+		localSource: newLocalSource(deletePlainCopies, dryRun, minAgeInDays),
+		root:        root,
+	}
+}
+
+// Iterate loops through the given folder, selects all messages which match
+// the given filter and are older than the configured minimum age and invokes
+// the callback for each message.
+func (s *MboxSource) Iterate(folder string, filter *SearchFilter, callbackFunc MessageCallback) error {
+	return s.iterate(folder, filter, callbackFunc)
+}
+
+// IterateEncrypted loops through the given folder and invokes the callback
+// for each message which has been encrypted by lemoncrypt.
+func (s *MboxSource) IterateEncrypted(folder string, callbackFunc MessageCallback) error {
+	return s.iterate(folder, nil, callbackFunc)
+}
+
+// iterate invokes the callback for all messages in the given folder which
+// are selected by the given filter, see localSource.selects. Afterwards,
+// the messages which have been stored successfully are removed from the
+// file if configured.
+func (s *MboxSource) iterate(folder string, filter *SearchFilter, callbackFunc MessageCallback) error {
+	path, err := mboxPath(s.root, folder)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("reading mbox %s", path)
+	fd, err := os.Open(path)
+	if err != nil {
+		logger.Errorf("failed to open mbox: %s", err)
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	var removals [][2]int64
+	pipeline := NewPipeline(s.jobs)
+	defer s.discardSample()
+	r := newMboxReader(fd, s.spooler, fi.ModTime())
+	matching := 0
+	for !s.stopped() {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pipeline.Close()
+			logger.Errorf("failed to read mbox: %s", err)
+			return err
+		}
+		if !s.selects(msg.mail, msg.flags, msg.idate, filter) {
+			msg.mail.Close()
+			continue
+		}
+		matching++
+		desc := fmt.Sprintf("message at offset %d", msg.start)
+		start, end := msg.start, msg.end
+		s.submit(pipeline, desc, msg.mail, msg.flags, msg.idate, callbackFunc, func() error {
+			removals = append(removals, [2]int64{start, end})
+			return nil
+		})
+	}
+	logger.Infof("found %d matching messages", matching)
+	s.submitSample(pipeline)
+	pipeline.Close()
+	if s.stopped() {
+		logger.Infof("stop requested, skipped the remaining messages")
+	}
+	if len(removals) == 0 {
+		return nil
+	}
+	logger.Debugf("removing %d messages from %s", len(removals), path)
+	err = removeMboxRanges(path, fi, removals)
+	if err != nil {
+		logger.Errorf("failed to remove messages: %s", err)
+	}
+	return err
+}
+
+// removeMboxRanges rewrites the mbox file at the given path without the
+// given byte ranges, which have to be sorted. orig is the state of the file
+// when it was read; if it has been modified since then, nothing is removed.
+func removeMboxRanges(path string, orig os.FileInfo, ranges [][2]int64) error {
+	unchanged := func() error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if fi.Size() != orig.Size() || !fi.ModTime().Equal(orig.ModTime()) {
+			return fmt.Errorf("%s has been modified by another program", path)
+		}
+		return nil
+	}
+	err := unchanged()
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".lemoncrypt-mbox-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var pos int64
+	for _, r := range append(ranges, [2]int64{orig.Size(), orig.Size()}) {
+		_, err = io.Copy(tmp, io.NewSectionReader(src, pos, r[0]-pos))
+		if err != nil {
+			return err
+		}
+		pos = r[1]
+	}
+	err = tmp.Chmod(orig.Mode().Perm())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = unchanged()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// findMboxMessageID returns true if the mbox file at the given path contains
+// a message with the given Message-Id.
+func findMboxMessageID(path, msgID string) (bool, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	r := newMboxReader(fd, nil, time.Time{})
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		found := readHeaders(msg.mail).Get("Message-Id") == msgID
+		msg.mail.Close()
+		if found {
+			return true, nil
+		}
+	}
+}
+
+// MboxSink provides support for appending mails to local mbox files
+// (mboxrd format). The internal date is stored in the "From " line.
+type MboxSink struct {
+	root    string
+	path    string
+	fd      *os.File
+	lastLen int64
+	lastEnd int64
+}
+
+// NewMboxSink returns a new MboxSink instance for the mbox files in the
+// given root directory.
+func NewMboxSink(root string) *MboxSink {
+	return &MboxSink{root: root}
+}
+
+// SelectMailbox makes the given folder the one further messages are
+// appended to. The mbox file is created if necessary.
+func (s *MboxSink) SelectMailbox(mailbox string) error {
+	path, err := mboxPath(s.root, mailbox)
+	if err != nil {
+		return err
+	}
+	err = s.Close()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		s.fd, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		logger.Errorf("unable to open mbox '%s': %s", path, err)
+		return err
+	}
+	s.path = path
+	return nil
+}
+
+// Append adds the given message to the end of the current mbox file. If
+// writing fails, the file is truncated to its previous size. mbox files have
+// no UIDs, so 0 is returned.
+func (s *MboxSink) Append(flags imap.FlagSet, idate *time.Time, msg imap.Literal,
+	msgID string) (uint32, error) {
+	logger.Debugf("appending mail to %s", s.path)
+	start, err := s.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	date := time.Now()
+	if idate != nil {
+		date = *idate
+	}
+	w := bufio.NewWriter(s.fd)
+	_, err = fmt.Fprintf(w, "From MAILER-DAEMON %s\n", date.UTC().Format(mboxDateFormat))
+	var n int64
+	if err == nil {
+		n, err = writeMboxMessage(w, msg, flags)
+	}
+	if err == nil {
+		_, err = w.WriteString("\n")
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = s.fd.Sync()
+	}
+	if err != nil {
+		if truncErr := s.fd.Truncate(start); truncErr != nil {
+			logger.Errorf("unable to remove partially written message from %s: %s", s.path, truncErr)
+		}
+		return 0, fmt.Errorf("unable to write message: %s", err)
+	}
+	s.lastLen = n
+	s.lastEnd, err = s.fd.Seek(0, io.SeekEnd)
+	return 0, err
+}
+
+// FindMessageID searches the current mbox file for a message with the given
+// Message-Id and returns 1 if it exists or 0 otherwise. The next
+// ConfirmStored looks the message up by its Message-Id again instead of
+// checking the most recently appended one.
+func (s *MboxSink) FindMessageID(msgID string) (uint32, error) {
+	s.lastEnd = 0
+	found, err := findMboxMessageID(s.path, msgID)
+	if err != nil || !found {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// ConfirmStored checks that the most recently appended message has been
+// stored completely.
+func (s *MboxSink) ConfirmStored(uid uint32, msgID string, msg imap.Literal) (uint32, error) {
+	if s.lastEnd == 0 {
+		found, err := findMboxMessageID(s.path, msgID)
+		if err != nil || !found {
+			return 0, fmt.Errorf("stored message with message-id=%s not found", msgID)
+		}
+		return uid, nil
+	}
+	fi, err := s.fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("unable to check stored message: %s", err)
+	}
+	if s.lastLen != int64(msg.Info().Len) || fi.Size() < s.lastEnd {
+		return 0, fmt.Errorf("stored message has size=%d, expected %d", s.lastLen, msg.Info().Len)
+	}
+	logger.Debugf("confirmed stored message in %s (size=%d)", s.path, s.lastLen)
+	return uid, nil
+}
+
+// Close closes the current mbox file.
+func (s *MboxSink) Close() error {
+	if s.fd == nil {
+		return nil
+	}
+	err := s.fd.Close()
+	s.fd = nil
+	s.lastEnd = 0
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type MboxSuite struct{}
+
+var _ = Suite(&MboxSuite{})
+
+// appendMboxMessages appends messages with the given bodies to the given
+// mbox folder.
+func appendMboxMessages(c *C, root, folder string, idate time.Time, bodies ...string) {
+	sink := NewMboxSink(root)
+	defer sink.Close()
+	c.Assert(sink.SelectMailbox(folder), IsNil)
+	for _, body := range bodies {
+		msg := imap.NewLiteral([]byte(body))
+		_, err := sink.Append(imap.NewFlagSet("\\Seen", "\\Answered", "$Forwarded"), &idate, msg, "")
+		c.Assert(err, IsNil)
+		_, err = sink.ConfirmStored(0, "", msg)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *MboxSuite) TestRoundTrip(c *C) {
+	root := c.MkDir()
+	idate := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	body := "Subject: one\nStatus: O\n\nFrom here\n>From there\n\n"
+	appendMboxMessages(c, root, "Archive/2015", idate, body, "Subject: two\n\nno newline")
+
+	content, err := ioutil.ReadFile(filepath.Join(root, "Archive", "2015"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals,
+		"From MAILER-DAEMON Sun Mar  1 12:00:00 2015\n"+
+			"Subject: one\nStatus: RO\nX-Status: A\nX-Keywords: $Forwarded\n\n>From here\n>>From there\n\n\n"+
+			"From MAILER-DAEMON Sun Mar  1 12:00:00 2015\n"+
+			"Subject: two\nStatus: RO\nX-Status: A\nX-Keywords: $Forwarded\n\nno newline\n\n")
+
+	source := NewMboxSource(root, false, false, 30)
+	var msgs []localTestMessage
+	c.Assert(source.Iterate("Archive/2015", &SearchFilter{}, collectMessages(&msgs, "")), IsNil)
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[0].body, Equals, "Subject: one\n\nFrom here\n>From there\n\n")
+	c.Assert(msgs[0].flags, DeepEquals, imap.NewFlagSet("\\Seen", "\\Answered", "$Forwarded"))
+	c.Assert(msgs[0].idate.Equal(idate), Equals, true)
+	c.Assert(msgs[1].body, Equals, "Subject: two\n\nno newline\n")
+}
+
+func (s *MboxSuite) TestRemove(c *C) {
+	root := c.MkDir()
+	idate := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	appendMboxMessages(c, root, "INBOX", idate, "Subject: 1\n\none\n", "Subject: 2\n\ntwo\n",
+		"Subject: 3\n\nthree\n")
+
+	source := NewMboxSource(root, true, false, 30)
+	var msgs []localTestMessage
+	c.Assert(source.Iterate("INBOX", &SearchFilter{}, collectMessages(&msgs, "two")), IsNil)
+	c.Assert(msgs, HasLen, 3)
+
+	content, err := ioutil.ReadFile(filepath.Join(root, "INBOX"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "From MAILER-DAEMON Sun Mar  1 12:00:00 2015\n"+
+		"Subject: 2\nStatus: RO\nX-Status: A\nX-Keywords: $Forwarded\n\ntwo\n\n")
+}
+
+func (s *MboxSuite) TestNotAnMbox(c *C) {
+	root := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "INBOX"), []byte("Subject: x\n\n"), 0600), IsNil)
+	source := NewMboxSource(root, false, false, 30)
+	var msgs []localTestMessage
+	err := source.Iterate("INBOX", &SearchFilter{}, collectMessages(&msgs, ""))
+	c.Assert(err, ErrorMatches, "not an mbox file.*")
+}
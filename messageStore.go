@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Supported values for the type option of the server, source and target
+// config sections.
+const (
+	// BackendIMAP accesses mailboxes on an IMAP server (default).
+	BackendIMAP = "imap"
+
+	// BackendMaildir accesses a local Maildir++ directory tree.
+	BackendMaildir = "maildir"
+
+	// BackendMbox accesses a directory of local mbox files (mboxrd).
+	BackendMbox = "mbox"
+)
+
+// MessageSource is implemented by all backends which messages can be read
+// from.
+type MessageSource interface {
+	// Iterate invokes the callback for each message in the given folder
+	// which matches the filter and is older than the configured minimum
+	// age. Successfully stored messages are deleted if configured.
+	Iterate(folder string, filter *SearchFilter, callback MessageCallback) error
+
+	// IterateEncrypted invokes the callback for each message in the given
+	// folder which has been encrypted by lemoncrypt.
+	IterateEncrypted(folder string, callback MessageCallback) error
+
+	// SetSampleSize limits all further iterations to a random sample of at
+	// most n of the matching messages. 0 disables sampling.
+	SetSampleSize(n int)
+
+	// Stop makes the current and all further iterations finish early. It
+	// may be called from any goroutine.
+	Stop()
+
+	// Close releases the backend's resources.
+	Close() error
+}
+
+// MessageSink is implemented by all backends which messages can be written
+// to.
+type MessageSink interface {
+	// SelectMailbox makes the given mailbox (which is created if necessary)
+	// the one further messages are appended to.
+	SelectMailbox(mailbox string) error
+
+	// Append stores the given message with the given flags and internal
+	// date. It returns the UID of the stored message if known, 0 otherwise.
+	// msgID is used to find out whether an interrupted append succeeded; it
+	// is empty if the message must not be looked up by its Message-Id.
+	Append(flags imap.FlagSet, idate *time.Time, msg imap.Literal, msgID string) (uint32, error)
+
+	// FindMessageID returns the UID of a message with the given Message-Id
+	// or 0 if there is no such message. Backends without UIDs return an
+	// arbitrary non-zero value if the message exists.
+	FindMessageID(msgID string) (uint32, error)
+
+	// ConfirmStored returns an error unless the given message has been
+	// stored completely. uid may be 0 if unknown, msgID may be empty as
+	// for Append; the confirmed UID is returned.
+	ConfirmStored(uid uint32, msgID string, msg imap.Literal) (uint32, error)
+
+	// Close releases the backend's resources.
+	Close() error
+}
+
+// MessageCallback is the type for the MessageSource callback parameter.
+// It may be invoked concurrently for several messages and should therefore
+// only do CPU-bound work. The journal record may be nil if no journal is in
+// use. The message is only valid until the returned store function has
+// finished.
+type MessageCallback func(*JournalRecord, imap.FlagSet, *time.Time, imap.Literal) MessageStoreFunc
+
+// MessageStoreFunc is returned by a MessageCallback and completes the
+// processing of a message, e.g. by storing the result. Store functions are
+// invoked one at a time in the order in which the messages have been
+// read. The message is deleted if nil is returned.
+type MessageStoreFunc func() error
+
+// validateBackend returns an error if the given value is not a supported
+// backend type.
+func validateBackend(backend string) error {
+	switch backend {
+	case "", BackendIMAP, BackendMaildir, BackendMbox:
+		return nil
+	}
+	return fmt.Errorf("unsupported type '%s' (expected %s, %s or %s)",
+		backend, BackendIMAP, BackendMaildir, BackendMbox)
+}
+
+// isLocalBackend returns true if the given backend type refers to local
+// files.
+func isLocalBackend(backend string) bool {
+	return backend == BackendMaildir || backend == BackendMbox
+}
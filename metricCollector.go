@@ -4,12 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 )
 
 // MetricCollector can be used to collect statistics and write them to a
 // CSV file.
+// It may be used concurrently.
 type MetricCollector struct {
+	mu      sync.Mutex
 	outfd   *os.File
 	counter uint64
 }
@@ -23,6 +26,9 @@ type MetricRecord struct {
 	OrigSize   uint32
 	ResultSize uint32
 	Success    bool
+	// Skipped is true for messages which had already been stored by an
+	// interrupted run.
+	Skipped bool
 }
 
 // NewMetricCollector returns a new MetricCollector instance.
@@ -46,7 +52,7 @@ func NewMetricCollector(outfile string) (*MetricCollector, error) {
 
 // writeHeader outputs a CSV header to the output file.
 func (mc *MetricCollector) writeHeader() error {
-	_, err := mc.outfd.WriteString("StartTime;EndTime;Duration (ns);OrigSize (B);ResultSize (B);Success\n")
+	_, err := mc.outfd.WriteString("StartTime;EndTime;Duration (ns);OrigSize (B);ResultSize (B);Success;Skipped\n")
 	if err != nil {
 		return fmt.Errorf("failed to write header: %s", err)
 	}
@@ -64,11 +70,19 @@ func (mc *MetricCollector) NewRecord() *MetricRecord {
 	return r
 }
 
-// Commit updates the EndTime field and passes this record to the collector
-// so it can be serialized to disk.
-func (mr *MetricRecord) Commit() error {
+// Stop sets the EndTime and Duration fields to the current time, so that the
+// measured duration does not include anything which happens until Commit.
+func (mr *MetricRecord) Stop() {
 	mr.EndTime = time.Now()
 	mr.Duration = mr.EndTime.Sub(mr.StartTime)
+}
+
+// Commit updates the EndTime field unless Stop has been called and passes
+// this record to the collector so it can be serialized to disk.
+func (mr *MetricRecord) Commit() error {
+	if mr.EndTime.IsZero() {
+		mr.Stop()
+	}
 	return mr.collector.writeRecord(mr)
 }
 
@@ -81,8 +95,10 @@ func (mc *MetricCollector) writeRecord(r *MetricRecord) error {
 		// silently as this means that none has been configured.
 		return nil
 	}
-	_, err := fmt.Fprintf(mc.outfd, "%s;%s;%d;%d;%d;%t\n",
-		r.StartTime, r.EndTime, r.Duration, r.OrigSize, r.ResultSize, r.Success)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	_, err := fmt.Fprintf(mc.outfd, "%s;%s;%d;%d;%d;%t;%t\n",
+		r.StartTime, r.EndTime, r.Duration, r.OrigSize, r.ResultSize, r.Success, r.Skipped)
 	if err != nil {
 		return fmt.Errorf("failed to write record: %s", err)
 	}
@@ -98,5 +114,8 @@ func (mc *MetricCollector) writeRecord(r *MetricRecord) error {
 
 // Close closes the underlying file handle.
 func (mc *MetricCollector) Close() error {
+	if mc == nil {
+		return nil
+	}
 	return mc.outfd.Close()
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetricCollectorSuite struct{}
+
+var _ = Suite(&MetricCollectorSuite{})
+
+func (s *MetricCollectorSuite) TestRecords(c *C) {
+	path := filepath.Join(c.MkDir(), "metrics.csv")
+	mc, err := NewMetricCollector(path)
+	c.Assert(err, IsNil)
+
+	// the duration ends with Stop, not with Commit
+	r := mc.NewRecord()
+	r.Stop()
+	duration := r.Duration
+	time.Sleep(10 * time.Millisecond)
+	r.Success = true
+	c.Assert(r.Commit(), IsNil)
+	c.Assert(r.Duration, Equals, duration)
+
+	r = mc.NewRecord()
+	r.Success = true
+	r.Skipped = true
+	c.Assert(r.Commit(), IsNil)
+	c.Assert(mc.Close(), IsNil)
+
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	c.Assert(lines, HasLen, 3)
+	c.Assert(strings.HasSuffix(lines[0], ";Success;Skipped"), Equals, true)
+	c.Assert(strings.HasSuffix(lines[1], ";true;false"), Equals, true)
+	c.Assert(strings.HasSuffix(lines[2], ";true;true"), Equals, true)
+}
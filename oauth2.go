@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauth2ExpiryMargin is the time before the reported expiry of an access
+// token when it is considered expired already, so that it does not expire
+// while authenticating.
+const oauth2ExpiryMargin = time.Minute
+
+// OAuth2Config contains the settings which are needed to obtain OAuth2
+// access tokens. The access token is either taken from a command or file
+// or requested from the token endpoint using a refresh token.
+type OAuth2Config struct {
+	TokenCommand        string
+	TokenFile           string
+	TokenURL            string `toml:"token_url"`
+	ClientID            string `toml:"client_id"`
+	ClientSecret        string
+	Scope               string
+	RefreshToken        string
+	RefreshTokenCommand string
+	RefreshTokenFile    string
+}
+
+// refreshTokenSecret returns the configured sources of the refresh token.
+func (c *OAuth2Config) refreshTokenSecret() *Secret {
+	return &Secret{
+		Value:   c.RefreshToken,
+		Command: c.RefreshTokenCommand,
+		File:    c.RefreshTokenFile,
+	}
+}
+
+// Validate checks that exactly one way of obtaining access tokens has been
+// configured.
+func (c *OAuth2Config) Validate() error {
+	configured := 0
+	for _, source := range []string{c.TokenCommand, c.TokenFile, c.TokenURL} {
+		if source != "" {
+			configured++
+		}
+	}
+	if configured != 1 {
+		return errors.New("exactly one of oauth2.token_command, oauth2.token_file and oauth2.token_url has to be set")
+	}
+	if c.TokenURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid oauth2.token_url '%s'", c.TokenURL)
+	}
+	if c.ClientID == "" {
+		return errors.New("missing oauth2.client_id")
+	}
+	err = c.refreshTokenSecret().Validate()
+	if err != nil {
+		return fmt.Errorf("invalid oauth2 refresh token: %s", err)
+	}
+	return nil
+}
+
+// OAuth2TokenSource provides OAuth2 access tokens for authenticating with a
+// server. Tokens obtained from the token endpoint are cached until they
+// expire. It is safe for concurrent use.
+type OAuth2TokenSource struct {
+	cfg          *OAuth2Config
+	client       *http.Client
+	mu           sync.Mutex
+	token        []byte
+	expiry       time.Time
+	refreshToken []byte
+}
+
+// NewOAuth2TokenSource returns a new OAuth2TokenSource instance using the
+// given settings.
+func NewOAuth2TokenSource(cfg *OAuth2Config) *OAuth2TokenSource {
+	return &OAuth2TokenSource{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Token returns a valid access token. The caller owns the returned slice
+// and should clear it using zeroBytes after use.
+func (s *OAuth2TokenSource) Token() ([]byte, error) {
+	if s.cfg.TokenURL == "" {
+		token, err := (&Secret{Command: s.cfg.TokenCommand, File: s.cfg.TokenFile}).Resolve("OAuth2 access token")
+		if err != nil {
+			return nil, fmt.Errorf("unable to get access token: %s", err)
+		}
+		return token, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == nil || (!s.expiry.IsZero() && time.Now().After(s.expiry.Add(-oauth2ExpiryMargin))) {
+		err := s.refresh()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte(nil), s.token...), nil
+}
+
+// Invalidate discards the cached access token, e.g. after it has been
+// rejected by the server.
+func (s *OAuth2TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zeroBytes(s.token)
+	s.token = nil
+}
+
+// Clear overwrites all cached tokens in memory.
+func (s *OAuth2TokenSource) Clear() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zeroBytes(s.token)
+	zeroBytes(s.refreshToken)
+	s.token = nil
+	s.refreshToken = nil
+}
+
+// oauth2TokenResponse is the response of the token endpoint, see RFC 6749,
+// sections 5.1 and 5.2.
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refresh requests a new access token from the token endpoint using the
+// refresh token. If the endpoint issues a new refresh token, it replaces the
+// old one and is written back to the refresh token file (if configured).
+// s.mu has to be held by the caller.
+func (s *OAuth2TokenSource) refresh() error {
+	if s.refreshToken == nil {
+		var err error
+		s.refreshToken, err = s.cfg.refreshTokenSecret().Resolve("OAuth2 refresh token")
+		if err != nil {
+			return fmt.Errorf("unable to get refresh token: %s", err)
+		}
+	}
+	logger.Debugf("requesting access token from %s", s.cfg.TokenURL)
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {string(s.refreshToken)},
+		"client_id":     {s.cfg.ClientID},
+	}
+	if s.cfg.ClientSecret != "" {
+		form.Set("client_secret", s.cfg.ClientSecret)
+	}
+	if s.cfg.Scope != "" {
+		form.Set("scope", s.cfg.Scope)
+	}
+	resp, err := s.client.PostForm(s.cfg.TokenURL, form)
+	if err != nil {
+		return fmt.Errorf("token request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read token response: %s", err)
+	}
+	defer zeroBytes(body)
+	var result oauth2TokenResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("unable to parse token response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Error != "" {
+		if result.Error == "" {
+			return fmt.Errorf("token request failed: %s", resp.Status)
+		}
+		return fmt.Errorf("token request failed: %s (%s)", result.Error, result.ErrorDescription)
+	}
+	if result.AccessToken == "" {
+		return errors.New("token response lacks access_token")
+	}
+	if result.TokenType != "" && !strings.EqualFold(result.TokenType, "Bearer") {
+		return fmt.Errorf("unsupported token_type '%s'", result.TokenType)
+	}
+	zeroBytes(s.token)
+	s.token = []byte(result.AccessToken)
+	s.expiry = time.Time{}
+	if result.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	}
+	logger.Debugf("obtained access token (expires in %ds)", result.ExpiresIn)
+	if result.RefreshToken != "" && result.RefreshToken != string(s.refreshToken) {
+		zeroBytes(s.refreshToken)
+		s.refreshToken = []byte(result.RefreshToken)
+		s.storeRefreshToken()
+	}
+	return nil
+}
+
+// storeRefreshToken writes a new refresh token back to the refresh token
+// file, so that it is available for future runs. Failures are only logged,
+// as the current run can continue with the token in memory.
+func (s *OAuth2TokenSource) storeRefreshToken() {
+	if s.cfg.RefreshTokenFile == "" {
+		logger.Warningf("token endpoint issued a new refresh token, update your configuration")
+		return
+	}
+	path := expandTilde(s.cfg.RefreshTokenFile)
+	fd, err := ioutil.TempFile(filepath.Dir(path), ".refresh-token")
+	if err != nil {
+		logger.Errorf("unable to store new refresh token: %s", err)
+		return
+	}
+	_, err = fd.Write(s.refreshToken)
+	if err == nil {
+		_, err = fd.Write([]byte("\n"))
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		logger.Errorf("unable to store new refresh token: %s", err)
+		return
+	}
+	logger.Infof("stored new refresh token in %s", path)
+}
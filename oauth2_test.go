@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type OAuth2Suite struct{}
+
+var _ = Suite(&OAuth2Suite{})
+
+// fakeTokenEndpoint is a minimal OAuth2 token endpoint which accepts
+// refresh token grants for a single client.
+type fakeTokenEndpoint struct {
+	*httptest.Server
+	mu           sync.Mutex
+	requests     int
+	refreshToken string
+	rotate       bool
+}
+
+// newFakeTokenEndpoint starts a token endpoint which accepts the given
+// refresh token.
+func newFakeTokenEndpoint(refreshToken string) *fakeTokenEndpoint {
+	e := &fakeTokenEndpoint{refreshToken: refreshToken}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.handle))
+	return e
+}
+
+func (e *fakeTokenEndpoint) handle(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" || r.PostFormValue("grant_type") != "refresh_token" ||
+		r.PostFormValue("client_id") != "lemoncrypt" || r.PostFormValue("client_secret") != "s3cr3t" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_request"}`)
+		return
+	}
+	if r.PostFormValue("refresh_token") != e.refreshToken {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"token revoked"}`)
+		return
+	}
+	newRefreshToken := ""
+	if e.rotate {
+		e.refreshToken = fmt.Sprintf("refresh-%d", e.requests)
+		newRefreshToken = e.refreshToken
+	}
+	fmt.Fprintf(w, `{"access_token":"access-%d","token_type":"bearer","expires_in":3600,"refresh_token":"%s"}`,
+		e.requests, newRefreshToken)
+}
+
+func (s *OAuth2Suite) TestRefresh(c *C) {
+	endpoint := newFakeTokenEndpoint("refresh-0")
+	defer endpoint.Close()
+	cfg := &OAuth2Config{TokenURL: endpoint.URL, ClientID: "lemoncrypt", ClientSecret: "s3cr3t",
+		RefreshToken: "refresh-0"}
+	c.Assert(cfg.Validate(), IsNil)
+	tokens := NewOAuth2TokenSource(cfg)
+
+	token, err := tokens.Token()
+	c.Assert(err, IsNil)
+	c.Assert(string(token), Equals, "access-1")
+	// cached until it expires
+	token, err = tokens.Token()
+	c.Assert(err, IsNil)
+	c.Assert(string(token), Equals, "access-1")
+	c.Assert(endpoint.requests, Equals, 1)
+
+	tokens.Invalidate()
+	token, err = tokens.Token()
+	c.Assert(err, IsNil)
+	c.Assert(string(token), Equals, "access-2")
+
+	tokens.Clear()
+	c.Assert(tokens.token, IsNil)
+	c.Assert(tokens.refreshToken, IsNil)
+}
+
+func (s *OAuth2Suite) TestRotatedRefreshToken(c *C) {
+	endpoint := newFakeTokenEndpoint("refresh-0")
+	endpoint.rotate = true
+	defer endpoint.Close()
+	path := filepath.Join(c.MkDir(), "refresh-token")
+	c.Assert(ioutil.WriteFile(path, []byte("refresh-0\n"), 0600), IsNil)
+	tokens := NewOAuth2TokenSource(&OAuth2Config{TokenURL: endpoint.URL, ClientID: "lemoncrypt",
+		ClientSecret: "s3cr3t", RefreshTokenFile: path})
+
+	_, err := tokens.Token()
+	c.Assert(err, IsNil)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "refresh-1\n")
+
+	// the new refresh token is used from now on
+	tokens.Invalidate()
+	token, err := tokens.Token()
+	c.Assert(err, IsNil)
+	c.Assert(string(token), Equals, "access-2")
+}
+
+func (s *OAuth2Suite) TestRefreshRejected(c *C) {
+	endpoint := newFakeTokenEndpoint("refresh-0")
+	defer endpoint.Close()
+	tokens := NewOAuth2TokenSource(&OAuth2Config{TokenURL: endpoint.URL, ClientID: "lemoncrypt",
+		ClientSecret: "s3cr3t", RefreshToken: "expired"})
+	_, err := tokens.Token()
+	c.Assert(err, ErrorMatches, "token request failed: invalid_grant \\(token revoked\\)")
+}
+
+func (s *OAuth2Suite) TestTokenCommand(c *C) {
+	tokens := NewOAuth2TokenSource(&OAuth2Config{TokenCommand: "echo from-command"})
+	token, err := tokens.Token()
+	c.Assert(err, IsNil)
+	c.Assert(string(token), Equals, "from-command")
+}
+
+var invalidOAuth2Configs = []struct {
+	cfg OAuth2Config
+	err string
+}{
+	{OAuth2Config{}, "exactly one of .* has to be set"},
+	{OAuth2Config{TokenCommand: "true", TokenFile: "/token"}, "exactly one of .* has to be set"},
+	{OAuth2Config{TokenURL: "ftp://example.org/token", ClientID: "id"}, "invalid oauth2.token_url .*"},
+	{OAuth2Config{TokenURL: "https://example.org/token"}, "missing oauth2.client_id"},
+	{OAuth2Config{TokenURL: "https://example.org/token", ClientID: "id", RefreshToken: "a",
+		RefreshTokenFile: "/b"}, "invalid oauth2 refresh token: .*"},
+}
+
+func (s *OAuth2Suite) TestInvalid(c *C) {
+	for _, tt := range invalidOAuth2Configs {
+		c.Assert(tt.cfg.Validate(), ErrorMatches, tt.err)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
-import "os/user"
+import (
+	"os/user"
+	"strings"
+)
 
 func expandTilde(path string) string {
-	if path[0:2] != "~/" {
+	if !strings.HasPrefix(path, "~/") {
 		return path
 	}
 	usr, err := user.Current()
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -10,26 +9,34 @@ import (
 	"mime/multipart"
 	"net/textproto"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 )
 
 // PGPDecryptor handles decryption of a single mail message.
+// The encrypted message is written to a SpoolBuffer, so large messages are
+// kept in a temporary file instead of memory.
 type PGPDecryptor struct {
-	buf                  *bytes.Buffer
-	headers              textproto.MIMEHeader
-	keyring              openpgp.EntityList
-	md                   *openpgp.MessageDetails
-	decryptionPassphrase string
+	buf     *SpoolBuffer
+	headers textproto.MIMEHeader
+	keyring openpgp.EntityList
+	md      *openpgp.MessageDetails
 }
 
 // NewPGPDecryptor returns a new PGPDecryptor instance, initialized with the given parameters.
-func NewPGPDecryptor(signingKey, decryptionKey *openpgp.Entity, decryptionPassphrase string) *PGPDecryptor {
+// The encrypted message is buffered using the given spooler, which may be nil.
+// The private parts of the decryption keys have to be decrypted already.
+// signingKey may be nil if signatures are not going to be verified.
+func NewPGPDecryptor(signingKey *openpgp.Entity, decryptionKeys openpgp.EntityList,
+	spooler *Spooler) *PGPDecryptor {
 	d := &PGPDecryptor{}
-	d.buf = &bytes.Buffer{}
-	d.decryptionPassphrase = decryptionPassphrase
-	d.keyring = openpgp.EntityList{signingKey, decryptionKey}
+	d.buf = spooler.NewBuffer()
+	if signingKey != nil {
+		d.keyring = openpgp.EntityList{signingKey}
+	}
+	d.keyring = append(d.keyring, decryptionKeys...)
 	return d
 }
 
@@ -37,12 +44,18 @@ func (d *PGPDecryptor) Write(data []byte) (int, error) {
 	return d.buf.Write(data)
 }
 
+// Close releases the buffered message. Readers returned by
+// .GetNonVerifyingReader() must not be used afterwards.
+func (d *PGPDecryptor) Close() error {
+	return d.buf.Close()
+}
+
 // GetNonVerifyingReader returns the decrypted message as a Reader.
 // IMPORTANT: The reader will return unverified data. .Verify() has to
 // be called before working with the data!
 func (d *PGPDecryptor) GetNonVerifyingReader() (io.Reader, error) {
 	var err error
-	plainReader := bufio.NewReader(d.buf)
+	plainReader := bufio.NewReader(d.buf.Reader())
 	mimeReader := textproto.NewReader(plainReader)
 	d.headers, err = mimeReader.ReadMIMEHeader()
 	if err != nil {
@@ -50,7 +63,7 @@ func (d *PGPDecryptor) GetNonVerifyingReader() (io.Reader, error) {
 	}
 	if !d.isLemoncrypt() {
 		logger.Debugf("returning non-lemoncrypt message without modification")
-		return d.buf, nil
+		return d.buf.Reader(), nil
 	}
 	boundary, err := d.getBoundary()
 	multipartReader := multipart.NewReader(mimeReader.R, boundary)
@@ -100,25 +113,58 @@ func (d *PGPDecryptor) getEncryptedPart(r *multipart.Reader) (*multipart.Part, e
 // Verify ensures that the signature is valid.
 // It must be called after reading all data from the reader returned by .GetReader().
 func (d *PGPDecryptor) Verify() error {
+	if d.md == nil {
+		return errors.New("message has not been decrypted")
+	}
+	if !d.md.IsSigned {
+		return errors.New("message is not signed")
+	}
 	if d.md.SignatureError != nil {
 		return fmt.Errorf("signature verification failed: %s", d.md.SignatureError)
 	}
 	return nil
 }
 
-func (d *PGPDecryptor) decryptDecryptionKey(keys []openpgp.Key, symmetric bool) ([]byte, error) {
-	// why do we need the prompt function here although our keyring contains a decrypted
-	// private key?
-	// .ReadMessage chose to call .DecryptionKeys() on the keyring, which actually duplicates
-	// the key material but not the decryption state, so .ReadMessage only sees encrypted keys.
-	err := errors.New("requiring passphrase")
-	for _, key := range keys {
-		err := key.PrivateKey.Decrypt([]byte(d.decryptionPassphrase))
-		if err == nil {
-			return nil, nil
+// VerifyRecipients ensures that the message contains a session key packet
+// for each of the given recipients' encryption (sub)keys. The packets are
+// not decrypted, so this does not prove that the recipients are able to
+// decrypt the message.
+func (d *PGPDecryptor) VerifyRecipients(recipients []*openpgp.Entity) error {
+	if d.md == nil {
+		return errors.New("message has not been decrypted")
+	}
+	encryptedTo := make(map[uint64]bool)
+	for _, id := range d.md.EncryptedToKeyIds {
+		encryptedTo[id] = true
+	}
+	for _, recipient := range recipients {
+		subkey, err := selectSubkey(recipient, usageEncrypt, time.Now())
+		if err != nil {
+			return err
+		}
+		key := recipient.PrimaryKey
+		if subkey != nil {
+			key = subkey.PublicKey
+		}
+		if !encryptedTo[key.KeyId] {
+			return fmt.Errorf("message is not encrypted to keyid=%s of key with fingerprint=%s",
+				key.KeyIdString(), fingerprint(recipient.PrimaryKey))
 		}
 	}
-	return nil, err
+	return nil
+}
+
+// decryptDecryptionKey is invoked by .ReadMessage if none of the matching
+// private keys has been decrypted. Passphrases are not kept around, as the
+// keys are decrypted when loading them, so this is an error.
+func (d *PGPDecryptor) decryptDecryptionKey(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	return nil, errors.New("private decryption key is locked")
+}
+
+// IsLemoncrypt returns true if the message which has been passed to
+// .GetNonVerifyingReader() looks like one which had been encrypted by lemoncrypt.
+func (d *PGPDecryptor) IsLemoncrypt() bool {
+	return d.headers != nil && d.isLemoncrypt()
 }
 
 // isLemoncrypt returns true if the message currently in the buffer
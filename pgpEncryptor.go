@@ -11,6 +11,7 @@ import (
 	"net/textproto"
 	"strings"
 
+	"github.com/mxk/go-imap/imap"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
@@ -18,25 +19,32 @@ import (
 
 // PGPEncryptor implements PGP encryption; use PGPTransformer.NewEncryptor
 // to get a properly configured instance.
+//
+// The armored ciphertext is written to a SpoolBuffer, so large messages are
+// kept in a temporary file instead of memory.
 type PGPEncryptor struct {
-	pgpBuffer    *bytes.Buffer
+	pgpBuffer    *SpoolBuffer
 	outBuffer    *bytes.Buffer
 	headerBuffer *HeaderBuffer
 	pgpWriter    io.WriteCloser
 	asciiWriter  io.WriteCloser
 	keepHeaders  []string
 	headers      textproto.MIMEHeader
+	messageID    string
+	trailer      string
 }
 
 // NewPGPEncryptor returns a new PGPEncryptor instance, prepared for encrypting one single
-// mail with the given parameters.
-func NewPGPEncryptor(signingKey, encryptionKey *openpgp.Entity, keepHeaders []string) (*PGPEncryptor, error) {
-	if encryptionKey == nil {
+// mail to the given recipients with the given parameters. The ciphertext is
+// buffered using the given spooler, which may be nil.
+func NewPGPEncryptor(recipients []*openpgp.Entity, signingKey *openpgp.Entity, keepHeaders []string,
+	spooler *Spooler) (*PGPEncryptor, error) {
+	if len(recipients) == 0 {
 		return nil, errors.New("missing encryption key")
 	}
 	e := &PGPEncryptor{}
 	e.keepHeaders = keepHeaders
-	e.pgpBuffer = &bytes.Buffer{}
+	e.pgpBuffer = spooler.NewBuffer()
 	e.headerBuffer = NewHeaderBuffer()
 	var err error
 	e.asciiWriter, err = armor.Encode(e.pgpBuffer, "PGP MESSAGE", nil)
@@ -47,10 +55,10 @@ func NewPGPEncryptor(signingKey, encryptionKey *openpgp.Entity, keepHeaders []st
 		DefaultCipher: packet.CipherAES256,
 		DefaultHash:   crypto.SHA256,
 	}
-	e.pgpWriter, err = openpgp.Encrypt(e.asciiWriter,
-		[]*openpgp.Entity{encryptionKey}, signingKey,
+	e.pgpWriter, err = openpgp.Encrypt(e.asciiWriter, recipients, signingKey,
 		&openpgp.FileHints{IsBinary: true}, cfg)
 	if err != nil {
+		e.pgpBuffer.Close()
 		return nil, err
 	}
 	return e, nil
@@ -65,17 +73,28 @@ func (e *PGPEncryptor) Write(data []byte) (int, error) {
 	return e.pgpWriter.Write(data)
 }
 
-// GetBytes returns the encrypted message as a byte array.
-func (e *PGPEncryptor) GetBytes() ([]byte, error) {
+// GetLiteral returns the encrypted message. The literal may be backed by a
+// temporary file and has to be released using closeLiteral() after use.
+func (e *PGPEncryptor) GetLiteral() (imap.Literal, error) {
 	err := e.finalizePGP()
-	if err != nil {
-		return nil, err
+	if err == nil {
+		err = e.finalizeMIME()
 	}
-	err = e.finalizeMIME()
 	if err != nil {
+		e.pgpBuffer.Close()
 		return nil, err
 	}
-	return e.outBuffer.Bytes(), nil
+	return concatLiteral{
+		imap.NewLiteral(e.outBuffer.Bytes()),
+		e.pgpBuffer,
+		imap.NewLiteral([]byte(e.trailer)),
+	}, nil
+}
+
+// Close releases the ciphertext buffer if encryption is aborted before
+// .GetLiteral() has been called.
+func (e *PGPEncryptor) Close() error {
+	return e.pgpBuffer.Close()
 }
 
 // finalizePGP ends the PGP encryption process and ascii-encoding process.
@@ -127,9 +146,16 @@ func (e *PGPEncryptor) writeMessageID() {
 			msgid += msgIDPrefix + msgid[1:]
 		}
 	}
+	e.messageID = msgid
 	e.outBuffer.WriteString("Message-Id: " + msgid + "\n")
 }
 
+// MessageID returns the Message-Id of the encrypted message.
+// It is only available after calling .GetLiteral().
+func (e *PGPEncryptor) MessageID() string {
+	return e.messageID
+}
+
 func (e *PGPEncryptor) writeLemoncryptHeader() {
 	e.outBuffer.WriteString(CustomHeader + ": v0.1\n")
 }
@@ -147,8 +173,8 @@ func (e *PGPEncryptor) writeKeptHeaders() {
 	}
 }
 
-// writeMIMEStructure writes the basic MIME structure and the encrypted content
-// to the output buffer.
+// writeMIMEStructure writes the basic MIME structure up to the encrypted
+// content to the output buffer and prepares the trailer which follows it.
 func (e *PGPEncryptor) writeMIMEStructure() error {
 	boundary, err := generateBoundary()
 	if err != nil {
@@ -165,8 +191,8 @@ func (e *PGPEncryptor) writeMIMEStructure() error {
 			"Version: 1\n\n" +
 			"--" + boundary + "\n" +
 			"Content-Type: application/octet-stream; name=\"encrypted.asc\"\n" +
-			"Content-Disposition: inline; filename=\"encrypted.asc\"\n\n" +
-			string(e.pgpBuffer.Bytes()) + "\n--" + boundary + "--")
+			"Content-Disposition: inline; filename=\"encrypted.asc\"\n\n")
+	e.trailer = "\n--" + boundary + "--"
 	return nil
 }
 
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// keyUsage is the capability which a key is selected for.
+type keyUsage int
+
+const (
+	usageEncrypt keyUsage = iota
+	usageSign
+)
+
+// String returns the usage as used in log and error messages.
+func (u keyUsage) String() string {
+	if u == usageSign {
+		return "signing"
+	}
+	return "encryption"
+}
+
+// fingerprint returns the hex-encoded v4 fingerprint of the given key.
+func fingerprint(key *packet.PublicKey) string {
+	return fmt.Sprintf("%X", key.Fingerprint)
+}
+
+// normalizeKeyID converts the given key id to the upper-case hex form without
+// "0x" prefix and spaces, which allows copying fingerprints from gpg's output.
+// Short (8 digits) and long (16 digits) key ids and v4 fingerprints (40
+// digits) are accepted.
+func normalizeKeyID(id string) (string, error) {
+	id = strings.ToUpper(strings.Replace(id, " ", "", -1))
+	id = strings.TrimPrefix(id, "0X")
+	switch len(id) {
+	case 8, 16, 40:
+	default:
+		return "", fmt.Errorf("invalid keyid=%s: expected a fingerprint or a key id", id)
+	}
+	for _, r := range id {
+		if !strings.ContainsRune("0123456789ABCDEF", r) {
+			return "", fmt.Errorf("invalid keyid=%s: expected a fingerprint or a key id", id)
+		}
+	}
+	return id, nil
+}
+
+// matchesKeyID returns true if the given public key has the given normalized
+// key id or fingerprint.
+func matchesKeyID(key *packet.PublicKey, id string) bool {
+	switch len(id) {
+	case 40:
+		return fingerprint(key) == id
+	case 16:
+		return key.KeyIdString() == id
+	}
+	return key.KeyIdShortString() == id
+}
+
+// findKey returns the key with the given id from the given keyring. The id is
+// preferably the key's full fingerprint; key ids are accepted as well, but
+// are rejected if they match more than one key. Ids of subkeys select the
+// key they belong to. An empty id selects the only key of the keyring.
+// Revoked and expired keys are rejected.
+func findKey(keyring openpgp.EntityList, wantID string) (*openpgp.Entity, error) {
+	var matches openpgp.EntityList
+	if wantID == "" {
+		if len(keyring) != 1 {
+			return nil, fmt.Errorf("no keyid given, but the keyring contains %d keys", len(keyring))
+		}
+		matches = keyring
+	} else {
+		id, err := normalizeKeyID(wantID)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keyring {
+			if !containsKey(matches, key) && entityMatchesKeyID(key, id) {
+				matches = append(matches, key)
+			}
+		}
+		if len(id) == 8 && len(matches) == 1 {
+			logger.Warningf("keyid=%s is a short key id, which can easily be forged; use the fingerprint %s instead",
+				wantID, fingerprint(matches[0].PrimaryKey))
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no key with keyid=%s", wantID)
+	}
+	if len(matches) > 1 {
+		var fingerprints []string
+		for _, key := range matches {
+			fingerprints = append(fingerprints, fingerprint(key.PrimaryKey))
+		}
+		return nil, fmt.Errorf("keyid=%s is ambiguous, it matches the keys %s; use the full fingerprint",
+			wantID, strings.Join(fingerprints, ", "))
+	}
+	key := matches[0]
+	err := checkKeyValidity(key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("loaded key with fingerprint=%s", fingerprint(key.PrimaryKey))
+	return key, nil
+}
+
+// entityMatchesKeyID returns true if the given key's primary key or one of its
+// subkeys has the given normalized key id or fingerprint.
+func entityMatchesKeyID(key *openpgp.Entity, id string) bool {
+	if matchesKeyID(key.PrimaryKey, id) {
+		return true
+	}
+	for _, subkey := range key.Subkeys {
+		if matchesKeyID(subkey.PublicKey, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryIdentity returns the identity which is marked as primary or any
+// identity if none is.
+func primaryIdentity(key *openpgp.Entity) *openpgp.Identity {
+	var first *openpgp.Identity
+	for _, identity := range key.Identities {
+		if identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return identity
+		}
+		if first == nil {
+			first = identity
+		}
+	}
+	return first
+}
+
+// keyExpired returns true if the given key has expired at the given time
+// according to the given (self or binding) signature. Unlike
+// Signature.KeyExpired, the lifetime is counted from the key's creation as
+// required by RFC 4880 rather than from the signature's creation.
+func keyExpired(key *packet.PublicKey, sig *packet.Signature, now time.Time) bool {
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return false
+	}
+	return now.After(key.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second))
+}
+
+// checkKeyValidity returns an error if the given key has been revoked or has
+// expired at the given time.
+func checkKeyValidity(key *openpgp.Entity, now time.Time) error {
+	if len(key.Revocations) > 0 {
+		return fmt.Errorf("key with fingerprint=%s has been revoked", fingerprint(key.PrimaryKey))
+	}
+	identity := primaryIdentity(key)
+	if identity == nil {
+		return fmt.Errorf("key with fingerprint=%s has no user id", fingerprint(key.PrimaryKey))
+	}
+	if keyExpired(key.PrimaryKey, identity.SelfSignature, now) {
+		return fmt.Errorf("key with fingerprint=%s has expired", fingerprint(key.PrimaryKey))
+	}
+	return nil
+}
+
+// selectSubkey returns the subkey of the given key which is used for the
+// given usage or nil if the primary key is used. The rules of openpgp's
+// Encrypt and Sign are followed: the newest encryption subkey, the first
+// signing subkey or the primary key if there is no such subkey and its flags
+// allow it. Revoked and expired subkeys are skipped; for signing, subkeys
+// without private key are skipped as well. An error is returned if no
+// suitable key exists.
+func selectSubkey(key *openpgp.Entity, usage keyUsage, now time.Time) (*openpgp.Subkey, error) {
+	var selected *openpgp.Subkey
+	for i := range key.Subkeys {
+		subkey := &key.Subkeys[i]
+		if !subkeyUsable(key, subkey, usage, now) {
+			continue
+		}
+		if usage == usageSign {
+			return subkey, nil
+		}
+		if selected == nil || subkey.Sig.CreationTime.After(selected.Sig.CreationTime) {
+			selected = subkey
+		}
+	}
+	if selected != nil {
+		return selected, nil
+	}
+	sig := primaryIdentity(key).SelfSignature
+	switch {
+	case usage == usageEncrypt && (!sig.FlagsValid || sig.FlagEncryptCommunications) &&
+		key.PrimaryKey.PubKeyAlgo.CanEncrypt():
+		return nil, nil
+	case usage == usageSign && (!sig.FlagsValid || sig.FlagSign) && key.PrimaryKey.PubKeyAlgo.CanSign():
+		return nil, nil
+	}
+	return nil, fmt.Errorf("key with fingerprint=%s has no valid subkey for %s", fingerprint(key.PrimaryKey),
+		usage)
+}
+
+// subkeyUsable returns true if the given subkey of the given key can be used
+// for the given usage at the given time.
+func subkeyUsable(key *openpgp.Entity, subkey *openpgp.Subkey, usage keyUsage, now time.Time) bool {
+	id := subkey.PublicKey.KeyIdString()
+	switch {
+	case subkey.Sig.SigType == packet.SigTypeSubkeyRevocation:
+		logger.Debugf("skipping revoked subkey keyid=%s", id)
+		return false
+	case !subkey.Sig.FlagsValid:
+		return false
+	// openpgp only encrypts to subkeys flagged for communications, even
+	// though storage would be more appropriate for archived mail
+	case usage == usageEncrypt && !(subkey.Sig.FlagEncryptCommunications &&
+		subkey.PublicKey.PubKeyAlgo.CanEncrypt()):
+		return false
+	case usage == usageSign && !(subkey.Sig.FlagSign && subkey.PublicKey.PubKeyAlgo.CanSign()):
+		return false
+	case keyExpired(subkey.PublicKey, subkey.Sig, now):
+		logger.Debugf("skipping expired subkey keyid=%s", id)
+		return false
+	case usage == usageSign && subkey.PrivateKey == nil:
+		logger.Debugf("skipping signing subkey keyid=%s without private key", id)
+		return false
+	}
+	return true
+}
+
+// usableKey returns a copy of the given key which is restricted to the
+// subkey selected for the given usage (see selectSubkey), so that openpgp
+// cannot pick a different one. The selected subkey is logged.
+func usableKey(key *openpgp.Entity, usage keyUsage) (*openpgp.Entity, error) {
+	subkey, err := selectSubkey(key, usage, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	restricted := *key
+	restricted.Subkeys = nil
+	if subkey == nil {
+		logger.Infof("using primary key of fingerprint=%s for %s", fingerprint(key.PrimaryKey), usage)
+		return &restricted, nil
+	}
+	restricted.Subkeys = []openpgp.Subkey{*subkey}
+	logger.Infof("using subkey fingerprint=%s of key fingerprint=%s for %s", fingerprint(subkey.PublicKey),
+		fingerprint(key.PrimaryKey), usage)
+	return &restricted, nil
+}
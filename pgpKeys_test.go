@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	. "gopkg.in/check.v1"
+)
+
+type PGPKeysSuite struct {
+	alice *openpgp.Entity
+	bob   *openpgp.Entity
+}
+
+var _ = Suite(&PGPKeysSuite{})
+
+// newKey returns a new key with a signing primary key and an encryption
+// subkey, which has been created a week ago.
+func (s *PGPKeysSuite) newKey(c *C, name string) *openpgp.Entity {
+	key, err := openpgp.NewEntity(name, "", strings.ToLower(name)+"@example.org", &packet.Config{
+		RSABits: 1024,
+		Time:    func() time.Time { return time.Now().Add(-7 * 24 * time.Hour) },
+	})
+	c.Assert(err, IsNil)
+	return key
+}
+
+func (s *PGPKeysSuite) SetUpSuite(c *C) {
+	s.alice = s.newKey(c, "Alice")
+	s.bob = s.newKey(c, "Bob")
+}
+
+func (s *PGPKeysSuite) TestFindKey(c *C) {
+	keyring := openpgp.EntityList{s.alice, s.bob}
+	fpr := fingerprint(s.bob.PrimaryKey)
+	ids := []string{
+		fpr,
+		"0x" + strings.ToLower(fpr),
+		fpr[:20] + " " + fpr[20:],
+		s.bob.PrimaryKey.KeyIdString(),
+		s.bob.PrimaryKey.KeyIdShortString(),
+		// subkeys select the key they belong to
+		fingerprint(s.bob.Subkeys[0].PublicKey),
+	}
+	for _, id := range ids {
+		key, err := findKey(keyring, id)
+		c.Assert(err, IsNil, Commentf("keyid=%s", id))
+		c.Assert(key, Equals, s.bob)
+	}
+
+	_, err := findKey(keyring, "DEADBEEF")
+	c.Assert(err, ErrorMatches, "no key with keyid=DEADBEEF")
+	_, err = findKey(keyring, "DEADBEEF1")
+	c.Assert(err, ErrorMatches, "invalid keyid=DEADBEEF1: .*")
+	_, err = findKey(keyring, "DEADBEEG")
+	c.Assert(err, ErrorMatches, "invalid keyid=DEADBEEG: .*")
+	_, err = findKey(keyring, "")
+	c.Assert(err, ErrorMatches, "no keyid given, but the keyring contains 2 keys")
+	key, err := findKey(openpgp.EntityList{s.alice}, "")
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, s.alice)
+}
+
+func (s *PGPKeysSuite) TestAmbiguousKeyID(c *C) {
+	// a key with a colliding short key id, as could be generated by an
+	// attacker
+	pub := *s.bob.PrimaryKey
+	copy(pub.Fingerprint[16:], s.alice.PrimaryKey.Fingerprint[16:])
+	forged := *s.bob
+	forged.PrimaryKey = &pub
+	keyring := openpgp.EntityList{s.alice, &forged, s.alice}
+
+	_, err := findKey(keyring, s.alice.PrimaryKey.KeyIdShortString())
+	c.Assert(err, ErrorMatches, "keyid=.* is ambiguous, it matches the keys "+
+		fingerprint(s.alice.PrimaryKey)+", "+fingerprint(&pub)+"; use the full fingerprint")
+	// keys contained several times are not ambiguous
+	key, err := findKey(keyring, fingerprint(s.alice.PrimaryKey))
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, s.alice)
+}
+
+func (s *PGPKeysSuite) TestRevokedKey(c *C) {
+	key := s.newKey(c, "Revoked")
+	key.Revocations = []*packet.Signature{{SigType: packet.SigTypeKeyRevocation}}
+	_, err := findKey(openpgp.EntityList{key}, fingerprint(key.PrimaryKey))
+	c.Assert(err, ErrorMatches, "key with fingerprint=.* has been revoked")
+}
+
+func (s *PGPKeysSuite) TestExpiredKey(c *C) {
+	key := s.newKey(c, "Expired")
+	lifetime := uint32(24 * 60 * 60)
+	primaryIdentity(key).SelfSignature.KeyLifetimeSecs = &lifetime
+	_, err := findKey(openpgp.EntityList{key}, fingerprint(key.PrimaryKey))
+	c.Assert(err, ErrorMatches, "key with fingerprint=.* has expired")
+
+	lifetime = 30 * 24 * 60 * 60
+	_, err = findKey(openpgp.EntityList{key}, fingerprint(key.PrimaryKey))
+	c.Assert(err, IsNil)
+}
+
+func (s *PGPKeysSuite) TestUsableKey(c *C) {
+	key, err := usableKey(s.alice, usageEncrypt)
+	c.Assert(err, IsNil)
+	c.Assert(key.Subkeys, HasLen, 1)
+	c.Assert(key.Subkeys[0].PublicKey, Equals, s.alice.Subkeys[0].PublicKey)
+	key, err = usableKey(s.alice, usageSign)
+	c.Assert(err, IsNil)
+	c.Assert(key.PrimaryKey, Equals, s.alice.PrimaryKey)
+	c.Assert(key.Subkeys, HasLen, 0)
+	// the original key is not modified
+	c.Assert(s.alice.Subkeys, HasLen, 1)
+}
+
+func (s *PGPKeysSuite) TestNewestSubkey(c *C) {
+	key := s.newKey(c, "Carol")
+	newer := key.Subkeys[0]
+	sig := *newer.Sig
+	sig.CreationTime = sig.CreationTime.Add(time.Hour)
+	newer.Sig = &sig
+	key.Subkeys = append(key.Subkeys, newer)
+	subkey, err := selectSubkey(key, usageEncrypt, time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(subkey, Equals, &key.Subkeys[1])
+}
+
+func (s *PGPKeysSuite) TestNoUsableSubkey(c *C) {
+	revoked := s.newKey(c, "Revoked")
+	revoked.Subkeys[0].Sig = &packet.Signature{SigType: packet.SigTypeSubkeyRevocation}
+	_, err := usableKey(revoked, usageEncrypt)
+	c.Assert(err, ErrorMatches, "key with fingerprint=.* has no valid subkey for encryption")
+
+	expired := s.newKey(c, "Expired")
+	lifetime := uint32(24 * 60 * 60)
+	expired.Subkeys[0].Sig.KeyLifetimeSecs = &lifetime
+	_, err = usableKey(expired, usageEncrypt)
+	c.Assert(err, ErrorMatches, "key with fingerprint=.* has no valid subkey for encryption")
+
+	encryptOnly := s.newKey(c, "Encrypt")
+	identity := primaryIdentity(encryptOnly)
+	identity.SelfSignature.FlagSign = false
+	identity.SelfSignature.FlagEncryptCommunications = true
+	_, err = usableKey(encryptOnly, usageSign)
+	c.Assert(err, ErrorMatches, "key with fingerprint=.* has no valid subkey for signing")
+	// the primary key is used for encryption if it is flagged for it
+	encryptOnly.Subkeys = nil
+	key, err := usableKey(encryptOnly, usageEncrypt)
+	c.Assert(err, IsNil)
+	c.Assert(key.Subkeys, HasLen, 0)
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
 	"strings"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 const (
@@ -22,87 +24,353 @@ const (
 // PGPTransformer provides support for converting arbitrary plain messages to PGP/MIME
 // messages in a way which allows for bit-perfect reversal of the operation.
 type PGPTransformer struct {
-	signingKey              *openpgp.Entity
-	encryptionKey           *openpgp.Entity
-	encryptionKeyPassphrase string
-	keepHeaders             []string
+	// signingKey is used for verifying signatures; signer is the same key
+	// restricted to the subkey which is used for signing.
+	signingKey  *openpgp.Entity
+	signer      *openpgp.Entity
+	keepHeaders []string
+	spooler     *Spooler
+
+	// encryptionKeys contains the public keys of all recipients by their
+	// configured ids.
+	encryptionKeys map[string]*openpgp.Entity
+
+	// decryptionKeys contains the unlocked private keys of the recipients
+	// which are available locally; decryptable contains their ids.
+	decryptionKeys openpgp.EntityList
+	decryptable    map[string]bool
+
+	// recoveryKeys are added to the recipients of every message.
+	recoveryKeys []*openpgp.Entity
+
+	// ephemeralKey is added to the recipients of every message and used
+	// for the round-trip verification instead of decryptionKeys if set.
+	ephemeralKey *openpgp.Entity
+
+	// agent performs the operations with private keys which are not
+	// available in the keyrings, if set.
+	agent *GPGAgent
 }
 
+// PassphraseFunc returns the passphrase of a private key. It is only
+// invoked if the key is actually protected by a passphrase; the returned
+// slice is cleared after use.
+type PassphraseFunc func() ([]byte, error)
+
 // NewPGPTransformer returns a new PGPTransformer instance.
 func NewPGPTransformer(keepHeaders []string) *PGPTransformer {
 	return &PGPTransformer{keepHeaders: keepHeaders}
 }
 
-// LoadEncryptionKey loads the keyring from the given path and tries to set up the
-// first and only public key found there as the encryption target.
-func (t *PGPTransformer) LoadEncryptionKey(path, id, passphrase string) error {
-	logger.Debugf("loading encryption key from %s (id=%s)", path, id)
-	var err error
-	t.encryptionKey, err = t.loadKey(path, id, passphrase, false)
+// SetSpooler configures the spooler which is used for buffering large
+// messages.
+func (t *PGPTransformer) SetSpooler(spooler *Spooler) {
+	t.spooler = spooler
+}
+
+// SetAgent configures gpg-agent to be used for private keys which are not
+// contained in the keyrings. It has to be called before loading any keys.
+func (t *PGPTransformer) SetAgent(agent *GPGAgent) {
+	t.agent = agent
+}
+
+// LoadEncryptionKeys loads the public keys with the given ids from the
+// keyring at the given path; messages can be encrypted to any of them
+// afterwards, see Recipients.
+// The round-trip verification requires one of a message's recipients to
+// have a private key, which is looked up in the keyrings at privatePaths.
+// These private keys are decrypted upfront, so that concurrent round-trip
+// verifications never have to modify the shared key material and the
+// passphrase does not have to be kept in memory. Private keys which cannot
+// be unlocked using the passphrase are ignored.
+// If an ephemeral key has been generated, private keys are not looked up at
+// all, see GenerateEphemeralKey.
+func (t *PGPTransformer) LoadEncryptionKeys(path string, ids []string, privatePaths []string,
+	passphrase PassphraseFunc) error {
+	logger.Debugf("loading encryption keys from %s (ids=%s)", path, strings.Join(ids, ", "))
+	keyring, err := readKeyring(path)
+	if err != nil {
+		return err
+	}
+	var privateKeyrings []openpgp.EntityList
+	for _, privatePath := range privatePaths {
+		privateKeyring, err := readKeyring(privatePath)
+		if err != nil {
+			return err
+		}
+		privateKeyrings = append(privateKeyrings, privateKeyring)
+	}
+	cache := &passphraseCache{get: passphrase}
+	defer cache.clear()
+	t.encryptionKeys = make(map[string]*openpgp.Entity)
+	t.decryptable = make(map[string]bool)
+	for _, id := range ids {
+		if _, exists := t.encryptionKeys[id]; exists {
+			continue
+		}
+		key, err := findKey(keyring, id)
+		if err != nil {
+			return err
+		}
+		t.encryptionKeys[id], err = usableKey(key, usageEncrypt)
+		if err != nil {
+			return err
+		}
+		if t.ephemeralKey != nil {
+			continue
+		}
+		priv := findPrivateKey(append([]openpgp.EntityList{keyring}, privateKeyrings...), key)
+		if priv == nil && t.agent != nil {
+			priv, err = t.agent.PrivateKey(key)
+			if err != nil {
+				return fmt.Errorf("unable to query gpg-agent: %s", err)
+			}
+		}
+		if priv == nil {
+			logger.Debugf("no private key available for keyid=%s", id)
+			continue
+		}
+		err = unlockKey(priv, cache)
+		if err == errNoPassphrase {
+			return err
+		}
+		if err != nil {
+			logger.Warningf("unable to decrypt private key of keyid=%s, not using it for verification: %s",
+				id, err)
+			continue
+		}
+		t.decryptable[id] = true
+		t.decryptionKeys = append(t.decryptionKeys, priv)
+	}
+	return nil
+}
+
+// Recipients returns the previously loaded encryption keys with the given
+// ids. An error is returned if none of them has a private key which can be
+// used for the round-trip verification, unless an ephemeral key is used for
+// it; the ephemeral key is one of the returned recipients then.
+func (t *PGPTransformer) Recipients(ids []string) ([]*openpgp.Entity, error) {
+	var recipients []*openpgp.Entity
+	decryptable := false
+	for _, id := range ids {
+		key, exists := t.encryptionKeys[id]
+		if !exists {
+			return nil, fmt.Errorf("encryption key with keyid=%s has not been loaded", id)
+		}
+		recipients = append(recipients, key)
+		decryptable = decryptable || t.decryptable[id]
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	if t.ephemeralKey != nil {
+		recipients = append(recipients, t.ephemeralKey)
+	} else if !decryptable {
+		return nil, fmt.Errorf("none of the recipients (%s) has a private key available for the "+
+			"round-trip verification", strings.Join(ids, ", "))
+	}
+	for _, key := range t.recoveryKeys {
+		if !containsKey(recipients, key) {
+			recipients = append(recipients, key)
+		}
+	}
+	return recipients, nil
+}
+
+// GenerateEphemeralKey generates a key which only exists in memory and is
+// used for the round-trip verification instead of the recipients' private
+// keys, which do not have to be available on this machine then. Every message
+// is encrypted to the ephemeral key in addition to its recipients; as the
+// ephemeral key is discarded on exit, this session key packet is useless
+// afterwards. The verification cannot prove that the recipients' session key
+// packets can be decrypted, it only checks that there is one for each of
+// them, see PGPDecryptor.VerifyRecipients.
+// It has to be called before LoadEncryptionKeys.
+func (t *PGPTransformer) GenerateEphemeralKey() error {
+	key, err := openpgp.NewEntity("lemoncrypt ephemeral verification key", "", "", nil)
 	if err != nil {
 		return err
 	}
-	t.encryptionKeyPassphrase = passphrase
+	logger.Infof("generated ephemeral verification key with fingerprint=%s", fingerprint(key.PrimaryKey))
+	t.ephemeralKey = key
+	t.decryptionKeys = openpgp.EntityList{key}
 	return nil
 }
 
+// LoadRecoveryKey loads the public key with the given id from the keyring at
+// the given path. Messages are always encrypted to it in addition to the
+// recipients passed to Recipients. It may be called several times in order
+// to use several recovery keys.
+func (t *PGPTransformer) LoadRecoveryKey(path, id string) error {
+	logger.Debugf("loading recovery key from %s (id=%s)", path, id)
+	keyring, err := readKeyring(path)
+	if err != nil {
+		return err
+	}
+	key, err := findKey(keyring, id)
+	if err != nil {
+		return err
+	}
+	key, err = usableKey(key, usageEncrypt)
+	if err != nil {
+		return err
+	}
+	t.recoveryKeys = append(t.recoveryKeys, key)
+	return nil
+}
+
+// containsKey returns true if the given key is one of the given keys.
+func containsKey(keys []*openpgp.Entity, key *openpgp.Entity) bool {
+	for _, candidate := range keys {
+		if candidate.PrimaryKey.Fingerprint == key.PrimaryKey.Fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
 // LoadSigningKey loads the keyring from the given path and tries to so set up
-// the first and only private key found there as the signing key, optionally
+// the private key with the given id as the signing key, optionally
 // decrypting it with the given passphrase first.
-func (t *PGPTransformer) LoadSigningKey(path, id, passphrase string) error {
+func (t *PGPTransformer) LoadSigningKey(path, id string, passphrase PassphraseFunc) error {
 	logger.Debugf("loading signing key from %s (id=%s)", path, id)
-	var err error
-	t.signingKey, err = t.loadKey(path, id, passphrase, true)
-	return err
+	key, err := loadPrivateKey(path, id, passphrase, t.agent)
+	if err != nil {
+		return err
+	}
+	t.signer, err = usableKey(key, usageSign)
+	if err != nil {
+		return err
+	}
+	t.signingKey = key
+	return nil
 }
 
-// loadKey is the internal method which contains the common key loading and
-// parsing functionality.
-func (t *PGPTransformer) loadKey(path, wantID, passphrase string, needPrivateKey bool) (*openpgp.Entity, error) {
-	keyringReader, err := os.Open(path)
+// loadPrivateKey returns the key with the given id from the keyring at the
+// given path with its private parts decrypted. If the keyring only contains
+// the public key, the private key is looked up in the given agent (if any).
+func loadPrivateKey(path, id string, passphrase PassphraseFunc, agent *GPGAgent) (*openpgp.Entity, error) {
+	keyring, err := readKeyring(path)
 	if err != nil {
 		return nil, err
 	}
-	defer keyringReader.Close()
-	keyring, err := openpgp.ReadKeyRing(keyringReader)
+	key, err := findKey(keyring, id)
 	if err != nil {
 		return nil, err
 	}
-	var foundKey *openpgp.Entity
-	for _, key := range keyring {
-		id := key.PrimaryKey.KeyIdString()
-		if strings.HasSuffix(id, wantID) {
-			foundKey = key
-			logger.Infof("loaded key with keyid=%s", id)
-			break
+	if key.PrivateKey == nil && agent != nil {
+		agentKey, err := agent.PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query gpg-agent: %s", err)
+		}
+		if agentKey != nil {
+			key = agentKey
 		}
 	}
-	if foundKey == nil {
-		return nil, fmt.Errorf("no key with keyid=%s", wantID)
+	if key.PrivateKey == nil {
+		return nil, fmt.Errorf("key with keyid=%s lacks private key", id)
 	}
-	if !needPrivateKey {
-		return foundKey, nil
+	cache := &passphraseCache{get: passphrase}
+	defer cache.clear()
+	err = unlockKey(key, cache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %s", err)
 	}
-	priv := foundKey.PrivateKey
-	if priv == nil {
-		return nil, errors.New("signing key lacks private key")
+	return key, nil
+}
+
+// readKeyring reads the keyring at the given path, which is either a binary
+// keyring (e.g. pubring.gpg), an ASCII-armored key export or a GnuPG keybox
+// (pubring.kbx).
+func readKeyring(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	if priv.Encrypted {
-		err := priv.Decrypt([]byte(passphrase))
+	switch {
+	case isKeybox(data):
+		return parseKeybox(data)
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")):
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// findPrivateKey returns the entity from the given keyrings which contains
+// the private parts of the given key or nil if there is none.
+func findPrivateKey(keyrings []openpgp.EntityList, key *openpgp.Entity) *openpgp.Entity {
+	for _, keyring := range keyrings {
+		for _, candidate := range keyring {
+			if candidate.PrimaryKey.Fingerprint == key.PrimaryKey.Fingerprint && candidate.PrivateKey != nil {
+				return candidate
+			}
+		}
+	}
+	return nil
+}
+
+// errNoPassphrase is returned by passphraseCache if the passphrase could not
+// be obtained.
+var errNoPassphrase = errors.New("no passphrase available")
+
+// passphraseCache requests a passphrase at most once, so that the same
+// passphrase can be tried for several keys.
+type passphraseCache struct {
+	get    PassphraseFunc
+	secret []byte
+	err    error
+}
+
+// passphrase returns the passphrase, requesting it on the first call.
+func (c *passphraseCache) passphrase() ([]byte, error) {
+	if c.secret == nil && c.err == nil {
+		c.secret, c.err = c.get()
+		if c.err != nil {
+			logger.Errorf("unable to get passphrase: %s", c.err)
+			c.err = errNoPassphrase
+		} else if c.secret == nil {
+			c.secret = []byte{}
+		}
+	}
+	return c.secret, c.err
+}
+
+// clear overwrites the passphrase in memory.
+func (c *passphraseCache) clear() {
+	zeroBytes(c.secret)
+}
+
+// unlockKey decrypts all encrypted private parts of the given key. The
+// passphrase is only requested if there are any.
+func unlockKey(key *openpgp.Entity, cache *passphraseCache) error {
+	keys := []*packet.PrivateKey{key.PrivateKey}
+	for _, subkey := range key.Subkeys {
+		keys = append(keys, subkey.PrivateKey)
+	}
+	for _, priv := range keys {
+		if priv == nil || !priv.Encrypted {
+			continue
+		}
+		secret, err := cache.passphrase()
 		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt private key: %s", err)
+			return err
+		}
+		err = priv.Decrypt(secret)
+		if err != nil {
+			return err
 		}
 	}
-	return foundKey, nil
+	return nil
 }
 
 // NewEncryptor returns a new PGPEncryptor instance, which is ready for
-// encrypting one single mail.
-func (t *PGPTransformer) NewEncryptor() (*PGPEncryptor, error) {
-	return NewPGPEncryptor(t.encryptionKey, t.signingKey, t.keepHeaders)
+// encrypting one single mail to the given recipients, see Recipients.
+func (t *PGPTransformer) NewEncryptor(recipients []*openpgp.Entity) (*PGPEncryptor, error) {
+	return NewPGPEncryptor(recipients, t.signer, t.keepHeaders, t.spooler)
 }
 
-// NewDecryptor returns and initializes a new PGPDecryptor instance.
+// NewDecryptor returns and initializes a new PGPDecryptor instance, which
+// uses the locally available private keys of the recipients.
 func (t *PGPTransformer) NewDecryptor() *PGPDecryptor {
-	return NewPGPDecryptor(t.signingKey, t.encryptionKey, t.encryptionKeyPassphrase)
+	return NewPGPDecryptor(t.signingKey, t.decryptionKeys, t.spooler)
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mxk/go-imap/imap"
+	"golang.org/x/crypto/openpgp"
+	. "gopkg.in/check.v1"
+)
+
+type PGPTransformerSuite struct {
+	dir      string
+	alice    *openpgp.Entity
+	bob      *openpgp.Entity
+	recovery *openpgp.Entity
+}
+
+var _ = Suite(&PGPTransformerSuite{})
+
+func (s *PGPTransformerSuite) SetUpSuite(c *C) {
+	var err error
+	s.alice, err = openpgp.NewEntity("Alice", "", "alice@example.org", nil)
+	c.Assert(err, IsNil)
+	s.bob, err = openpgp.NewEntity("Bob", "", "bob@example.org", nil)
+	c.Assert(err, IsNil)
+	s.recovery, err = openpgp.NewEntity("Recovery", "", "recovery@example.org", nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *PGPTransformerSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	// the public keyring contains both keys, but only Alice's private key
+	// is available locally
+	s.writeKeyring(c, "pubring.gpg", false, s.alice, s.bob, s.recovery)
+	s.writeKeyring(c, "secring.gpg", true, s.alice)
+	s.writeKeyring(c, "recovery.gpg", true, s.recovery)
+}
+
+// writeKeyring stores the given keys in a binary keyring in the test
+// directory.
+func (s *PGPTransformerSuite) writeKeyring(c *C, name string, private bool, keys ...*openpgp.Entity) {
+	fd, err := os.Create(filepath.Join(s.dir, name))
+	c.Assert(err, IsNil)
+	defer fd.Close()
+	for _, key := range keys {
+		if private {
+			c.Assert(key.SerializePrivate(fd, nil), IsNil)
+		} else {
+			c.Assert(key.Serialize(fd), IsNil)
+		}
+	}
+}
+
+// newTransformer returns a transformer which has loaded both keys as
+// encryption keys and Alice's key as the signing key.
+func (s *PGPTransformerSuite) newTransformer(c *C) *PGPTransformer {
+	t := NewPGPTransformer([]string{"Subject"})
+	c.Assert(t.LoadEncryptionKeys(filepath.Join(s.dir, "pubring.gpg"),
+		[]string{s.alice.PrimaryKey.KeyIdShortString(), s.bob.PrimaryKey.KeyIdShortString()},
+		[]string{filepath.Join(s.dir, "secring.gpg")}, nil), IsNil)
+	c.Assert(t.LoadSigningKey(filepath.Join(s.dir, "secring.gpg"), s.alice.PrimaryKey.KeyIdShortString(),
+		nil), IsNil)
+	return t
+}
+
+func (s *PGPTransformerSuite) TestRecipients(c *C) {
+	t := s.newTransformer(c)
+	alice, bob := s.alice.PrimaryKey.KeyIdShortString(), s.bob.PrimaryKey.KeyIdShortString()
+	recipients, err := t.Recipients([]string{alice, bob})
+	c.Assert(err, IsNil)
+	c.Assert(recipients, HasLen, 2)
+	_, err = t.Recipients([]string{bob})
+	c.Assert(err, ErrorMatches, "none of the recipients \\("+bob+"\\) has a private key .*")
+	_, err = t.Recipients([]string{"DEADBEEF"})
+	c.Assert(err, ErrorMatches, "encryption key with keyid=DEADBEEF has not been loaded")
+}
+
+func (s *PGPTransformerSuite) TestMissingKey(c *C) {
+	t := NewPGPTransformer(nil)
+	err := t.LoadEncryptionKeys(filepath.Join(s.dir, "pubring.gpg"), []string{"DEADBEEF"}, nil, nil)
+	c.Assert(err, ErrorMatches, "no key with keyid=DEADBEEF")
+}
+
+// encrypt returns a test message encrypted to the given recipients.
+func (s *PGPTransformerSuite) encrypt(c *C, t *PGPTransformer, recipients []*openpgp.Entity) imap.Literal {
+	e, err := t.NewEncryptor(recipients)
+	c.Assert(err, IsNil)
+	_, err = e.Write([]byte("Subject: team\r\nMessage-Id: <1@example.org>\r\n\r\nhello\r\n"))
+	c.Assert(err, IsNil)
+	encMail, err := e.GetLiteral()
+	c.Assert(err, IsNil)
+	return encMail
+}
+
+// assertDecryptable checks that the given message can be decrypted using
+// each of the given keys on its own.
+func (s *PGPTransformerSuite) assertDecryptable(c *C, encMail imap.Literal, keys ...*openpgp.Entity) {
+	for _, key := range keys {
+		d := NewPGPDecryptor(s.alice, openpgp.EntityList{key}, nil)
+		_, err := encMail.WriteTo(d)
+		c.Assert(err, IsNil)
+		r, err := d.GetNonVerifyingReader()
+		c.Assert(err, IsNil)
+		plain, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.HasSuffix(plain, []byte("\r\n\r\nhello\r\n")), Equals, true)
+		c.Assert(d.Verify(), IsNil)
+		d.Close()
+	}
+}
+
+func (s *PGPTransformerSuite) TestMultipleRecipients(c *C) {
+	t := s.newTransformer(c)
+	recipients, err := t.Recipients([]string{s.alice.PrimaryKey.KeyIdShortString(),
+		s.bob.PrimaryKey.KeyIdShortString()})
+	c.Assert(err, IsNil)
+	encMail := s.encrypt(c, t, recipients)
+	defer closeLiteral(encMail)
+	s.assertDecryptable(c, encMail, s.alice, s.bob)
+}
+
+func (s *PGPTransformerSuite) TestRecoveryKey(c *C) {
+	t := s.newTransformer(c)
+	c.Assert(t.LoadRecoveryKey(filepath.Join(s.dir, "pubring.gpg"), s.recovery.PrimaryKey.KeyIdShortString()),
+		IsNil)
+	recipients, err := t.Recipients([]string{s.alice.PrimaryKey.KeyIdShortString()})
+	c.Assert(err, IsNil)
+	c.Assert(recipients, DeepEquals, []*openpgp.Entity{t.encryptionKeys[s.alice.PrimaryKey.KeyIdShortString()],
+		t.recoveryKeys[0]})
+	encMail := s.encrypt(c, t, recipients)
+	defer closeLiteral(encMail)
+
+	// the recovery key can decrypt the message without the signing key
+	recoveryKey, err := loadPrivateKey(filepath.Join(s.dir, "recovery.gpg"),
+		s.recovery.PrimaryKey.KeyIdShortString(), nil, nil)
+	c.Assert(err, IsNil)
+	d := NewPGPDecryptor(nil, openpgp.EntityList{recoveryKey}, nil)
+	defer d.Close()
+	_, err = encMail.WriteTo(d)
+	c.Assert(err, IsNil)
+	r, err := d.GetNonVerifyingReader()
+	c.Assert(err, IsNil)
+	plain, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasSuffix(plain, []byte("\r\n\r\nhello\r\n")), Equals, true)
+
+	// messages to other recipients cannot be decrypted with the recovery key
+	t.recoveryKeys = nil
+	recipients, err = t.Recipients([]string{s.alice.PrimaryKey.KeyIdShortString()})
+	c.Assert(err, IsNil)
+	encMail = s.encrypt(c, t, recipients)
+	defer closeLiteral(encMail)
+	d = NewPGPDecryptor(nil, openpgp.EntityList{recoveryKey}, nil)
+	defer d.Close()
+	_, err = encMail.WriteTo(d)
+	c.Assert(err, IsNil)
+	_, err = d.GetNonVerifyingReader()
+	c.Assert(err, ErrorMatches, ".*incorrect key")
+}
+
+func (s *PGPTransformerSuite) TestEphemeralVerification(c *C) {
+	// Bob's private key is not available, but the ephemeral key allows
+	// verifying messages to him anyway
+	bob := s.bob.PrimaryKey.KeyIdShortString()
+	t := NewPGPTransformer([]string{"Subject"})
+	c.Assert(t.GenerateEphemeralKey(), IsNil)
+	c.Assert(t.LoadEncryptionKeys(filepath.Join(s.dir, "pubring.gpg"), []string{bob},
+		[]string{filepath.Join(s.dir, "secring.gpg")}, nil), IsNil)
+	c.Assert(t.LoadSigningKey(filepath.Join(s.dir, "secring.gpg"), s.alice.PrimaryKey.KeyIdShortString(),
+		nil), IsNil)
+	recipients, err := t.Recipients([]string{bob})
+	c.Assert(err, IsNil)
+	c.Assert(recipients, DeepEquals, []*openpgp.Entity{t.encryptionKeys[bob], t.ephemeralKey})
+	encMail := s.encrypt(c, t, recipients)
+	defer closeLiteral(encMail)
+
+	d := t.NewDecryptor()
+	defer d.Close()
+	_, err = encMail.WriteTo(d)
+	c.Assert(err, IsNil)
+	r, err := d.GetNonVerifyingReader()
+	c.Assert(err, IsNil)
+	plain, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasSuffix(plain, []byte("\r\n\r\nhello\r\n")), Equals, true)
+	c.Assert(d.Verify(), IsNil)
+	c.Assert(d.VerifyRecipients(recipients), IsNil)
+	c.Assert(d.VerifyRecipients([]*openpgp.Entity{s.alice}), ErrorMatches,
+		"message is not encrypted to keyid=.* of key with fingerprint=.*")
+
+	// the recipient can decrypt the message as usual
+	s.assertDecryptable(c, encMail, s.bob)
+}
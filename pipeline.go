@@ -0,0 +1,97 @@
+package main
+
+import "sync"
+
+// Pipeline runs the CPU-intensive part of message processing on a bounded
+// number of concurrent workers, while the results are completed one at a time
+// in the order in which they have been submitted.
+//
+// At most 2*workers submitted messages are in flight at any time; Submit
+// blocks until there is room for another one. This bounds memory usage and
+// lets the network connection apply backpressure.
+type Pipeline struct {
+	work      chan *pipelineJob
+	pending   chan *pipelineJob
+	workersWg sync.WaitGroup
+	completed chan struct{}
+}
+
+// PipelineTransformFunc performs the CPU-intensive part of processing a
+// message and returns the function which completes it.
+type PipelineTransformFunc func() MessageStoreFunc
+
+// PipelineCompleteFunc is invoked with the result of completing a message.
+type PipelineCompleteFunc func(error)
+
+// pipelineJob represents a single submitted message.
+type pipelineJob struct {
+	transform PipelineTransformFunc
+	complete  PipelineCompleteFunc
+	store     MessageStoreFunc
+	finished  chan struct{}
+}
+
+// NewPipeline returns a new Pipeline instance with the given number of
+// workers, which are started immediately.
+func NewPipeline(workers int) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pipeline{
+		work:      make(chan *pipelineJob),
+		pending:   make(chan *pipelineJob, 2*workers),
+		completed: make(chan struct{}),
+	}
+	p.workersWg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.runWorker()
+	}
+	go p.runCompleter()
+	return p
+}
+
+// Submit queues a message for processing. transform is run on one of the
+// workers, the function returned by it is then run in submission order,
+// followed by complete. complete may be nil.
+func (p *Pipeline) Submit(transform PipelineTransformFunc, complete PipelineCompleteFunc) {
+	job := &pipelineJob{
+		transform: transform,
+		complete:  complete,
+		finished:  make(chan struct{}),
+	}
+	p.pending <- job
+	p.work <- job
+}
+
+// Close waits until all submitted messages have been completed and stops
+// the workers. The Pipeline must not be used afterwards.
+func (p *Pipeline) Close() {
+	close(p.work)
+	close(p.pending)
+	p.workersWg.Wait()
+	<-p.completed
+}
+
+// runWorker transforms messages until the pipeline is closed.
+func (p *Pipeline) runWorker() {
+	defer p.workersWg.Done()
+	for job := range p.work {
+		job.store = job.transform()
+		close(job.finished)
+	}
+}
+
+// runCompleter completes the transformed messages in submission order.
+func (p *Pipeline) runCompleter() {
+	defer close(p.completed)
+	for job := range p.pending {
+		<-job.finished
+		var err error
+		if job.store != nil {
+			err = job.store()
+		}
+		if job.complete != nil {
+			job.complete(err)
+		}
+	}
+}
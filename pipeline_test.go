@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type PipelineSuite struct{}
+
+var _ = Suite(&PipelineSuite{})
+
+func (s *PipelineSuite) TestOrder(c *C) {
+	const workers = 4
+	p := NewPipeline(workers)
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	var stored []int
+	var failed []int
+	for i := 0; i < 40; i++ {
+		i := i
+		p.Submit(func() MessageStoreFunc {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(time.Duration(40-i) * 100 * time.Microsecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return func() error {
+				stored = append(stored, i)
+				if i%10 == 0 {
+					return errors.New("failed")
+				}
+				return nil
+			}
+		}, func(err error) {
+			if err != nil {
+				failed = append(failed, i)
+			}
+		})
+	}
+	p.Close()
+	c.Assert(len(stored), Equals, 40)
+	for i, val := range stored {
+		c.Assert(val, Equals, i)
+	}
+	c.Assert(failed, DeepEquals, []int{0, 10, 20, 30})
+	c.Assert(maxRunning <= workers, Equals, true)
+}
+
+func (s *PipelineSuite) TestNilStore(c *C) {
+	p := NewPipeline(0)
+	var results []error
+	p.Submit(func() MessageStoreFunc { return nil }, func(err error) {
+		results = append(results, err)
+	})
+	p.Submit(func() MessageStoreFunc { return nil }, nil)
+	p.Close()
+	c.Assert(results, DeepEquals, []error{nil})
+}
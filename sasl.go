@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Supported values for the server.auth config option. If none is
+// configured, the best mechanism offered by the server is chosen, see
+// chooseMechanism.
+const (
+	// AuthLogin uses the LOGIN command with username and password.
+	AuthLogin = "login"
+
+	// AuthPlain uses AUTHENTICATE PLAIN (RFC 4616) with username and
+	// password and, optionally, an authorization identity.
+	AuthPlain = "plain"
+
+	// AuthExternal uses AUTHENTICATE EXTERNAL (RFC 4422), i.e. the identity
+	// established by the TLS client certificate.
+	AuthExternal = "external"
+
+	// AuthXOAuth2 uses AUTHENTICATE XOAUTH2 with an OAuth2 access token.
+	AuthXOAuth2 = "xoauth2"
+
+	// AuthOAuthBearer uses AUTHENTICATE OAUTHBEARER (RFC 7628) with an
+	// OAuth2 access token.
+	AuthOAuthBearer = "oauthbearer"
+)
+
+// validateAuth returns an error if the given value is not a supported
+// server.auth setting.
+func validateAuth(auth string) error {
+	switch auth {
+	case "", AuthLogin, AuthPlain, AuthExternal, AuthXOAuth2, AuthOAuthBearer:
+		return nil
+	}
+	return fmt.Errorf("unsupported auth mechanism '%s' (expected %s, %s, %s, %s or %s)",
+		auth, AuthLogin, AuthPlain, AuthExternal, AuthXOAuth2, AuthOAuthBearer)
+}
+
+// isOAuth2 returns true if the given server.auth setting uses OAuth2 access
+// tokens.
+func isOAuth2(auth string) bool {
+	return auth == AuthXOAuth2 || auth == AuthOAuthBearer
+}
+
+// chooseMechanism returns the mechanism which is used for authenticating
+// with the given server, which announced the given capabilities. The
+// configured mechanism is used if the server supports it. Otherwise, EXTERNAL
+// is preferred if a client certificate but no password is configured, then
+// PLAIN and finally LOGIN.
+func chooseMechanism(server *ServerConfig, caps map[string]bool) (string, error) {
+	if server.Auth == AuthLogin {
+		// LOGIN is not announced as a capability, but may be disabled
+		if caps["LOGINDISABLED"] {
+			return "", fmt.Errorf("server has disabled LOGIN (available mechanisms: %s)", authMechanisms(caps))
+		}
+		return AuthLogin, nil
+	}
+	if server.Auth != "" {
+		if !caps["AUTH="+strings.ToUpper(server.Auth)] {
+			return "", fmt.Errorf("server does not support AUTH=%s (available mechanisms: %s)",
+				strings.ToUpper(server.Auth), authMechanisms(caps))
+		}
+		return server.Auth, nil
+	}
+	password := server.PasswordSecret()
+	passwordConfigured := password.Value != "" || password.Command != "" ||
+		password.File != "" || password.Env != ""
+	switch {
+	case server.ClientCertFile != "" && !passwordConfigured && caps["AUTH=EXTERNAL"]:
+		return AuthExternal, nil
+	case caps["AUTH=PLAIN"]:
+		return AuthPlain, nil
+	case !caps["LOGINDISABLED"] && server.AuthzID == "":
+		// LOGIN does not support authorization identities
+		return AuthLogin, nil
+	}
+	return "", fmt.Errorf("server offers no supported auth mechanism (available mechanisms: %s)",
+		authMechanisms(caps))
+}
+
+// authMechanisms returns the SASL mechanisms announced in the given
+// capabilities for use in error messages.
+func authMechanisms(caps map[string]bool) string {
+	var mechanisms []string
+	for _, capability := range sortedKeys(caps) {
+		if strings.HasPrefix(capability, "AUTH=") {
+			mechanisms = append(mechanisms, capability[5:])
+		}
+	}
+	if !caps["LOGINDISABLED"] {
+		mechanisms = append(mechanisms, "LOGIN command")
+	}
+	if len(mechanisms) == 0 {
+		return "none"
+	}
+	return strings.Join(mechanisms, ", ")
+}
+
+// plainAuth implements the PLAIN SASL mechanism. The authorization identity
+// may be empty; otherwise the server is asked to act as that user after
+// authenticating (e.g. an administrator accessing a user's mailbox).
+type plainAuth struct {
+	authzid  string
+	username string
+	password []byte
+	ir       []byte
+}
+
+// Start implements the imap.SASL interface.
+func (a *plainAuth) Start(s *imap.ServerInfo) (string, []byte, error) {
+	a.ir = append([]byte(a.authzid+"\x00"+a.username+"\x00"), a.password...)
+	return "PLAIN", a.ir, nil
+}
+
+// Next implements the imap.SASL interface. PLAIN does not expect any
+// challenges.
+func (a *plainAuth) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("unexpected server challenge")
+}
+
+// clear overwrites the password in memory.
+func (a *plainAuth) clear() {
+	zeroBytes(a.ir)
+}
+
+// externalAuth implements the EXTERNAL SASL mechanism, which relies on the
+// TLS client certificate. The authorization identity may be empty, which
+// makes the server derive it from the certificate.
+type externalAuth struct {
+	authzid string
+}
+
+// Start implements the imap.SASL interface.
+func (a *externalAuth) Start(s *imap.ServerInfo) (string, []byte, error) {
+	return "EXTERNAL", []byte(a.authzid), nil
+}
+
+// Next implements the imap.SASL interface. EXTERNAL does not expect any
+// challenges.
+func (a *externalAuth) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("unexpected server challenge")
+}
+
+// oauth2Auth implements the XOAUTH2 and OAUTHBEARER SASL mechanisms, which
+// send an OAuth2 access token as the initial response. If the token is
+// rejected, the server sends an error description (usually JSON) as a
+// challenge, which is remembered for reporting the failure.
+type oauth2Auth struct {
+	mechanism   string
+	username    string
+	token       []byte
+	address     string
+	ir          []byte
+	serverError string
+}
+
+// newOAuth2Auth returns a SASL client for the given mechanism (AuthXOAuth2
+// or AuthOAuthBearer). address is the server's host:port, which is part of
+// the OAUTHBEARER message.
+func newOAuth2Auth(mechanism, username string, token []byte, address string) *oauth2Auth {
+	return &oauth2Auth{
+		mechanism: mechanism,
+		username:  username,
+		token:     token,
+		address:   address,
+	}
+}
+
+// Start implements the imap.SASL interface.
+func (a *oauth2Auth) Start(s *imap.ServerInfo) (string, []byte, error) {
+	var ir []string
+	switch a.mechanism {
+	case AuthXOAuth2:
+		ir = []string{"user=" + a.username, "auth=Bearer "}
+	case AuthOAuthBearer:
+		// the authorization identity in the GS2 header requires escaping
+		user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.username)
+		ir = []string{"n,a=" + user + ","}
+		host, port, err := net.SplitHostPort(a.address)
+		if err == nil {
+			ir = append(ir, "host="+host, "port="+port)
+		}
+		ir = append(ir, "auth=Bearer ")
+	default:
+		return "", nil, fmt.Errorf("unsupported mechanism %s", a.mechanism)
+	}
+	a.ir = []byte(strings.Join(ir, "\x01"))
+	a.ir = append(a.ir, a.token...)
+	a.ir = append(a.ir, "\x01\x01"...)
+	return strings.ToUpper(a.mechanism), a.ir, nil
+}
+
+// Next implements the imap.SASL interface. Any challenge is an error
+// description; the expected dummy response makes the server fail the
+// command.
+func (a *oauth2Auth) Next(challenge []byte) ([]byte, error) {
+	a.serverError = string(challenge)
+	if a.mechanism == AuthOAuthBearer {
+		return []byte("\x01"), nil
+	}
+	return []byte{}, nil
+}
+
+// clear overwrites the access token in memory.
+func (a *oauth2Auth) clear() {
+	zeroBytes(a.ir)
+	zeroBytes(a.token)
+}
+
+// authError returns the error of a failed authentication, including the
+// server's error description if there is one.
+func (a *oauth2Auth) authError(err error) error {
+	if a.serverError == "" {
+		return err
+	}
+	return fmt.Errorf("%s (server reported: %s)", err, a.serverError)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type SASLSuite struct{}
+
+var _ = Suite(&SASLSuite{})
+
+func (s *SASLSuite) TestXOAuth2(c *C) {
+	auth := newOAuth2Auth(AuthXOAuth2, "doe@example.org", []byte("token"), "imap.example.org:993")
+	mech, ir, err := auth.Start(&imap.ServerInfo{TLS: true})
+	c.Assert(err, IsNil)
+	c.Assert(mech, Equals, "XOAUTH2")
+	c.Assert(string(ir), Equals, "user=doe@example.org\x01auth=Bearer token\x01\x01")
+
+	resp, err := auth.Next([]byte(`{"status":"401"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp, HasLen, 0)
+	c.Assert(auth.authError(errors.New("NO failed")), ErrorMatches, `NO failed \(server reported: {"status":"401"}\)`)
+
+	auth.clear()
+	c.Assert(ir, DeepEquals, make([]byte, len(ir)))
+}
+
+func (s *SASLSuite) TestOAuthBearer(c *C) {
+	auth := newOAuth2Auth(AuthOAuthBearer, "doe,jr=x@example.org", []byte("token"), "imap.example.org:993")
+	mech, ir, err := auth.Start(&imap.ServerInfo{TLS: true})
+	c.Assert(err, IsNil)
+	c.Assert(mech, Equals, "OAUTHBEARER")
+	c.Assert(string(ir), Equals, "n,a=doe=2Cjr=3Dx@example.org,\x01host=imap.example.org\x01port=993\x01"+
+		"auth=Bearer token\x01\x01")
+	resp, err := auth.Next([]byte(`{"status":"invalid_token"}`))
+	c.Assert(err, IsNil)
+	c.Assert(string(resp), Equals, "\x01")
+}
+
+var chooseMechanismTests = []struct {
+	server    ServerConfig
+	caps      []string
+	mechanism string
+	err       string
+}{
+	{ServerConfig{}, nil, AuthLogin, ""},
+	{ServerConfig{}, []string{"AUTH=PLAIN"}, AuthPlain, ""},
+	{ServerConfig{Auth: AuthLogin}, []string{"AUTH=PLAIN"}, AuthLogin, ""},
+	{ServerConfig{ClientCertFile: "cert.pem"}, []string{"AUTH=PLAIN", "AUTH=EXTERNAL"}, AuthExternal, ""},
+	{ServerConfig{ClientCertFile: "cert.pem", Password: "secret"}, []string{"AUTH=PLAIN", "AUTH=EXTERNAL"},
+		AuthPlain, ""},
+	{ServerConfig{Auth: AuthXOAuth2}, []string{"AUTH=XOAUTH2"}, AuthXOAuth2, ""},
+	{ServerConfig{Auth: AuthLogin}, []string{"LOGINDISABLED", "AUTH=XOAUTH2"}, "",
+		"server has disabled LOGIN \\(available mechanisms: XOAUTH2\\)"},
+	{ServerConfig{Auth: AuthOAuthBearer}, []string{"AUTH=XOAUTH2"}, "",
+		"server does not support AUTH=OAUTHBEARER \\(available mechanisms: XOAUTH2, LOGIN command\\)"},
+	{ServerConfig{AuthzID: "doe"}, nil, "", "server offers no supported auth mechanism .*"},
+	{ServerConfig{}, []string{"LOGINDISABLED"}, "",
+		"server offers no supported auth mechanism \\(available mechanisms: none\\)"},
+}
+
+func (s *SASLSuite) TestChooseMechanism(c *C) {
+	for i, tt := range chooseMechanismTests {
+		caps := make(map[string]bool)
+		for _, capability := range tt.caps {
+			caps[capability] = true
+		}
+		mechanism, err := chooseMechanism(&tt.server, caps)
+		if tt.err != "" {
+			c.Assert(err, ErrorMatches, tt.err, Commentf("test %d", i))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("test %d", i))
+		c.Assert(mechanism, Equals, tt.mechanism, Commentf("test %d", i))
+	}
+}
+
+func (s *SASLSuite) TestPlain(c *C) {
+	password := []byte("secret")
+	auth := &plainAuth{authzid: "doe", username: "admin", password: password}
+	mech, ir, err := auth.Start(&imap.ServerInfo{TLS: true})
+	c.Assert(err, IsNil)
+	c.Assert(mech, Equals, "PLAIN")
+	c.Assert(string(ir), Equals, "doe\x00admin\x00secret")
+	_, err = auth.Next([]byte("challenge"))
+	c.Assert(err, NotNil)
+	auth.clear()
+	c.Assert(ir, DeepEquals, make([]byte, len(ir)))
+	c.Assert(string(password), Equals, "secret")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Supported values for the unread and flagged filter options.
+const (
+	// FilterExclude skips messages with the respective property (default).
+	FilterExclude = "exclude"
+
+	// FilterInclude selects messages regardless of the respective property.
+	FilterInclude = "include"
+
+	// FilterOnly selects only messages with the respective property.
+	FilterOnly = "only"
+)
+
+// Supported values for the date filter option.
+const (
+	// DateAny requires either the sent date or the internal date to be
+	// older than the minimum age (default).
+	DateAny = "any"
+
+	// DateSent uses the date from the message's Date header.
+	DateSent = "sent"
+
+	// DateInternal uses the date when the message was stored on the server.
+	DateInternal = "internal"
+)
+
+// SearchFilter defines which messages of a folder are selected for
+// processing. Its zero value represents the default filter, which selects
+// read and unflagged messages of any size.
+type SearchFilter struct {
+	Unread          string
+	Flagged         string
+	MinSize         uint32
+	MaxSize         uint32
+	From            string
+	To              string
+	Subject         string
+	Keywords        []string
+	ExcludeKeywords []string
+	Date            string
+}
+
+// Validate checks the filter for unsupported values and returns an error
+// describing the first problem found.
+func (f *SearchFilter) Validate() error {
+	_, err := f.Query(0, time.Now())
+	return err
+}
+
+// Query compiles the filter to an IMAP SEARCH expression which selects all
+// matching messages, which are older than minAge relative to now. Messages
+// which have been deleted or which have already been processed by lemoncrypt
+// are never selected.
+func (f *SearchFilter) Query(minAge time.Duration, now time.Time) (string, error) {
+	criteria := []string{"UNDELETED"}
+	crit, err := f.stateCriterion("unread", f.Unread, "SEEN", "UNSEEN")
+	if err != nil {
+		return "", err
+	}
+	criteria = append(criteria, crit...)
+	crit, err = f.stateCriterion("flagged", f.Flagged, "UNFLAGGED", "FLAGGED")
+	if err != nil {
+		return "", err
+	}
+	criteria = append(criteria, crit...)
+	criteria = append(criteria, "(NOT HEADER "+CustomHeader+" \"\")")
+
+	if f.MinSize > 1 {
+		criteria = append(criteria, "LARGER "+strconv.FormatUint(uint64(f.MinSize)-1, 10))
+	}
+	if f.MaxSize > 0 {
+		if f.MaxSize < f.MinSize {
+			return "", fmt.Errorf("max_size (%d) is smaller than min_size (%d)", f.MaxSize, f.MinSize)
+		}
+		criteria = append(criteria, "SMALLER "+strconv.FormatUint(uint64(f.MaxSize)+1, 10))
+	}
+
+	for _, header := range []struct{ key, value string }{
+		{"FROM", f.From}, {"TO", f.To}, {"SUBJECT", f.Subject}} {
+		if header.value == "" {
+			continue
+		}
+		quoted, err := quoteSearchString(header.value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s filter: %s", strings.ToLower(header.key), err)
+		}
+		criteria = append(criteria, header.key+" "+quoted)
+	}
+
+	for _, keyword := range f.Keywords {
+		if !isAtom(keyword) {
+			return "", fmt.Errorf("invalid keyword '%s'", keyword)
+		}
+		criteria = append(criteria, "KEYWORD "+keyword)
+	}
+	for _, keyword := range f.ExcludeKeywords {
+		if !isAtom(keyword) {
+			return "", fmt.Errorf("invalid keyword '%s'", keyword)
+		}
+		criteria = append(criteria, "UNKEYWORD "+keyword)
+	}
+
+	dateStr := now.Add(-minAge).Format(IMAPDateFormat)
+	switch f.Date {
+	case "", DateAny:
+		criteria = append(criteria, "(OR SENTBEFORE "+dateStr+" BEFORE "+dateStr+")")
+	case DateSent:
+		criteria = append(criteria, "SENTBEFORE "+dateStr)
+	case DateInternal:
+		criteria = append(criteria, "BEFORE "+dateStr)
+	default:
+		return "", fmt.Errorf("unsupported date '%s' (expected %s, %s or %s)",
+			f.Date, DateAny, DateSent, DateInternal)
+	}
+	return strings.Join(criteria, " "), nil
+}
+
+// Matches evaluates the filter for a single message on behalf of sources
+// which cannot run IMAP searches. It selects the same messages as the
+// expression returned by Query. The filter has to be valid.
+func (f *SearchFilter) Matches(flags imap.FlagSet, idate time.Time, size uint32,
+	headers textproto.MIMEHeader, minAge time.Duration, now time.Time) bool {
+	if flags["\\Deleted"] || isEncrypted(headers) {
+		return false
+	}
+	if !matchesState(f.Unread, !flags["\\Seen"]) || !matchesState(f.Flagged, flags["\\Flagged"]) {
+		return false
+	}
+	if size < f.MinSize || (f.MaxSize > 0 && size > f.MaxSize) {
+		return false
+	}
+
+	for _, header := range []struct{ key, value string }{
+		{"From", f.From}, {"To", f.To}, {"Subject", f.Subject}} {
+		if header.value == "" {
+			continue
+		}
+		value := strings.ToLower(strings.Join(headers[header.key], " "))
+		if !strings.Contains(value, strings.ToLower(header.value)) {
+			return false
+		}
+	}
+
+	for _, keyword := range f.Keywords {
+		if !flags[keyword] {
+			return false
+		}
+	}
+	for _, keyword := range f.ExcludeKeywords {
+		if flags[keyword] {
+			return false
+		}
+	}
+
+	// like SENTBEFORE and BEFORE, only compare the dates
+	cutoff := now.Add(-minAge)
+	cutoff = time.Date(cutoff.Year(), cutoff.Month(), cutoff.Day(), 0, 0, 0, 0, cutoff.Location())
+	sentBefore := false
+	if sent, err := mail.ParseDate(headers.Get("Date")); err == nil {
+		sentDay := time.Date(sent.Year(), sent.Month(), sent.Day(), 0, 0, 0, 0, cutoff.Location())
+		sentBefore = sentDay.Before(cutoff)
+	}
+	internalBefore := idate.Before(cutoff)
+	switch f.Date {
+	case DateSent:
+		return sentBefore
+	case DateInternal:
+		return internalBefore
+	}
+	return sentBefore || internalBefore
+}
+
+// matchesState returns true if a message, which has the property checked by
+// a flag-based filter option if has is true, is selected by that option.
+func matchesState(value string, has bool) bool {
+	switch value {
+	case FilterInclude:
+		return true
+	case FilterOnly:
+		return has
+	}
+	return !has
+}
+
+// isEncrypted returns true if the given headers belong to a message which
+// has been encrypted by lemoncrypt.
+func isEncrypted(headers textproto.MIMEHeader) bool {
+	_, exists := headers[textproto.CanonicalMIMEHeaderKey(CustomHeader)]
+	return exists
+}
+
+// stateCriterion returns the search criteria for the given flag-based
+// filter option.
+func (f *SearchFilter) stateCriterion(name, value, exclude, only string) ([]string, error) {
+	switch value {
+	case "", FilterExclude:
+		return []string{exclude}, nil
+	case FilterInclude:
+		return nil, nil
+	case FilterOnly:
+		return []string{only}, nil
+	}
+	return nil, fmt.Errorf("unsupported %s filter '%s' (expected %s, %s or %s)",
+		name, value, FilterExclude, FilterInclude, FilterOnly)
+}
+
+// quoteSearchString returns s as an IMAP quoted string.
+// Only printable ASCII characters are supported as anything else would
+// require sending a literal with an explicit CHARSET.
+func quoteSearchString(s string) (string, error) {
+	for _, char := range s {
+		if char < 0x20 || char > 0x7e {
+			return "", fmt.Errorf("unsupported character %q", char)
+		}
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\"", nil
+}
+
+// isAtom returns true if s can be sent as an IMAP atom (rfc3501), as
+// required for keywords.
+func isAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, char := range s {
+		if char <= 0x20 || char > 0x7e || strings.ContainsRune("(){%*\"\\]", char) {
+			return false
+		}
+	}
+	return true
+}
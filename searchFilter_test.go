@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/textproto"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type SearchFilterSuite struct{}
+
+var _ = Suite(&SearchFilterSuite{})
+
+var searchFilterNow = time.Date(2015, 6, 30, 12, 0, 0, 0, time.UTC)
+
+var searchFilterTests = []struct {
+	filter SearchFilter
+	minAge time.Duration
+	query  string
+}{
+	{SearchFilter{}, 30 * Day,
+		"UNDELETED SEEN UNFLAGGED (NOT HEADER X-Lemoncrypt \"\") " +
+			"(OR SENTBEFORE 31-May-2015 BEFORE 31-May-2015)"},
+	{SearchFilter{Unread: FilterInclude, Flagged: FilterInclude}, 0,
+		"UNDELETED (NOT HEADER X-Lemoncrypt \"\") " +
+			"(OR SENTBEFORE 30-Jun-2015 BEFORE 30-Jun-2015)"},
+	{SearchFilter{Unread: FilterOnly, Flagged: FilterOnly, Date: DateSent}, Day,
+		"UNDELETED UNSEEN FLAGGED (NOT HEADER X-Lemoncrypt \"\") SENTBEFORE 29-Jun-2015"},
+	{SearchFilter{Flagged: FilterExclude, Date: DateInternal}, 10 * Day,
+		"UNDELETED SEEN UNFLAGGED (NOT HEADER X-Lemoncrypt \"\") BEFORE 20-Jun-2015"},
+	{SearchFilter{MinSize: 1024, MaxSize: 2048, Date: DateInternal}, 0,
+		"UNDELETED SEEN UNFLAGGED (NOT HEADER X-Lemoncrypt \"\") " +
+			"LARGER 1023 SMALLER 2049 BEFORE 30-Jun-2015"},
+	{SearchFilter{From: "doe@example.org", To: "list", Subject: `say "hi" \o/`, Date: DateSent}, 0,
+		"UNDELETED SEEN UNFLAGGED (NOT HEADER X-Lemoncrypt \"\") " +
+			`FROM "doe@example.org" TO "list" SUBJECT "say \"hi\" \\o/" SENTBEFORE 30-Jun-2015`},
+	{SearchFilter{Keywords: []string{"$Archive", "Work"}, ExcludeKeywords: []string{"$Junk"},
+		Date: DateSent}, 0,
+		"UNDELETED SEEN UNFLAGGED (NOT HEADER X-Lemoncrypt \"\") " +
+			"KEYWORD $Archive KEYWORD Work UNKEYWORD $Junk SENTBEFORE 30-Jun-2015"},
+}
+
+func (s *SearchFilterSuite) TestQuery(c *C) {
+	for _, tt := range searchFilterTests {
+		query, err := tt.filter.Query(tt.minAge, searchFilterNow)
+		c.Assert(err, IsNil)
+		c.Assert(query, Equals, tt.query)
+	}
+}
+
+var invalidSearchFilterTests = []struct {
+	filter SearchFilter
+	err    string
+}{
+	{SearchFilter{Unread: "maybe"}, "unsupported unread filter 'maybe'.*"},
+	{SearchFilter{Flagged: "yes"}, "unsupported flagged filter 'yes'.*"},
+	{SearchFilter{Date: "received"}, "unsupported date 'received'.*"},
+	{SearchFilter{MinSize: 10, MaxSize: 5}, "max_size \\(5\\) is smaller than min_size \\(10\\)"},
+	{SearchFilter{Subject: "line\r\nbreak"}, "invalid subject filter: unsupported character.*"},
+	{SearchFilter{From: "Jürgen"}, "invalid from filter: unsupported character.*"},
+	{SearchFilter{Keywords: []string{"two words"}}, "invalid keyword 'two words'"},
+	{SearchFilter{ExcludeKeywords: []string{"(paren"}}, "invalid keyword '\\(paren'"},
+	{SearchFilter{Keywords: []string{""}}, "invalid keyword ''"},
+}
+
+func (s *SearchFilterSuite) TestInvalid(c *C) {
+	for _, tt := range invalidSearchFilterTests {
+		c.Assert(tt.filter.Validate(), ErrorMatches, tt.err)
+	}
+}
+
+func (s *SearchFilterSuite) TestFolderFilter(c *C) {
+	cfg := &Config{}
+	cfg.Mailbox.Filter.Unread = FilterInclude
+	cfg.Mailbox.FolderFilters = map[string]SearchFilter{
+		"INBOX.Lists": SearchFilter{From: "list@example.org"},
+	}
+	c.Assert(cfg.FolderFilter("INBOX").Unread, Equals, FilterInclude)
+	c.Assert(cfg.FolderFilter("INBOX.Lists").Unread, Equals, "")
+	c.Assert(cfg.FolderFilter("INBOX.Lists").From, Equals, "list@example.org")
+}
+
+var matchesTests = []struct {
+	filter  SearchFilter
+	flags   imap.FlagSet
+	idate   time.Time
+	headers textproto.MIMEHeader
+	matches bool
+}{
+	{SearchFilter{}, imap.NewFlagSet("\\Seen"), time.Date(2015, 5, 30, 0, 0, 0, 0, time.UTC), nil, true},
+	{SearchFilter{}, imap.NewFlagSet("\\Seen"), time.Date(2015, 5, 31, 0, 0, 0, 0, time.UTC), nil, false},
+	{SearchFilter{}, imap.NewFlagSet("\\Seen"), searchFilterNow,
+		textproto.MIMEHeader{"Date": {"Sat, 30 May 2015 23:00:00 +0200"}}, true},
+	{SearchFilter{Date: DateInternal}, imap.NewFlagSet("\\Seen"), searchFilterNow,
+		textproto.MIMEHeader{"Date": {"Sat, 30 May 2015 23:00:00 +0200"}}, false},
+	{SearchFilter{}, imap.NewFlagSet(), time.Time{}, nil, false},
+	{SearchFilter{Unread: FilterOnly}, imap.NewFlagSet(), time.Time{}, nil, true},
+	{SearchFilter{}, imap.NewFlagSet("\\Seen", "\\Flagged"), time.Time{}, nil, false},
+	{SearchFilter{}, imap.NewFlagSet("\\Seen", "\\Deleted"), time.Time{}, nil, false},
+	{SearchFilter{}, imap.NewFlagSet("\\Seen"), time.Time{},
+		textproto.MIMEHeader{"X-Lemoncrypt": {""}}, false},
+	{SearchFilter{MaxSize: 99}, imap.NewFlagSet("\\Seen"), time.Time{}, nil, false},
+	{SearchFilter{From: "DOE@example"}, imap.NewFlagSet("\\Seen"), time.Time{},
+		textproto.MIMEHeader{"From": {"John Doe <doe@example.org>"}}, true},
+	{SearchFilter{Subject: "news"}, imap.NewFlagSet("\\Seen"), time.Time{},
+		textproto.MIMEHeader{"Subject": {"Hello"}}, false},
+	{SearchFilter{Keywords: []string{"Work"}}, imap.NewFlagSet("\\Seen"), time.Time{}, nil, false},
+	{SearchFilter{ExcludeKeywords: []string{"$Junk"}}, imap.NewFlagSet("\\Seen", "$Junk"), time.Time{},
+		nil, false},
+}
+
+func (s *SearchFilterSuite) TestMatches(c *C) {
+	for i, tt := range matchesTests {
+		matches := tt.filter.Matches(tt.flags, tt.idate, 100, tt.headers, 30*Day, searchFilterNow)
+		c.Assert(matches, Equals, tt.matches, Commentf("test %d", i))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Secret describes where a password or passphrase is obtained from. At most
+// one of the sources may be configured; if none is, the user is prompted
+// for the secret on the terminal.
+type Secret struct {
+	// Value is the secret itself, stored in the config file.
+	Value string
+	// Command is run using the shell; its output is the secret.
+	Command string
+	// File is the path of a file containing the secret.
+	File string
+	// Env is the name of an environment variable containing the secret.
+	Env string
+}
+
+// promptMutex makes sure that only one prompt is shown at a time, even if
+// several accounts are processed concurrently.
+var promptMutex sync.Mutex
+
+// promptSecret asks the user for a secret without echoing the input. It is
+// a variable to allow for replacing it in tests.
+var promptSecret = func(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("not configured and stdin is not a terminal")
+	}
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	secret, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return secret, err
+}
+
+// Validate returns an error if more than one source is configured.
+func (s *Secret) Validate() error {
+	configured := 0
+	for _, source := range []string{s.Value, s.Command, s.File, s.Env} {
+		if source != "" {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return errors.New("only one of the value, command, file and environment variable may be set")
+	}
+	return nil
+}
+
+// Resolve returns the secret from the configured source or, if there is
+// none, by prompting the user using the given prompt. The caller should
+// clear the returned slice using zeroBytes once it is no longer needed.
+func (s *Secret) Resolve(prompt string) ([]byte, error) {
+	err := s.Validate()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case s.Value != "":
+		return []byte(s.Value), nil
+	case s.Command != "":
+		return s.runCommand()
+	case s.File != "":
+		return s.readFile()
+	case s.Env != "":
+		value := os.Getenv(s.Env)
+		if value == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return []byte(value), nil
+	}
+	secret, err := promptSecret(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prompt for %s: %s", prompt, err)
+	}
+	return secret, nil
+}
+
+// runCommand runs the configured command and returns its output without
+// the trailing line break. Stdin and stderr are passed through, so that the
+// command may interact with the user (e.g. for unlocking a password store).
+func (s *Secret) runCommand() ([]byte, error) {
+	logger.Debugf("running password command")
+	cmd := exec.Command("/bin/sh", "-c", s.Command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		zeroBytes(out)
+		return nil, fmt.Errorf("password command failed: %s", err)
+	}
+	return trimLineBreak(out), nil
+}
+
+// readFile returns the content of the configured file without the trailing
+// line break. A warning is logged if the file is accessible by other users.
+func (s *Secret) readFile() ([]byte, error) {
+	path := expandTilde(s.File)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read password file: %s", err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		logger.Warningf("password file %s is accessible by other users (mode %s)", path, fi.Mode().Perm())
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read password file: %s", err)
+	}
+	return trimLineBreak(content), nil
+}
+
+// trimLineBreak removes a single trailing LF or CRLF line break.
+func trimLineBreak(secret []byte) []byte {
+	if bytes.HasSuffix(secret, []byte("\n")) {
+		secret = secret[:len(secret)-1]
+		if bytes.HasSuffix(secret, []byte("\r")) {
+			secret = secret[:len(secret)-1]
+		}
+	}
+	return secret
+}
+
+// zeroBytes overwrites the given secret in memory.
+func zeroBytes(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type SecretSuite struct{}
+
+var _ = Suite(&SecretSuite{})
+
+func (s *SecretSuite) TestSources(c *C) {
+	path := filepath.Join(c.MkDir(), "password")
+	c.Assert(ioutil.WriteFile(path, []byte("from file\n"), 0600), IsNil)
+	os.Setenv("LEMONCRYPT_TEST_SECRET", "from env")
+	defer os.Unsetenv("LEMONCRYPT_TEST_SECRET")
+
+	tests := []struct {
+		secret Secret
+		value  string
+	}{
+		{Secret{Value: "from config"}, "from config"},
+		{Secret{Command: "printf 'from command\\r\\n'"}, "from command"},
+		{Secret{Command: "printf 'no line break'"}, "no line break"},
+		{Secret{File: path}, "from file"},
+		{Secret{Env: "LEMONCRYPT_TEST_SECRET"}, "from env"},
+	}
+	for _, tt := range tests {
+		value, err := tt.secret.Resolve("unused")
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, tt.value)
+	}
+}
+
+func (s *SecretSuite) TestPrompt(c *C) {
+	defer func(orig func(string) ([]byte, error)) { promptSecret = orig }(promptSecret)
+	var prompt string
+	promptSecret = func(p string) ([]byte, error) {
+		prompt = p
+		return []byte("typed"), nil
+	}
+	value, err := (&Secret{}).Resolve("Password for user")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "typed")
+	c.Assert(prompt, Equals, "Password for user")
+
+	promptSecret = func(p string) ([]byte, error) {
+		return nil, errors.New("not a terminal")
+	}
+	_, err = (&Secret{}).Resolve("Password for user")
+	c.Assert(err, ErrorMatches, "unable to prompt for Password for user: not a terminal")
+}
+
+func (s *SecretSuite) TestErrors(c *C) {
+	_, err := (&Secret{Value: "a", File: "/b"}).Resolve("unused")
+	c.Assert(err, ErrorMatches, "only one of .* may be set")
+	_, err = (&Secret{Command: "exit 3"}).Resolve("unused")
+	c.Assert(err, ErrorMatches, "password command failed: exit status 3")
+	_, err = (&Secret{File: filepath.Join(c.MkDir(), "missing")}).Resolve("unused")
+	c.Assert(err, ErrorMatches, "unable to read password file: .*")
+	_, err = (&Secret{Env: "LEMONCRYPT_TEST_UNSET"}).Resolve("unused")
+	c.Assert(err, ErrorMatches, "environment variable LEMONCRYPT_TEST_UNSET is not set")
+}
+
+func (s *SecretSuite) TestZeroBytes(c *C) {
+	secret := []byte("secret")
+	zeroBytes(secret)
+	c.Assert(secret, DeepEquals, make([]byte, 6))
+}
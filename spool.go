@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// DefaultSpoolThresholdMB is the message size above which messages are
+// spooled to temporary files unless configured otherwise.
+const DefaultSpoolThresholdMB = 8
+
+// Spooler creates SpoolBuffers which share the same settings.
+// A nil Spooler creates buffers which never spool to disk.
+type Spooler struct {
+	threshold int64
+	dir       string
+}
+
+// NewSpooler returns a new Spooler instance. Buffers which grow beyond
+// threshold bytes are moved to a temporary file in dir (or the system's
+// default temporary directory if dir is empty).
+func NewSpooler(threshold int64, dir string) *Spooler {
+	return &Spooler{threshold: threshold, dir: dir}
+}
+
+// NewBuffer returns a new, empty SpoolBuffer.
+func (s *Spooler) NewBuffer() *SpoolBuffer {
+	if s == nil {
+		return &SpoolBuffer{threshold: -1}
+	}
+	return &SpoolBuffer{threshold: s.threshold, dir: s.dir}
+}
+
+// SpoolBuffer is a write-once buffer which keeps its contents in memory as
+// long as they are smaller than the configured threshold and moves them to
+// a temporary file otherwise. Once writing is complete, it can be used as an
+// imap.Literal. It has to be closed in order to release the temporary file.
+//
+// On systems which support it, the temporary file is unlinked right after
+// creation, so that no (possibly plaintext) data is left behind on disk if
+// lemoncrypt crashes.
+type SpoolBuffer struct {
+	threshold int64
+	dir       string
+	buf       *bytes.Buffer
+	file      *os.File
+	unlinked  bool
+	size      int64
+}
+
+// Write implements the io.Writer interface.
+func (b *SpoolBuffer) Write(data []byte) (int, error) {
+	if b.file == nil && b.threshold >= 0 && b.size+int64(len(data)) > b.threshold {
+		err := b.spill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	var l int
+	var err error
+	if b.file != nil {
+		l, err = b.file.Write(data)
+	} else {
+		if b.buf == nil {
+			b.buf = &bytes.Buffer{}
+		}
+		l, err = b.buf.Write(data)
+	}
+	b.size += int64(l)
+	return l, err
+}
+
+// spill moves the buffered data to a new temporary file.
+func (b *SpoolBuffer) spill() error {
+	fd, err := ioutil.TempFile(b.dir, "lemoncrypt-spool-")
+	if err != nil {
+		return fmt.Errorf("unable to create spool file: %s", err)
+	}
+	logger.Debugf("spooling message to %s", fd.Name())
+	// this fails on systems which do not support removing open files;
+	// the file is removed in .Close() then.
+	b.unlinked = os.Remove(fd.Name()) == nil
+	b.file = fd
+	if b.buf != nil {
+		_, err = fd.Write(b.buf.Bytes())
+		b.buf = nil
+		if err != nil {
+			return fmt.Errorf("unable to write spool file: %s", err)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of bytes written so far.
+func (b *SpoolBuffer) Len() int64 {
+	return b.size
+}
+
+// IsSpooled returns true if the contents have been moved to a temporary file.
+func (b *SpoolBuffer) IsSpooled() bool {
+	return b.file != nil
+}
+
+// Reader returns a new reader which starts at the beginning of the buffer.
+// Readers must not be used concurrently with Write.
+func (b *SpoolBuffer) Reader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	if b.buf == nil {
+		return bytes.NewReader(nil)
+	}
+	return bytes.NewReader(b.buf.Bytes())
+}
+
+// WriteTo implements the io.WriterTo interface (and thus part of the
+// imap.Literal interface) by writing the whole contents to w.
+func (b *SpoolBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.file == nil {
+		if b.buf == nil {
+			return 0, nil
+		}
+		l, err := w.Write(b.buf.Bytes())
+		return int64(l), err
+	}
+	return io.Copy(w, b.Reader())
+}
+
+// Info implements the imap.Literal interface.
+func (b *SpoolBuffer) Info() *imap.LiteralInfo {
+	return &imap.LiteralInfo{Len: uint32(b.size)}
+}
+
+// Close releases the memory or temporary file.
+func (b *SpoolBuffer) Close() error {
+	b.buf = nil
+	if b.file == nil {
+		return nil
+	}
+	name := b.file.Name()
+	err := b.file.Close()
+	b.file = nil
+	if !b.unlinked {
+		rmErr := os.Remove(name)
+		if err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// concatLiteral is an imap.Literal which consists of several parts. It is
+// used to build messages around large spooled contents without copying them.
+type concatLiteral []imap.Literal
+
+// WriteTo implements the io.WriterTo interface.
+func (c concatLiteral) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, part := range c {
+		l, err := part.WriteTo(w)
+		total += l
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Info implements the imap.Literal interface.
+func (c concatLiteral) Info() *imap.LiteralInfo {
+	var l uint32
+	for _, part := range c {
+		l += part.Info().Len
+	}
+	return &imap.LiteralInfo{Len: l}
+}
+
+// Close releases all parts which need to be closed.
+func (c concatLiteral) Close() error {
+	var err error
+	for _, part := range c {
+		partErr := closeLiteral(part)
+		if err == nil {
+			err = partErr
+		}
+	}
+	return err
+}
+
+// closeLiteral releases the resources held by the given literal, if any.
+func closeLiteral(lit imap.Literal) error {
+	closer, ok := lit.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close()
+}
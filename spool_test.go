@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type SpoolSuite struct{}
+
+var _ = Suite(&SpoolSuite{})
+
+func (s *SpoolSuite) TestInMemory(c *C) {
+	dir := c.MkDir()
+	b := NewSpooler(10, dir).NewBuffer()
+	b.Write([]byte("0123"))
+	b.Write([]byte("456789"))
+	c.Assert(b.IsSpooled(), Equals, false)
+	c.Assert(b.Len(), Equals, int64(10))
+	c.Assert(b.Info().Len, Equals, uint32(10))
+	out := &bytes.Buffer{}
+	l, err := b.WriteTo(out)
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, int64(10))
+	c.Assert(out.String(), Equals, "0123456789")
+	c.Assert(b.Close(), IsNil)
+}
+
+func (s *SpoolSuite) TestSpill(c *C) {
+	dir := c.MkDir()
+	b := NewSpooler(10, dir).NewBuffer()
+	b.Write([]byte("0123456789"))
+	b.Write([]byte("abc"))
+	c.Assert(b.IsSpooled(), Equals, true)
+	c.Assert(b.Len(), Equals, int64(13))
+	// the spool file is unlinked right away
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+
+	for i := 0; i < 2; i++ {
+		data, err := ioutil.ReadAll(b.Reader())
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "0123456789abc")
+	}
+	out := &bytes.Buffer{}
+	l, err := b.WriteTo(out)
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, int64(13))
+	c.Assert(out.String(), Equals, "0123456789abc")
+	c.Assert(b.Close(), IsNil)
+	c.Assert(b.Close(), IsNil)
+}
+
+func (s *SpoolSuite) TestNilSpooler(c *C) {
+	var spooler *Spooler
+	b := spooler.NewBuffer()
+	b.Write(make([]byte, 1024*1024))
+	c.Assert(b.IsSpooled(), Equals, false)
+	c.Assert(b.Len(), Equals, int64(1024*1024))
+}
+
+func (s *SpoolSuite) TestConcatLiteral(c *C) {
+	spooler := NewSpooler(2, c.MkDir())
+	var lit concatLiteral
+	for _, part := range []string{"a", "bcd", ""} {
+		b := spooler.NewBuffer()
+		b.Write([]byte(part))
+		lit = append(lit, b)
+	}
+	c.Assert(lit.Info().Len, Equals, uint32(4))
+	out := &bytes.Buffer{}
+	l, err := lit.WriteTo(out)
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, int64(4))
+	c.Assert(out.String(), Equals, "abcd")
+	c.Assert(closeLiteral(lit), IsNil)
+}
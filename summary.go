@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Summary collects per-folder statistics about the processed messages so
+// that they can be reported at the end of a dry run.
+type Summary struct {
+	folders []*FolderSummary
+	current *FolderSummary
+}
+
+// FolderSummary contains the statistics for a single folder.
+type FolderSummary struct {
+	Name       string
+	Messages   int
+	Failed     int
+	OrigSize   uint64
+	ResultSize uint64
+	Failures   []string
+}
+
+// NewSummary returns a new Summary instance.
+func NewSummary() *Summary {
+	return &Summary{}
+}
+
+// StartFolder begins collecting statistics for the given folder.
+func (s *Summary) StartFolder(name string) {
+	if s == nil {
+		return
+	}
+	s.current = &FolderSummary{Name: name}
+	s.folders = append(s.folders, s.current)
+}
+
+// Record adds the result of processing one message to the current folder's
+// statistics. result may be nil if processing failed.
+func (s *Summary) Record(idate *time.Time, orig, result imap.Literal, err error) {
+	if s == nil || s.current == nil {
+		return
+	}
+	s.current.Messages++
+	s.current.OrigSize += uint64(orig.Info().Len)
+	if err != nil {
+		s.current.Failed++
+		s.current.Failures = append(s.current.Failures,
+			fmt.Sprintf("%s: %s", describeMessage(idate, orig), err))
+		return
+	}
+	s.current.ResultSize += uint64(result.Info().Len)
+}
+
+// Failed returns the number of messages which could not be processed in all
+// folders.
+func (s *Summary) Failed() int {
+	failed := 0
+	for _, f := range s.folders {
+		failed += f.Failed
+	}
+	return failed
+}
+
+// Print outputs a human-readable report of the collected statistics.
+func (s *Summary) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "FOLDER\tMESSAGES\tFAILED\tORIG SIZE (B)\tRESULT SIZE (B)\n")
+	for _, f := range s.folders {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", f.Name, f.Messages, f.Failed, f.OrigSize, f.ResultSize)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	for _, f := range s.folders {
+		if len(f.Failures) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nfailures in %s:\n", f.Name)
+		for _, failure := range f.Failures {
+			_, err = fmt.Fprintf(w, "  %s\n", failure)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// describeMessage returns a short description of the given message which
+// allows users to find it in their mail client.
+func describeMessage(idate *time.Time, msg imap.Literal) string {
+	headers := readHeaders(msg)
+	desc := fmt.Sprintf("message-id=%s", headers.Get("Message-Id"))
+	if subject := headers.Get("Subject"); subject != "" {
+		desc += fmt.Sprintf(" subject=%q", subject)
+	}
+	if idate != nil {
+		desc += " date=" + idate.Format(time.RFC3339)
+	}
+	return desc
+}
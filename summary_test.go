@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	. "gopkg.in/check.v1"
+)
+
+type SummarySuite struct{}
+
+var _ = Suite(&SummarySuite{})
+
+// newTestSummary returns a summary of two folders, one of which contains a
+// message which could not be processed.
+func newTestSummary() *Summary {
+	orig := imap.NewLiteral([]byte("Message-Id: <1@example.org>\r\nSubject: hello\r\n\r\nbody\r\n"))
+	result := imap.NewLiteral([]byte("encrypted body"))
+	idate := time.Date(2020, 2, 1, 10, 0, 0, 0, time.UTC)
+	s := NewSummary()
+	s.StartFolder("INBOX")
+	s.Record(&idate, orig, result, nil)
+	s.Record(nil, orig, nil, errors.New("no key"))
+	s.StartFolder("Sent")
+	s.Record(&idate, orig, result, nil)
+	return s
+}
+
+func (s *SummarySuite) TestRecord(c *C) {
+	summary := newTestSummary()
+	c.Assert(summary.Failed(), Equals, 1)
+	c.Assert(summary.folders, HasLen, 2)
+	c.Assert(*summary.folders[0], DeepEquals, FolderSummary{
+		Name:       "INBOX",
+		Messages:   2,
+		Failed:     1,
+		OrigSize:   106,
+		ResultSize: 14,
+		Failures:   []string{`message-id=<1@example.org> subject="hello": no key`},
+	})
+	c.Assert(summary.folders[1].Messages, Equals, 1)
+	c.Assert(summary.folders[1].Failures, HasLen, 0)
+}
+
+func (s *SummarySuite) TestRecordWithoutFolder(c *C) {
+	summary := NewSummary()
+	summary.Record(nil, imap.NewLiteral([]byte("body")), nil, errors.New("failed"))
+	c.Assert(summary.Failed(), Equals, 0)
+	// a nil summary ignores all messages
+	var nilSummary *Summary
+	nilSummary.StartFolder("INBOX")
+	nilSummary.Record(nil, imap.NewLiteral([]byte("body")), nil, nil)
+}
+
+func (s *SummarySuite) TestPrint(c *C) {
+	var buf bytes.Buffer
+	c.Assert(newTestSummary().Print(&buf), IsNil)
+	c.Assert(buf.String(), Equals, ""+
+		"FOLDER  MESSAGES  FAILED  ORIG SIZE (B)  RESULT SIZE (B)\n"+
+		"INBOX   2         1       106            14\n"+
+		"Sent    1         0       53             14\n"+
+		"\n"+
+		"failures in INBOX:\n"+
+		"  message-id=<1@example.org> subject=\"hello\": no key\n")
+}
+
+func (s *SummarySuite) TestPrintSummary(c *C) {
+	var buf bytes.Buffer
+	a := &MailboxAction{cfg: &Config{account: "work"}, summary: NewSummary()}
+	a.printSummary(&buf)
+	c.Assert(buf.String(), Equals, "\naccount work:\n"+
+		"FOLDER  MESSAGES  FAILED  ORIG SIZE (B)  RESULT SIZE (B)\n")
+
+	// nothing is printed if no summary has been collected
+	buf.Reset()
+	a.summary = nil
+	a.printSummary(&buf)
+	c.Assert(buf.String(), Equals, "")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+const (
+	// DefaultRescanIntervalInMinutes is the default interval in which all
+	// folders are searched for messages which have aged past min_age_in_days.
+	DefaultRescanIntervalInMinutes = 60
+
+	// changeSettleDelay is the time to wait after a change has been reported
+	// before processing the folder, so that bursts of changes are handled at
+	// once.
+	changeSettleDelay = 10 * time.Second
+)
+
+// WatchAction provides the context for the watch action, which keeps
+// running and encrypts messages as soon as they match the configured filter.
+type WatchAction struct {
+	EncryptAction
+	watchers []*IMAPWatcher
+	changes  chan string
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Run starts the WatchAction. All selected accounts are watched
+// concurrently.
+func (a *WatchAction) Run(ctx *cli.Context) {
+	a.ctx = ctx
+	a.encrypting = true
+	err := a.loadConfig()
+	if err != nil {
+		os.Exit(1)
+	}
+	if a.dryRun {
+		logger.Errorf("watch does not support --dry-run")
+		os.Exit(1)
+	}
+
+	accounts, err := a.accounts()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	err = a.setupMetrics()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	a.handleSignals()
+	err = a.runAccounts(accounts, len(accounts), func(account *MailboxAction) error {
+		wa := &WatchAction{
+			EncryptAction: EncryptAction{MailboxAction: *account, metrics: a.metrics},
+			stop:          a.stop,
+		}
+		return wa.run()
+	})
+	a.metrics.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+	logger.Infof("shut down")
+}
+
+// run watches the action's account until the action is stopped.
+func (a *WatchAction) run() error {
+	if isLocalBackend(a.sourceServer.Type) {
+		logger.Errorf("watch requires an IMAP source")
+		return errors.New("watch requires an IMAP source")
+	}
+	defer a.clearCredentials()
+	err := a.setupSource()
+	if err != nil {
+		return err
+	}
+	defer a.closeSource()
+
+	err = a.setupJournal()
+	if err != nil {
+		return err
+	}
+	defer a.closeJournal()
+
+	err = a.setupTarget()
+	if err != nil {
+		return err
+	}
+	defer a.closeTarget()
+
+	err = a.setupPGP()
+	if err != nil {
+		return err
+	}
+
+	// done makes the goroutine exit if run returns without being stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-a.stop:
+			a.source.Stop()
+		case <-done:
+		}
+	}()
+	a.setupWatchers()
+	a.watch()
+	a.closeWatchers()
+	return nil
+}
+
+// handleSignals makes SIGTERM and SIGINT stop the action gracefully: the
+// batch of messages which is currently being processed is completed and
+// mail which has been marked as deleted is expunged before exiting.
+func (a *WatchAction) handleSignals() {
+	a.stop = make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		logger.Infof("received %s, shutting down after the current batch", sig)
+		signal.Stop(signals)
+		close(a.stop)
+	}()
+}
+
+// setupWatchers connects one IMAPWatcher per source folder and starts
+// watching. Folders which cannot be watched are only processed by the
+// periodic rescans.
+func (a *WatchAction) setupWatchers() {
+	a.changes = make(chan string, len(a.cfg.Mailbox.Folders))
+	for folder := range a.cfg.Mailbox.Folders {
+		watcher := NewIMAPWatcher(folder)
+		watcher.SetMaxRetries(a.sourceServer.MaxRetries)
+		err := watcher.Dial(a.sourceServer)
+		if err == nil {
+			err = a.login(watcher.IMAPConnection, a.sourceServer)
+		}
+		if err != nil {
+			logger.Warningf("unable to watch folder=%s, relying on periodic rescans", folder)
+			continue
+		}
+		a.watchers = append(a.watchers, watcher)
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			err := watcher.Watch(a.changes, a.stop)
+			if err != nil {
+				logger.Warningf("stopped watching folder=%s, relying on periodic rescans: %s",
+					watcher.mailbox, err)
+			}
+		}()
+	}
+}
+
+// closeWatchers waits for all watchers to stop and closes their connections.
+func (a *WatchAction) closeWatchers() {
+	a.wg.Wait()
+	for _, watcher := range a.watchers {
+		watcher.Close()
+	}
+}
+
+// watch processes all folders initially, periodically and whenever a
+// watcher reports a change, until the action is stopped.
+func (a *WatchAction) watch() {
+	interval := a.cfg.Watch.RescanIntervalInMinutes * time.Minute
+	if interval <= 0 {
+		interval = DefaultRescanIntervalInMinutes * time.Minute
+	}
+	rescan := time.NewTicker(interval)
+	defer rescan.Stop()
+	all := make(map[string]bool)
+	for folder := range a.cfg.Mailbox.Folders {
+		all[folder] = true
+	}
+	pending := make(map[string]bool)
+	var settle <-chan time.Time
+
+	a.processFolders(sortedKeys(all))
+	for {
+		select {
+		case <-a.stop:
+			return
+		case folder := <-a.changes:
+			pending[folder] = true
+			if settle == nil {
+				settle = time.After(changeSettleDelay)
+			}
+		case <-settle:
+			a.processFolders(sortedKeys(pending))
+			pending = make(map[string]bool)
+			settle = nil
+		case <-rescan.C:
+			logger.Infof("rescanning all folders")
+			a.processFolders(sortedKeys(all))
+		}
+	}
+}
+
+// processFolders encrypts the matching mails of the given source folders.
+// Errors are logged, but do not end the action, as the folders will be
+// processed again later.
+func (a *WatchAction) processFolders(folders []string) {
+	for _, folder := range folders {
+		if a.stopped() {
+			return
+		}
+		err := a.encryptFolder(folder)
+		if err == ErrUIDValidityChanged {
+			logger.Warningf("aborted folder=%s, processing it again with the next rescan", folder)
+		} else if err != nil {
+			logger.Errorf("failed to process folder=%s: %s", folder, err)
+		}
+	}
+}
+
+// stopped returns true if the action has been asked to stop.
+func (a *WatchAction) stopped() bool {
+	select {
+	case <-a.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sortedKeys returns the keys of the given set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}